@@ -0,0 +1,119 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultIPv4Prefix is the prefix length given to an IPv4 link address
+// without one, as every link address used to be a /24.
+const DefaultIPv4Prefix = 24
+
+// DefaultIPv6Prefix is the prefix length given to an IPv6 link address
+// without one.
+const DefaultIPv6Prefix = 64
+
+// ParseLinkAddrs parses the addresses of one end of a link: a comma separated
+// list of addresses in CIDR notation, like "10.0.0.1/31,fd00::1/127". An
+// address without a prefix length gets the default for its family.
+func ParseLinkAddrs(value string) ([]net.IPNet, error) {
+	var addrs []net.IPNet
+
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		addr, err := parseLinkAddr(field)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+func parseLinkAddr(field string) (net.IPNet, error) {
+	if !strings.Contains(field, "/") {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return net.IPNet{}, fmt.Errorf("invalid link address %q", field)
+		}
+
+		if ip.To4() != nil {
+			field = fmt.Sprintf("%s/%d", field, DefaultIPv4Prefix)
+		} else {
+			field = fmt.Sprintf("%s/%d", field, DefaultIPv6Prefix)
+		}
+	}
+
+	ip, ipnet, err := net.ParseCIDR(field)
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("invalid link address %q: %v", field, err)
+	}
+
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+
+	if !ip.IsGlobalUnicast() {
+		return net.IPNet{}, fmt.Errorf("invalid link address %q: not a global unicast address", field)
+	}
+
+	// Only the point-to-point prefixes (/31, /127) and host routes may use
+	// the network's own address.
+	ones, bits := ipnet.Mask.Size()
+	if ones < bits-1 && ip.Equal(ipnet.IP) {
+		return net.IPNet{}, fmt.Errorf("invalid link address %q: that's the network address, not a host in it", field)
+	}
+
+	return net.IPNet{IP: ip, Mask: ipnet.Mask}, nil
+}
+
+// validateLinkAddrs makes sure both ends of the link have addresses that
+// parse, and that the ends don't share one.
+func validateLinkAddrs(linki LinkInfo) error {
+	// A link without a pair is known by its interface.
+	name := linki.PairName
+	if !linki.HasPair() {
+		name = linki.LocalIFName
+	}
+
+	local, err := ParseLinkAddrs(linki.LocalIP)
+	if err != nil {
+		return fmt.Errorf("local_ip of link %v: %v", name, err)
+	}
+
+	pair, err := ParseLinkAddrs(linki.PairIP)
+	if err != nil {
+		return fmt.Errorf("pair_ip of link %v: %v", name, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range append(local, pair...) {
+		if seen[addr.IP.String()] {
+			return fmt.Errorf("link %v uses address %v more than once", name, addr.IP)
+		}
+		seen[addr.IP.String()] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLinkAddrs(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr string
+	}{
+		{value: "", want: nil},
+		{value: "192.168.2.100", want: []string{"192.168.2.100/24"}},
+		{value: "10.0.0.1/31", want: []string{"10.0.0.1/31"}},
+		{value: "10.0.0.0/31", want: []string{"10.0.0.0/31"}},
+		{value: "10.0.0.0/32", want: []string{"10.0.0.0/32"}},
+		{value: "fd00::1", want: []string{"fd00::1/64"}},
+		{value: "fd00::/127", want: []string{"fd00::/127"}},
+		{value: "10.0.0.1/31, fd00::1/127", want: []string{"10.0.0.1/31", "fd00::1/127"}},
+		{value: " 10.0.0.1 ,,", want: []string{"10.0.0.1/24"}},
+		{value: "10.0.0.0/24", wantErr: "that's the network address"},
+		{value: "fd00::/64", wantErr: "that's the network address"},
+		{value: "192.168.2.300", wantErr: `invalid link address "192.168.2.300"`},
+		{value: "10.0.0.1/33", wantErr: `invalid link address "10.0.0.1/33"`},
+		{value: "127.0.0.1", wantErr: "not a global unicast address"},
+		{value: "224.0.0.1/24", wantErr: "not a global unicast address"},
+		{value: "fe80::1", wantErr: "not a global unicast address"},
+		{value: "10.0.0.1, nope", wantErr: `invalid link address "nope"`},
+	}
+
+	for _, tt := range tests {
+		addrs, err := ParseLinkAddrs(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseLinkAddrs(%q) error = %v, want one saying %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLinkAddrs(%q): %v", tt.value, err)
+			continue
+		}
+
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ParseLinkAddrs(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config holds the configuration shared between ratchet and
+// ratchet-child: the CNI network config, and the link we're building.
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// NetConf is our network configuration as passed in as json
+type NetConf struct {
+	types.NetConf
+	CNIDir                   string                 `json:"cniDir"`
+	Delegate                 map[string]interface{} `json:"delegate"`
+	StateBackend             string                 `json:"state_backend"`
+	EtcdHost                 string                 `json:"etcd_host"`
+	EtcdPort                 string                 `json:"etcd_port"`
+	EtcdEndpoints            []string               `json:"etcd_endpoints"`
+	EtcdCAFile               string                 `json:"etcd_ca_file"`
+	EtcdCertFile             string                 `json:"etcd_cert_file"`
+	EtcdKeyFile              string                 `json:"etcd_key_file"`
+	EtcdUsername             string                 `json:"etcd_username"`
+	EtcdPassword             string                 `json:"etcd_password"`
+	EtcdTimeoutSeconds       int                    `json:"etcd_timeout_seconds"`
+	UseLabels                bool                   `json:"use_labels"`
+	ChildPath                string                 `json:"child_path"`
+	BootNetwork              map[string]interface{} `json:"boot_network"`
+	ParentIface              string                 `json:"parent_interface"`
+	ParentAddr               string                 `json:"parent_address"`
+	WaitForLinks             bool                   `json:"wait_for_links"`
+	LinkWaitSeconds          int                    `json:"link_wait_seconds"`
+	RendezvousTimeoutSeconds int                    `json:"rendezvous_timeout_seconds"`
+	RendezvousRetrySeconds   int                    `json:"rendezvous_retry_seconds"`
+	KokoDelaySeconds         *int                   `json:"koko_delay_seconds"`
+	LogLevel                 string                 `json:"log_level"`
+	LogFile                  string                 `json:"log_file"`
+	Kubeconfig               string                 `json:"kubeconfig"`
+	VxlanIDRange             *VxlanIDRange          `json:"vxlan_id_range"`
+	PeerNamespaces           map[string][]string    `json:"peer_namespaces"`
+	LeaseTTLSeconds          int                    `json:"lease_ttl_seconds"`
+	NodeName                 string                 `json:"node_name"`
+	MTU                      int                    `json:"mtu"`
+}
+
+// Node names the node we're running on: the node_name, else the hostname.
+func (n *NetConf) Node() (string, error) {
+	if n.NodeName != "" {
+		return n.NodeName, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname for the node name (set node_name): %v", err)
+	}
+
+	return hostname, nil
+}
+
+// MayLink says whether pods in namespace a may have links to pods in
+// namespace b. Pods in the same namespace always may; otherwise either
+// namespace has to list the other (or "*") in peer_namespaces.
+func (n *NetConf) MayLink(a string, b string) bool {
+	if a == b {
+		return true
+	}
+
+	return listsNamespace(n.PeerNamespaces[a], b) || listsNamespace(n.PeerNamespaces[b], a)
+}
+
+func listsNamespace(namespaces []string, namespace string) bool {
+	for _, listed := range namespaces {
+		if listed == namespace || listed == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VxlanIDRange bounds the VXLAN ids handed out to links, both ends included.
+type VxlanIDRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// LinkInfo defines the pair of links we're going to create
+type LinkInfo struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	PodName         string `json:"pod_name"`
+	TargetPod       string `json:"target_pod"`
+	TargetContainer string `json:"target_container"`
+	PublicIP        string `json:"public_ip"`
+	LocalIP         string `json:"local_ip"`
+	LocalIFName     string `json:"local_ifname"`
+	PairName        string `json:"pair_name"`
+	PairIP          string `json:"pair_ip"`
+	PairIFName      string `json:"pair_ifname"`
+	Primary         string `json:"primary"`
+	ParentIface     string `json:"parent_interface"`
+	ParentAddr      string `json:"parent_address"`
+
+	// Type is what kind of link this is, LinkTypeVeth unless set. Master,
+	// VlanID and MacvlanMode are for the link types with no pair, which
+	// are made of one of the node's interfaces.
+	Type        string `json:"type,omitempty"`
+	Master      string `json:"master,omitempty"`
+	VlanID      int    `json:"vlan_id,omitempty"`
+	MacvlanMode string `json:"macvlan_mode,omitempty"`
+
+	// MirrorIFName is the interface of ours a mirror link copies traffic
+	// of, and Mirror which of its traffic, MirrorBoth unless set.
+	MirrorIFName string `json:"mirror_ifname,omitempty"`
+	Mirror       string `json:"mirror,omitempty"`
+
+	// MTU is the link's MTU, the netconf's unless set. A vxlan's is never
+	// more than its parent interfaces can carry.
+	MTU int `json:"mtu,omitempty"`
+
+	// LocalMAC and PairMAC are the MACs of the link's ends. An end without
+	// one gets a MAC derived from its pod and interface name.
+	LocalMAC string `json:"local_mac,omitempty"`
+	PairMAC  string `json:"pair_mac,omitempty"`
+
+	// These override the netconf's timing, for this link.
+	RendezvousTimeoutSeconds Seconds `json:"rendezvous_timeout_seconds,omitempty"`
+	RendezvousRetrySeconds   Seconds `json:"rendezvous_retry_seconds,omitempty"`
+	KokoDelaySeconds         Seconds `json:"koko_delay_seconds,omitempty"`
+}
+
+// LinkTypeVeth, LinkTypeVlan, LinkTypeMacvlan and LinkTypeMirror are the
+// kinds of link there are: a veth between two pods (or a vxlan, when
+// they're on different nodes), a tagged VLAN sub-interface of one of the
+// node's interfaces, a MACVLAN on one of them, putting the pod on the node's
+// segment, and a veth (or vxlan) to a monitor pod, carrying a copy of the
+// traffic on one of our interfaces.
+const (
+	LinkTypeVeth    = "veth"
+	LinkTypeVlan    = "vlan"
+	LinkTypeMacvlan = "macvlan"
+	LinkTypeMirror  = "mirror"
+)
+
+// MirrorIngress, MirrorEgress and MirrorBoth are which traffic a mirror link
+// copies: what the mirrored interface receives, what it sends, or both.
+const (
+	MirrorIngress = "ingress"
+	MirrorEgress  = "egress"
+	MirrorBoth    = "both"
+)
+
+// MirrorDirection is which traffic the mirror link copies.
+func (l LinkInfo) MirrorDirection() string {
+	if l.Mirror == "" {
+		return MirrorBoth
+	}
+
+	return l.Mirror
+}
+
+// MirrorsIngress says whether the mirror link copies what the mirrored
+// interface receives.
+func (l LinkInfo) MirrorsIngress() bool {
+	return l.LinkType() == LinkTypeMirror && l.MirrorDirection() != MirrorEgress
+}
+
+// MirrorsEgress says whether the mirror link copies what the mirrored
+// interface sends.
+func (l LinkInfo) MirrorsEgress() bool {
+	return l.LinkType() == LinkTypeMirror && l.MirrorDirection() != MirrorIngress
+}
+
+// MacvlanBridge, MacvlanPrivate, MacvlanVepa and MacvlanPassthru are the
+// modes a MACVLAN link can be in, MacvlanBridge unless set.
+const (
+	MacvlanBridge   = "bridge"
+	MacvlanPrivate  = "private"
+	MacvlanVepa     = "vepa"
+	MacvlanPassthru = "passthru"
+)
+
+// Mode is the MACVLAN mode of the link.
+func (l LinkInfo) Mode() string {
+	if l.MacvlanMode == "" {
+		return MacvlanBridge
+	}
+
+	return l.MacvlanMode
+}
+
+// LinkType says what kind of link this is.
+func (l LinkInfo) LinkType() string {
+	if l.Type == "" {
+		return LinkTypeVeth
+	}
+
+	return l.Type
+}
+
+// HasPair says whether the link has a pod at its other end.
+func (l LinkInfo) HasPair() bool {
+	return l.LinkType() == LinkTypeVeth || l.LinkType() == LinkTypeMirror
+}
+
+// RolePrimary, RolePair and RoleElect are the roles an end of a link can
+// take: building the link, waiting for the other end to build it, or
+// agreeing with the other end on which of them builds it.
+const (
+	RolePrimary = "primary"
+	RolePair    = "pair"
+	RoleElect   = "elect"
+)
+
+// IsPrimary says whether we're the end of the link which builds it, by its
+// primary label. The mirrored end of a mirror link always builds it, since
+// only it can set up the mirror.
+func (l LinkInfo) IsPrimary() bool {
+	return l.Primary == "true" || l.LinkType() == LinkTypeMirror
+}
+
+// Role says how this end of the link decides who builds it. Without a
+// primary label, an end naming its peer takes part in an election, and one
+// that doesn't waits to be told.
+func (l LinkInfo) Role() string {
+	if l.IsPrimary() {
+		return RolePrimary
+	}
+
+	if l.Primary == "" && l.PairName != "" {
+		return RoleElect
+	}
+
+	return RolePair
+}
+
+// RoleConflict says what's wrong when the peer we name takes peerRole for
+// the link: both ends labelled primary would both build it, and both
+// labelled pair would leave it to never be built.
+func (l LinkInfo) RoleConflict(peerRole string) error {
+	switch {
+	case l.Role() == RolePrimary && peerRole == RolePrimary:
+		return fmt.Errorf("conflicting labels: %v and %v are both labelled primary, so both would build the link between them; label one of them \"false\", or neither to elect one", l.PodKey(), l.PairKey())
+	case l.Role() == RolePair && l.PairName != "" && peerRole == RolePair:
+		return fmt.Errorf("conflicting labels: %v and %v are both labelled as the pair, so neither builds the link between them; label one of them \"true\", or neither to elect one", l.PodKey(), l.PairKey())
+	}
+
+	return nil
+}
+
+// PodKey is our pod, as namespace/name.
+func (l LinkInfo) PodKey() string {
+	return QualifiedName(l.Namespace, l.PodName)
+}
+
+// PairKey is the pod on the other end of the link, as namespace/name. A
+// pair_name without a namespace is in our namespace. It's empty when we
+// (the pair) don't know who our primary is.
+func (l LinkInfo) PairKey() string {
+	if l.PairName == "" {
+		return ""
+	}
+
+	return QualifiedName(SplitPodName(l.PairName, l.Namespace))
+}
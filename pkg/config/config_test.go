@@ -0,0 +1,93 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestMayLink(t *testing.T) {
+	netconf := &NetConf{PeerNamespaces: map[string][]string{
+		"lab":     {"tools"},
+		"monitor": {"*"},
+	}}
+
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"default", "default", true},
+		{"lab", "tools", true},
+		{"tools", "lab", true},
+		{"lab", "default", false},
+		{"monitor", "default", true},
+		{"default", "monitor", true},
+		{"default", "tools", false},
+	}
+
+	for _, tt := range tests {
+		if got := netconf.MayLink(tt.a, tt.b); got != tt.want {
+			t.Errorf("MayLink(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPairKey(t *testing.T) {
+	tests := []struct {
+		linki LinkInfo
+		want  string
+	}{
+		{LinkInfo{Namespace: "lab", PairName: "pod-b"}, "lab/pod-b"},
+		{LinkInfo{Namespace: "lab", PairName: "other/pod-b"}, "other/pod-b"},
+		{LinkInfo{PairName: "pod-b"}, "default/pod-b"},
+		{LinkInfo{Namespace: "lab"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.linki.PairKey(); got != tt.want {
+			t.Errorf("PairKey of %+v = %q, want %q", tt.linki, got, tt.want)
+		}
+	}
+}
+
+func TestRole(t *testing.T) {
+	tests := []struct {
+		name         string
+		linki        LinkInfo
+		peerRole     string
+		wantRole     string
+		wantConflict bool
+	}{
+		{"primary", LinkInfo{Primary: "true", PairName: "b"}, RolePair, RolePrimary, false},
+		{"both primary", LinkInfo{Primary: "true", PairName: "b"}, RolePrimary, RolePrimary, true},
+		{"pair", LinkInfo{Primary: "false", PairName: "b"}, RolePrimary, RolePair, false},
+		{"both pair", LinkInfo{Primary: "false", PairName: "b"}, RolePair, RolePair, true},
+		{"pair not naming its primary", LinkInfo{}, RolePair, RolePair, false},
+		{"elect", LinkInfo{PairName: "b"}, RoleElect, RoleElect, false},
+		{"elect with a primary", LinkInfo{PairName: "b"}, RolePrimary, RoleElect, false},
+		{"mirror", LinkInfo{Type: LinkTypeMirror, PairName: "b"}, RolePair, RolePrimary, false},
+	}
+
+	for _, tt := range tests {
+		if role := tt.linki.Role(); role != tt.wantRole {
+			t.Errorf("%v: Role() = %v, want %v", tt.name, role, tt.wantRole)
+		}
+
+		err := tt.linki.RoleConflict(tt.peerRole)
+		if (err != nil) != tt.wantConflict {
+			t.Errorf("%v: RoleConflict(%v) = %v, want a conflict: %v", tt.name, tt.peerRole, err, tt.wantConflict)
+		}
+	}
+}
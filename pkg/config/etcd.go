@@ -0,0 +1,89 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/dougbtv/ratchet-cni/pkg/etcd"
+)
+
+// EtcdConfig gives how to reach etcd: the etcd_endpoints, else etcd_host
+// and etcd_port (over https when there's TLS to do), along with any TLS
+// files and login.
+func (n *NetConf) EtcdConfig() (etcd.Config, error) {
+	cfg := etcd.Config{
+		Endpoints:      n.EtcdEndpoints,
+		RequestTimeout: time.Duration(n.EtcdTimeoutSeconds) * time.Second,
+		Username:       n.EtcdUsername,
+		Password:       n.EtcdPassword,
+	}
+
+	if n.EtcdCAFile != "" || n.EtcdCertFile != "" || n.EtcdKeyFile != "" {
+		tlsConfig, err := n.etcdTLS()
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TLS = tlsConfig
+	}
+
+	if len(cfg.Endpoints) == 0 {
+		scheme := "http"
+		if cfg.TLS != nil {
+			scheme = "https"
+		}
+		cfg.Endpoints = []string{scheme + "://" + n.EtcdHost + ":" + n.EtcdPort}
+	}
+
+	if n.EtcdPassword != "" && n.EtcdUsername == "" {
+		return cfg, fmt.Errorf("etcd_password given without etcd_username")
+	}
+
+	return cfg, nil
+}
+
+func (n *NetConf) etcdTLS() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if n.EtcdCAFile != "" {
+		pem, err := ioutil.ReadFile(n.EtcdCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read etcd_ca_file: %v", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in etcd_ca_file %v", n.EtcdCAFile)
+		}
+	}
+
+	if (n.EtcdCertFile == "") != (n.EtcdKeyFile == "") {
+		return nil, fmt.Errorf("etcd_cert_file and etcd_key_file go together")
+	}
+
+	if n.EtcdCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(n.EtcdCertFile, n.EtcdKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load etcd client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
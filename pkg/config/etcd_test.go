@@ -0,0 +1,136 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dougbtv/ratchet-cni/pkg/etcd"
+	"github.com/dougbtv/ratchet-cni/pkg/etcd/etcdtest"
+	"golang.org/x/net/context"
+)
+
+func TestEtcdConfig(t *testing.T) {
+	srv := etcdtest.NewTLSServer()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ratchet-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		netconf       NetConf
+		wantEndpoints []string
+		wantTimeout   time.Duration
+		wantErr       string
+	}{
+		{
+			name:          "host and port",
+			netconf:       NetConf{EtcdHost: "localhost", EtcdPort: "2379", EtcdTimeoutSeconds: 3},
+			wantEndpoints: []string{"http://localhost:2379"},
+			wantTimeout:   3 * time.Second,
+		},
+		{
+			name:          "endpoints win over host and port",
+			netconf:       NetConf{EtcdHost: "localhost", EtcdPort: "2379", EtcdEndpoints: []string{"http://a:2379", "http://b:2379"}},
+			wantEndpoints: []string{"http://a:2379", "http://b:2379"},
+		},
+		{
+			name:          "https for TLS",
+			netconf:       NetConf{EtcdHost: "localhost", EtcdPort: "2379", EtcdCAFile: ca},
+			wantEndpoints: []string{"https://localhost:2379"},
+		},
+		{
+			name:    "missing CA file",
+			netconf: NetConf{EtcdCAFile: filepath.Join(dir, "missing.pem")},
+			wantErr: "failed to read etcd_ca_file",
+		},
+		{
+			name:    "CA file without certificates",
+			netconf: NetConf{EtcdCAFile: notPEM},
+			wantErr: "no certificates found in etcd_ca_file",
+		},
+		{
+			name:    "certificate without a key",
+			netconf: NetConf{EtcdCertFile: ca},
+			wantErr: "etcd_cert_file and etcd_key_file go together",
+		},
+		{
+			name:    "bad client certificate",
+			netconf: NetConf{EtcdCertFile: ca, EtcdKeyFile: notPEM},
+			wantErr: "failed to load etcd client certificate",
+		},
+		{
+			name:    "password without a username",
+			netconf: NetConf{EtcdEndpoints: []string{"http://a:2379"}, EtcdPassword: "secret"},
+			wantErr: "etcd_password given without etcd_username",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.netconf.EtcdConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("EtcdConfig error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EtcdConfig: %v", err)
+			}
+
+			if !reflect.DeepEqual(cfg.Endpoints, tt.wantEndpoints) {
+				t.Errorf("EtcdConfig endpoints = %v, want %v", cfg.Endpoints, tt.wantEndpoints)
+			}
+			if cfg.RequestTimeout != tt.wantTimeout {
+				t.Errorf("EtcdConfig request timeout = %v, want %v", cfg.RequestTimeout, tt.wantTimeout)
+			}
+		})
+	}
+
+	// The CA file is all it takes to reach etcd over TLS.
+	cfg, err := (&NetConf{EtcdEndpoints: []string{srv.URL}, EtcdCAFile: ca}).EtcdConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := etcd.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(context.Background(), "/ratchet/a", "a"); err != nil {
+		t.Errorf("Put over TLS with etcd_ca_file: %v", err)
+	}
+}
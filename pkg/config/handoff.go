@@ -0,0 +1,102 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// HandoffVersion is the version of the Handoff document this build speaks.
+// Bump it whenever a change to the document would confuse an older child.
+const HandoffVersion = "8"
+
+// Handoff is everything ratchet hands to ratchet-child to build a pod's links.
+type Handoff struct {
+	Version string     `json:"version"`
+	NetConf *NetConf   `json:"netconf"`
+	Links   []LinkInfo `json:"links"`
+	Args    CNIArgs    `json:"args"`
+}
+
+// CNIArgs are the CNI arguments ratchet was invoked with.
+type CNIArgs struct {
+	ContainerID string `json:"container_id"`
+	Netns       string `json:"netns"`
+	IfName      string `json:"ifname"`
+	Args        string `json:"args"`
+	Path        string `json:"path"`
+}
+
+// NewHandoff makes a Handoff of the current version.
+func NewHandoff(netconf *NetConf, links []LinkInfo, args CNIArgs) *Handoff {
+	return &Handoff{
+		Version: HandoffVersion,
+		NetConf: netconf,
+		Links:   links,
+		Args:    args,
+	}
+}
+
+// HandoffPath is where the spool file for a container's handoff lives.
+func HandoffPath(cniDir string, containerID string) string {
+	return filepath.Join(cniDir, "handoff", containerID+".json")
+}
+
+// WriteHandoff spools the handoff to a file under the netconf's CNIDir, and
+// returns the file's path.
+func WriteHandoff(h *Handoff) (string, error) {
+	path := HandoffPath(h.NetConf.CNIDir, h.Args.ContainerID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create the handoff directory(%q): %v", filepath.Dir(path), err)
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return "", fmt.Errorf("error serializing handoff: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write handoff in the path(%q): %v", path, err)
+	}
+
+	return path, nil
+}
+
+// ReadHandoff decodes a handoff, and rejects any version we don't speak.
+func ReadHandoff(r io.Reader) (*Handoff, error) {
+	h := &Handoff{}
+	if err := json.NewDecoder(r).Decode(h); err != nil {
+		return nil, fmt.Errorf("failed to decode handoff: %v", err)
+	}
+
+	if h.Version != HandoffVersion {
+		return nil, fmt.Errorf("unsupported handoff version %q (want %q)", h.Version, HandoffVersion)
+	}
+
+	if h.NetConf == nil {
+		return nil, fmt.Errorf("handoff is missing its netconf")
+	}
+
+	if len(h.Links) == 0 {
+		return nil, fmt.Errorf("handoff has no links")
+	}
+
+	return h, nil
+}
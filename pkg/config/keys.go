@@ -0,0 +1,184 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "strings"
+
+// DefaultNamespace is the namespace of pods the runtime doesn't give one.
+const DefaultNamespace = "default"
+
+// QualifiedName names a pod as namespace/name, which is how we key it, so
+// that pods of the same name in different namespaces are kept apart.
+func QualifiedName(namespace string, name string) string {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	return namespace + "/" + name
+}
+
+// SplitPodName splits a namespace/name into its namespace and name. A name
+// without a namespace is in namespace.
+func SplitPodName(podName string, namespace string) (string, string) {
+	if i := strings.Index(podName, "/"); i >= 0 {
+		return podName[:i], podName[i+1:]
+	}
+
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	return namespace, podName
+}
+
+// AssociationDir is where we keep what we know about a pod in etcd, given
+// as namespace/name.
+func AssociationDir(pod string) string {
+	return "/ratchet/association/" + pod
+}
+
+// v2AssociationDir holds each pod's association in ratchet's etcd v2 store,
+// keyed by the pod's name alone, and v2CounterKey the vxlan id counter.
+const (
+	v2AssociationDir = "/ratchet/association/"
+	v2CounterKey     = "/ratchet/vxlanid"
+)
+
+// V2Keys gives where the keys of ratchet's etcd v2 store, given as key to
+// value, belong now. Ratchet knew nothing of namespaces then, so
+// associations are taken to be of pods in the default namespace. A pod's
+// own id, parentiface and parentaddr go in its association as they were,
+// and what its primary wrote into it about their link (vxlanid, pairip,
+// pairifname and primaryname) goes in the link's dir. The vxlan id counter
+// keeps its key, so VNIs go on from where v2 left off. Nothing else carries
+// over: the rest is what the v2 plugin kept for itself, like the
+// /ratchet/<containerid> and /ratchet/byname keys.
+func V2Keys(v2 map[string]string) map[string]string {
+	keys := make(map[string]string)
+
+	if counter, ok := v2[v2CounterKey]; ok {
+		keys[v2CounterKey] = counter
+	}
+
+	for podName, fields := range v2Associations(v2) {
+		pod := QualifiedName("", podName)
+		for _, field := range []string{"id", "parentiface", "parentaddr"} {
+			if value, ok := fields[field]; ok {
+				keys[AssociationDir(pod)+"/"+field] = value
+			}
+		}
+
+		// Without its primary's name, there's no telling which link it is.
+		primaryName, ok := fields["primaryname"]
+		if !ok || primaryName == "" {
+			continue
+		}
+
+		primary := QualifiedName("", primaryName)
+		linkdir := LinkDir(pod, primary, "")
+		keys[linkdir+"/primaryname"] = primary
+		for _, field := range []string{"vxlanid", "pairip", "pairifname"} {
+			if value, ok := fields[field]; ok {
+				keys[linkdir+"/"+field] = value
+			}
+		}
+	}
+
+	return keys
+}
+
+// v2Associations gathers the fields of each pod's association out of the
+// keys of the etcd v2 store, by pod name.
+func v2Associations(v2 map[string]string) map[string]map[string]string {
+	associations := make(map[string]map[string]string)
+	for key, value := range v2 {
+		path := strings.Split(strings.TrimPrefix(key, v2AssociationDir), "/")
+		if !strings.HasPrefix(key, v2AssociationDir) || len(path) != 2 {
+			continue
+		}
+
+		podName, field := path[0], path[1]
+		if associations[podName] == nil {
+			associations[podName] = make(map[string]string)
+		}
+		associations[podName][field] = value
+	}
+
+	return associations
+}
+
+// LinksDir is where the primaries of a pod's links tell it about them.
+func LinksDir(pairPod string) string {
+	return AssociationDir(pairPod) + "/links"
+}
+
+// LinkDir is where the primary of a link tells the pair about it: under the
+// pair's association, named for the primary (and the link, if it's named).
+func LinkDir(pairPod string, primaryPod string, linkName string) string {
+	return LinksDir(pairPod) + "/" + linkID(primaryPod, linkName)
+}
+
+// FindLinkDir is, for a pair that doesn't know who its primary is, the dir
+// of the link named linkName out of those its primaries wrote under
+// LinksDir(pairPod), listed in ids. It's "" when there's none of that name.
+func FindLinkDir(pairPod string, ids []string, linkName string) string {
+	for _, id := range ids {
+		if linkIDName(id) == linkName {
+			return LinksDir(pairPod) + "/" + id
+		}
+	}
+
+	return ""
+}
+
+// PeerDir is where a pod says what it knows of its end of the link to peer:
+// its role, and its own address and interface.
+func PeerDir(pod string, peer string, linkName string) string {
+	return AssociationDir(pod) + "/peers/" + linkID(peer, linkName)
+}
+
+// ElectionsDir holds the elections of every link.
+const ElectionsDir = "/ratchet/election"
+
+// ElectionKey holds the pod elected to build the link between podA and
+// podB. It's the same key whichever end asks.
+func ElectionKey(podA string, podB string, linkName string) string {
+	if podB < podA {
+		podA, podB = podB, podA
+	}
+
+	return ElectionsDir + "/" + linkID(podA, "") + "," + linkID(podB, linkName)
+}
+
+// linkID names the link to pod in one key. Namespaces can't have dots in
+// them, so namespace.name keeps the pod's namespace and name apart.
+func linkID(pod string, linkName string) string {
+	id := strings.Replace(pod, "/", ".", 1)
+	if linkName != "" {
+		id += ":" + linkName
+	}
+
+	return id
+}
+
+// linkIDName is the name of the link a linkID is of, "" when it has none.
+// Neither namespaces nor pod names can have colons in them.
+func linkIDName(id string) string {
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[i+1:]
+	}
+
+	return ""
+}
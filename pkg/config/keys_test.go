@@ -0,0 +1,186 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQualifiedName(t *testing.T) {
+	tests := []struct {
+		namespace, name string
+		want            string
+	}{
+		{"", "pod-a", "default/pod-a"},
+		{"lab", "pod-a", "lab/pod-a"},
+	}
+
+	for _, tt := range tests {
+		if got := QualifiedName(tt.namespace, tt.name); got != tt.want {
+			t.Errorf("QualifiedName(%q, %q) = %v, want %v", tt.namespace, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitPodName(t *testing.T) {
+	tests := []struct {
+		podName, namespace string
+		wantNamespace      string
+		wantName           string
+	}{
+		{"pod-a", "", DefaultNamespace, "pod-a"},
+		{"pod-a", "lab", "lab", "pod-a"},
+		{"other/pod-a", "lab", "other", "pod-a"},
+	}
+
+	for _, tt := range tests {
+		namespace, name := SplitPodName(tt.podName, tt.namespace)
+		if namespace != tt.wantNamespace || name != tt.wantName {
+			t.Errorf("SplitPodName(%q, %q) = %v, %v, want %v, %v", tt.podName, tt.namespace, namespace, name, tt.wantNamespace, tt.wantName)
+		}
+	}
+}
+
+func TestV2Keys(t *testing.T) {
+	tests := []struct {
+		name string
+		v2   map[string]string
+		want map[string]string
+	}{
+		{
+			name: "primary",
+			v2: map[string]string{
+				"/ratchet/association/pod-a/id":          "c0ffee",
+				"/ratchet/association/pod-a/parentiface": "eth0",
+				"/ratchet/association/pod-a/parentaddr":  "10.0.0.1",
+			},
+			want: map[string]string{
+				"/ratchet/association/default/pod-a/id":          "c0ffee",
+				"/ratchet/association/default/pod-a/parentiface": "eth0",
+				"/ratchet/association/default/pod-a/parentaddr":  "10.0.0.1",
+			},
+		},
+		{
+			name: "pair",
+			v2: map[string]string{
+				"/ratchet/association/pod-b/id":          "beef",
+				"/ratchet/association/pod-b/vxlanid":     "11",
+				"/ratchet/association/pod-b/pairip":      "192.168.2.101/24",
+				"/ratchet/association/pod-b/pairifname":  "in2",
+				"/ratchet/association/pod-b/primaryname": "pod-a",
+			},
+			want: map[string]string{
+				"/ratchet/association/default/pod-b/id":                              "beef",
+				"/ratchet/association/default/pod-b/links/default.pod-a/vxlanid":     "11",
+				"/ratchet/association/default/pod-b/links/default.pod-a/pairip":      "192.168.2.101/24",
+				"/ratchet/association/default/pod-b/links/default.pod-a/pairifname":  "in2",
+				"/ratchet/association/default/pod-b/links/default.pod-a/primaryname": "default/pod-a",
+			},
+		},
+		{
+			name: "link without its primary",
+			v2: map[string]string{
+				"/ratchet/association/pod-b/vxlanid": "11",
+				"/ratchet/association/pod-b/pairip":  "192.168.2.101/24",
+			},
+			want: map[string]string{},
+		},
+		{
+			name: "counter",
+			v2:   map[string]string{"/ratchet/vxlanid": "12"},
+			want: map[string]string{"/ratchet/vxlanid": "12"},
+		},
+		{
+			name: "what the v2 plugin kept for itself",
+			v2: map[string]string{
+				"/ratchet/c0ffee/isalive":               "true",
+				"/ratchet/c0ffee/pod_name":              "pod-a",
+				"/ratchet/byname/pod-a":                 "c0ffee",
+				"/ratchet/association/pod-a/other":      "x",
+				"/ratchet/association/pod-a/deeper/key": "x",
+			},
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := V2Keys(tt.v2); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: V2Keys = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLinkDir(t *testing.T) {
+	tests := []struct {
+		pairPod, primaryPod, linkName string
+		want                          string
+	}{
+		{"default/pod-b", "default/pod-a", "", "/ratchet/association/default/pod-b/links/default.pod-a"},
+		{"default/pod-b", "lab/pod-a", "left", "/ratchet/association/default/pod-b/links/lab.pod-a:left"},
+	}
+
+	for _, tt := range tests {
+		if got := LinkDir(tt.pairPod, tt.primaryPod, tt.linkName); got != tt.want {
+			t.Errorf("LinkDir(%q, %q, %q) = %v, want %v", tt.pairPod, tt.primaryPod, tt.linkName, got, tt.want)
+		}
+	}
+}
+
+func TestElectionKey(t *testing.T) {
+	tests := []struct {
+		podA, podB, linkName string
+		want                 string
+	}{
+		{"default/pod-a", "default/pod-b", "", "/ratchet/election/default.pod-a,default.pod-b"},
+		{"default/pod-b", "default/pod-a", "", "/ratchet/election/default.pod-a,default.pod-b"},
+		{"lab/pod-a", "default/pod-b", "left", "/ratchet/election/default.pod-b,lab.pod-a:left"},
+		{"default/pod-b", "lab/pod-a", "left", "/ratchet/election/default.pod-b,lab.pod-a:left"},
+	}
+
+	for _, tt := range tests {
+		if got := ElectionKey(tt.podA, tt.podB, tt.linkName); got != tt.want {
+			t.Errorf("ElectionKey(%q, %q, %q) = %v, want %v", tt.podA, tt.podB, tt.linkName, got, tt.want)
+		}
+	}
+}
+
+func TestFindLinkDir(t *testing.T) {
+	ids := []string{"default.pod-a", "lab.pod-b:left", "lab.pod-c:right"}
+
+	tests := []struct {
+		linkName string
+		want     string
+	}{
+		{"", "/ratchet/association/default/pod-z/links/default.pod-a"},
+		{"left", "/ratchet/association/default/pod-z/links/lab.pod-b:left"},
+		{"right", "/ratchet/association/default/pod-z/links/lab.pod-c:right"},
+		{"middle", ""},
+	}
+
+	for _, tt := range tests {
+		if got := FindLinkDir("default/pod-z", ids, tt.linkName); got != tt.want {
+			t.Errorf("FindLinkDir(%q) = %q, want %q", tt.linkName, got, tt.want)
+		}
+	}
+
+	if got := FindLinkDir("default/pod-z", []string{"lab.pod-b:left"}, ""); got != "" {
+		t.Errorf("FindLinkDir of an unnamed link among named ones = %q, want none", got)
+	}
+
+	if got, want := LinkDir("default/pod-z", "lab/pod-b", "left"), FindLinkDir("default/pod-z", ids, "left"); got != want {
+		t.Errorf("LinkDir = %q, but FindLinkDir found %q", got, want)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EligibleLabel marks a pod (or its infra container) as one for ratchet.
+const EligibleLabel = "ratchet"
+
+// LinkAnnotation is the pod annotation holding the link, as a JSON LinkInfo.
+const LinkAnnotation = "ratchet.link"
+
+// LinksAnnotation is the pod annotation holding a JSON list of links, for
+// pods with more than one.
+const LinksAnnotation = "ratchet.links"
+
+// IsEligible says whether a pod with these labels and annotations is to be
+// treated by ratchet.
+func IsEligible(labels map[string]string, annotations map[string]string) bool {
+	if _, ok := labels[EligibleLabel]; ok {
+		return true
+	}
+
+	if _, ok := annotations[LinksAnnotation]; ok {
+		return true
+	}
+
+	_, ok := annotations[LinkAnnotation]
+	return ok
+}
+
+// LinkInfoFromLabels reads the link from the ratchet.* labels.
+func LinkInfoFromLabels(labels map[string]string) LinkInfo {
+	linki := LinkInfo{}
+	linki.PodName = labels["ratchet.pod_name"]
+	linki.TargetPod = labels["ratchet.target_pod"]
+	linki.TargetContainer = labels["ratchet.target_container"]
+	linki.PublicIP = labels["ratchet.public_ip"]
+	linki.LocalIP = labels["ratchet.local_ip"]
+	linki.LocalIFName = labels["ratchet.local_ifname"]
+	linki.PairName = labels["ratchet.pair_name"]
+	linki.PairIP = labels["ratchet.pair_ip"]
+	linki.PairIFName = labels["ratchet.pair_ifname"]
+	linki.Primary = labels["ratchet.primary"]
+	linki.Type = labels["ratchet.type"]
+	linki.Master = labels["ratchet.master"]
+	// A bad VLAN id is left at 0, which validation turns down.
+	linki.VlanID, _ = strconv.Atoi(labels["ratchet.vlan_id"])
+	linki.MacvlanMode = labels["ratchet.macvlan_mode"]
+	linki.MirrorIFName = labels["ratchet.mirror_ifname"]
+	linki.Mirror = labels["ratchet.mirror"]
+	// Like the VLAN id, a bad MTU is left at 0, the default.
+	linki.MTU, _ = strconv.Atoi(labels["ratchet.mtu"])
+	linki.LocalMAC = labels["ratchet.local_mac"]
+	linki.PairMAC = labels["ratchet.pair_mac"]
+	linki.RendezvousTimeoutSeconds = Seconds(labels["ratchet.rendezvous_timeout_seconds"])
+	linki.RendezvousRetrySeconds = Seconds(labels["ratchet.rendezvous_retry_seconds"])
+	linki.KokoDelaySeconds = Seconds(labels["ratchet.koko_delay_seconds"])
+	return linki
+}
+
+// LinkInfosFromMetadata reads the pod's links from the LinksAnnotation, else
+// the LinkAnnotation, else the labels. All the links are the pod's, podName,
+// in its namespace: a link naming another pod is turned down, so no pod can
+// speak for another. Only without a podName (when we weren't called by the
+// kubelet) do the links name their pod themselves.
+func LinkInfosFromMetadata(labels map[string]string, annotations map[string]string, namespace string, podName string) ([]LinkInfo, error) {
+	var links []LinkInfo
+
+	if value, ok := annotations[LinksAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &links); err != nil {
+			return nil, fmt.Errorf("failed to parse %s annotation: %v", LinksAnnotation, err)
+		}
+	} else if value, ok := annotations[LinkAnnotation]; ok {
+		linki := LinkInfo{}
+		if err := json.Unmarshal([]byte(value), &linki); err != nil {
+			return nil, fmt.Errorf("failed to parse %s annotation: %v", LinkAnnotation, err)
+		}
+		links = append(links, linki)
+	} else {
+		links = append(links, LinkInfoFromLabels(labels))
+	}
+
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	for i := range links {
+		// Only the runtime gets to say which pod, and namespace, we're in.
+		if podName != "" {
+			if links[i].PodName != "" && links[i].PodName != podName {
+				return nil, fmt.Errorf("link names pod %v, but it belongs to pod %v", links[i].PodName, podName)
+			}
+			links[i].PodName = podName
+		}
+		links[i].Namespace = namespace
+	}
+
+	return links, validateLinks(links)
+}
+
+// validateLinks makes sure a pod's links can all live side by side.
+func validateLinks(links []LinkInfo) error {
+	if len(links) == 0 {
+		return fmt.Errorf("pod has no links")
+	}
+
+	ifnames := make(map[string]bool)
+	peers := make(map[string]bool)
+	for _, linki := range links {
+		if linki.PodName != links[0].PodName {
+			return fmt.Errorf("links of one pod name different pods: %v and %v", links[0].PodName, linki.PodName)
+		}
+
+		if err := validatePodNames(linki); err != nil {
+			return err
+		}
+
+		if err := validateLinkType(linki); err != nil {
+			return err
+		}
+
+		if linki.LocalIFName != "" {
+			if ifnames[linki.LocalIFName] {
+				return fmt.Errorf("more than one link uses interface %v", linki.LocalIFName)
+			}
+			ifnames[linki.LocalIFName] = true
+		}
+
+		if err := validateLinkPeer(linki, peers); err != nil {
+			return err
+		}
+
+		if err := validateLinkAddrs(linki); err != nil {
+			return err
+		}
+
+		if err := validateLinkMTU(linki); err != nil {
+			return err
+		}
+
+		if err := validateLinkMACs(linki); err != nil {
+			return err
+		}
+
+		if _, err := linki.Timing(&NetConf{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateLinkPeer makes sure the link is the only one to its peer of its
+// name, adding it to peers. Links that leave it to their primary to find
+// them count as being to the same peer, as all a pair without a pair_name
+// knows its link by is the name.
+func validateLinkPeer(linki LinkInfo, peers map[string]bool) error {
+	if !linki.HasPair() {
+		return nil
+	}
+
+	peer := ":" + linki.Name
+	if linki.PairName != "" {
+		peer = linki.PairKey() + peer
+	}
+
+	if peers[peer] {
+		if linki.PairName == "" {
+			return fmt.Errorf("more than one link without a pair_name, give them each a distinct name")
+		}
+		return fmt.Errorf("more than one link to %v, give them each a distinct name", linki.PairName)
+	}
+	peers[peer] = true
+
+	return nil
+}
+
+// validatePodNames makes sure pod_name is a plain name, and pair_name a name
+// or namespace/name.
+func validatePodNames(linki LinkInfo) error {
+	if strings.Contains(linki.PodName, "/") {
+		return fmt.Errorf("pod_name %q can't name a namespace, it's always the pod's own", linki.PodName)
+	}
+
+	if linki.PairName == "" {
+		return nil
+	}
+
+	namespace, name := SplitPodName(linki.PairName, linki.Namespace)
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("pair_name %q should be a pod name, or namespace/name", linki.PairName)
+	}
+
+	return nil
+}
+
+// MaxVlanID is the highest VLAN id there is, 4095 being reserved.
+const MaxVlanID = 4094
+
+// validateLinkType makes sure the link is of a type we know, and that a link
+// without a pair has what it takes to be made, and nothing of a pair.
+func validateLinkType(linki LinkInfo) error {
+	switch linki.LinkType() {
+	case LinkTypeVeth:
+	case LinkTypeVlan, LinkTypeMacvlan:
+		if err := validateLocalLink(linki); err != nil {
+			return err
+		}
+	case LinkTypeMirror:
+		if err := validateMirrorLink(linki); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("link %v has unknown type %q, it should be %v, %v, %v or %v", linki.LocalIFName, linki.Type, LinkTypeVeth, LinkTypeVlan, LinkTypeMacvlan, LinkTypeMirror)
+	}
+
+	if linki.LinkType() == LinkTypeVlan && (linki.VlanID < 1 || linki.VlanID > MaxVlanID) {
+		return fmt.Errorf("vlan link %v needs a vlan_id from 1 to %v", linki.LocalIFName, MaxVlanID)
+	}
+
+	if err := validateTypeFields(linki); err != nil {
+		return err
+	}
+
+	switch linki.Mode() {
+	case MacvlanBridge, MacvlanPrivate, MacvlanVepa, MacvlanPassthru:
+		return nil
+	}
+
+	return fmt.Errorf("macvlan link %v has unknown macvlan_mode %q, it should be %v, %v, %v or %v", linki.LocalIFName, linki.MacvlanMode, MacvlanBridge, MacvlanPrivate, MacvlanVepa, MacvlanPassthru)
+}
+
+// validateTypeFields makes sure the link only has the fields of its own
+// type.
+func validateTypeFields(linki LinkInfo) error {
+	if linki.LinkType() != LinkTypeVlan && linki.VlanID != 0 {
+		return fmt.Errorf("%v link %v can't have a vlan_id, only a vlan link can", linki.LinkType(), linki.LocalIFName)
+	}
+
+	if linki.LinkType() != LinkTypeMacvlan && linki.MacvlanMode != "" {
+		return fmt.Errorf("%v link %v can't have a macvlan_mode, only a macvlan link can", linki.LinkType(), linki.LocalIFName)
+	}
+
+	if linki.LinkType() != LinkTypeMirror && (linki.MirrorIFName != "" || linki.Mirror != "") {
+		return fmt.Errorf("%v link %v can't have a mirror_ifname or mirror, only a mirror link can", linki.LinkType(), linki.LocalIFName)
+	}
+
+	return nil
+}
+
+// validateLocalLink makes sure a link made of one of the node's interfaces
+// names it, and its own interface, and nothing of a pair.
+func validateLocalLink(linki LinkInfo) error {
+	if linki.PairName != "" || linki.PairIP != "" || linki.PairIFName != "" || linki.Primary != "" {
+		return fmt.Errorf("%v link %v has no pair, so it can't have pair_name, pair_ip, pair_ifname or primary", linki.LinkType(), linki.LocalIFName)
+	}
+
+	if linki.LocalIFName == "" {
+		return fmt.Errorf("%v link needs a local_ifname", linki.LinkType())
+	}
+
+	if linki.Master == "" {
+		return fmt.Errorf("%v link %v needs a master, the node's interface to make it of", linki.LinkType(), linki.LocalIFName)
+	}
+
+	return nil
+}
+
+// validateMirrorLink makes sure a mirror link names its monitor pod, both of
+// the monitor's interface and its own, and the interface it mirrors.
+func validateMirrorLink(linki LinkInfo) error {
+	if linki.PairName == "" || linki.PairIFName == "" {
+		return fmt.Errorf("mirror link %v needs the monitor pod's pair_name and pair_ifname", linki.LocalIFName)
+	}
+
+	if linki.Primary != "" && linki.Primary != "true" {
+		return fmt.Errorf("mirror link %v is always built by the pod it mirrors, so it can't have primary %q", linki.LocalIFName, linki.Primary)
+	}
+
+	if linki.LocalIFName == "" || linki.MirrorIFName == "" {
+		return fmt.Errorf("mirror link to %v needs a local_ifname, and the mirror_ifname it mirrors", linki.PairName)
+	}
+
+	if linki.MirrorIFName == linki.LocalIFName {
+		return fmt.Errorf("mirror link %v can't mirror itself", linki.LocalIFName)
+	}
+
+	switch linki.MirrorDirection() {
+	case MirrorIngress, MirrorEgress, MirrorBoth:
+		return nil
+	}
+
+	return fmt.Errorf("mirror link %v has unknown mirror %q, it should be %v, %v or %v", linki.LocalIFName, linki.Mirror, MirrorIngress, MirrorEgress, MirrorBoth)
+}
@@ -0,0 +1,430 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsEligible(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		want        bool
+	}{
+		{"label", map[string]string{"ratchet": "true"}, nil, true},
+		{"link annotation", nil, map[string]string{LinkAnnotation: "{}"}, true},
+		{"links annotation", nil, map[string]string{LinksAnnotation: "[]"}, true},
+		{"neither", map[string]string{"app": "web"}, map[string]string{"note": "ratchet"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsEligible(tt.labels, tt.annotations); got != tt.want {
+			t.Errorf("%v: IsEligible = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLinkInfosFromMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		namespace   string
+		podName     string
+		want        []LinkInfo
+		wantErr     string
+	}{
+		{
+			name: "labels",
+			labels: map[string]string{
+				"ratchet":              "true",
+				"ratchet.local_ip":     "192.168.2.100",
+				"ratchet.local_ifname": "in1",
+				"ratchet.pair_name":    "pair-pod",
+				"ratchet.pair_ip":      "192.168.2.101",
+				"ratchet.pair_ifname":  "in2",
+				"ratchet.primary":      "true",
+				"ratchet.mtu":          "9000",
+				"ratchet.local_mac":    "02-00-00-00-00-01",
+			},
+			namespace: "lab",
+			podName:   "primary-pod",
+			want: []LinkInfo{{
+				PodName: "primary-pod", Namespace: "lab",
+				LocalIP: "192.168.2.100", LocalIFName: "in1",
+				PairName: "pair-pod", PairIP: "192.168.2.101", PairIFName: "in2",
+				Primary: "true", MTU: 9000, LocalMAC: "02-00-00-00-00-01",
+			}},
+		},
+		{
+			name: "timing labels",
+			labels: map[string]string{
+				"ratchet.local_ifname":               "in1",
+				"ratchet.rendezvous_timeout_seconds": "-1",
+				"ratchet.rendezvous_retry_seconds":   "5",
+				"ratchet.koko_delay_seconds":         "0",
+			},
+			podName: "pod-a",
+			want: []LinkInfo{{
+				PodName: "pod-a", Namespace: DefaultNamespace, LocalIFName: "in1",
+				RendezvousTimeoutSeconds: "-1", RendezvousRetrySeconds: "5", KokoDelaySeconds: "0",
+			}},
+		},
+		{
+			name: "vlan labels",
+			labels: map[string]string{
+				"ratchet":              "true",
+				"ratchet.type":         "vlan",
+				"ratchet.master":       "eth1",
+				"ratchet.vlan_id":      "100",
+				"ratchet.local_ifname": "vlan100",
+			},
+			podName: "pod-a",
+			want: []LinkInfo{{
+				PodName: "pod-a", Namespace: DefaultNamespace,
+				Type: LinkTypeVlan, Master: "eth1", VlanID: 100, LocalIFName: "vlan100",
+			}},
+		},
+		{
+			name:    "pod_name matching the kubelet's",
+			labels:  map[string]string{"ratchet.pod_name": "pod-a", "ratchet.local_ifname": "in1"},
+			podName: "pod-a",
+			want:    []LinkInfo{{PodName: "pod-a", Namespace: DefaultNamespace, LocalIFName: "in1"}},
+		},
+		{
+			name:    "pod_name naming another pod",
+			labels:  map[string]string{"ratchet.pod_name": "pod-b", "ratchet.local_ifname": "in1"},
+			podName: "pod-a",
+			wantErr: "link names pod pod-b, but it belongs to pod pod-a",
+		},
+		{
+			name:   "pod_name without the kubelet",
+			labels: map[string]string{"ratchet.pod_name": "pod-b", "ratchet.local_ifname": "in1"},
+			want:   []LinkInfo{{PodName: "pod-b", Namespace: DefaultNamespace, LocalIFName: "in1"}},
+		},
+		{
+			name:        "link annotation wins over labels",
+			labels:      map[string]string{"ratchet.local_ifname": "in1"},
+			annotations: map[string]string{LinkAnnotation: `{"local_ifname": "in2", "pair_name": "other/pod-b"}`},
+			podName:     "pod-a",
+			want:        []LinkInfo{{PodName: "pod-a", Namespace: DefaultNamespace, LocalIFName: "in2", PairName: "other/pod-b"}},
+		},
+		{
+			name: "links annotation wins over the link annotation",
+			annotations: map[string]string{
+				LinkAnnotation:  `{"local_ifname": "in9"}`,
+				LinksAnnotation: `[{"name": "left", "local_ifname": "in1", "pair_name": "pod-b"}, {"name": "right", "local_ifname": "in2", "pair_name": "pod-b"}]`,
+			},
+			namespace: "lab",
+			podName:   "pod-a",
+			want: []LinkInfo{
+				{Name: "left", PodName: "pod-a", Namespace: "lab", LocalIFName: "in1", PairName: "pod-b"},
+				{Name: "right", PodName: "pod-a", Namespace: "lab", LocalIFName: "in2", PairName: "pod-b"},
+			},
+		},
+		{
+			name:        "namespace isn't the link's to say",
+			annotations: map[string]string{LinkAnnotation: `{"namespace": "other", "local_ifname": "in1"}`},
+			namespace:   "lab",
+			podName:     "pod-a",
+			want:        []LinkInfo{{PodName: "pod-a", Namespace: "lab", LocalIFName: "in1"}},
+		},
+		{
+			name:        "bad links annotation",
+			annotations: map[string]string{LinksAnnotation: `{"local_ifname": "in1"}`},
+			podName:     "pod-a",
+			wantErr:     "failed to parse ratchet.links annotation",
+		},
+		{
+			name:        "bad link annotation",
+			annotations: map[string]string{LinkAnnotation: `[`},
+			podName:     "pod-a",
+			wantErr:     "failed to parse ratchet.link annotation",
+		},
+		{
+			name:        "no links",
+			annotations: map[string]string{LinksAnnotation: `[]`},
+			podName:     "pod-a",
+			wantErr:     "pod has no links",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links, err := LinkInfosFromMetadata(tt.labels, tt.annotations, tt.namespace, tt.podName)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LinkInfosFromMetadata error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LinkInfosFromMetadata: %v", err)
+			}
+
+			if len(links) != len(tt.want) {
+				t.Fatalf("LinkInfosFromMetadata gave %v links, want %v", len(links), len(tt.want))
+			}
+			for i := range links {
+				if links[i] != tt.want[i] {
+					t.Errorf("link %v = %+v, want %+v", i, links[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		links   string
+		wantErr string
+	}{
+		{
+			name:  "links to two pods",
+			links: `[{"local_ifname": "in1", "pair_name": "pod-b"}, {"local_ifname": "in2", "pair_name": "pod-c"}]`,
+		},
+		{
+			name:    "links of two pods",
+			links:   `[{"pod_name": "pod-a", "local_ifname": "in1"}, {"pod_name": "pod-b", "local_ifname": "in2"}]`,
+			wantErr: "links of one pod name different pods",
+		},
+		{
+			name:    "pod_name with a namespace",
+			links:   `[{"pod_name": "lab/pod-a", "local_ifname": "in1"}]`,
+			wantErr: "can't name a namespace",
+		},
+		{
+			name:  "pair_name with a namespace",
+			links: `[{"local_ifname": "in1", "pair_name": "lab/pod-b"}]`,
+		},
+		{
+			name:    "pair_name with too many slashes",
+			links:   `[{"local_ifname": "in1", "pair_name": "lab/pod-b/x"}]`,
+			wantErr: "should be a pod name, or namespace/name",
+		},
+		{
+			name:    "pair_name without a name",
+			links:   `[{"local_ifname": "in1", "pair_name": "lab/"}]`,
+			wantErr: "should be a pod name, or namespace/name",
+		},
+		{
+			name:    "two links on one interface",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b"}, {"local_ifname": "in1", "pair_name": "pod-c"}]`,
+			wantErr: "more than one link uses interface in1",
+		},
+		{
+			name:    "two unnamed links to one pod",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b"}, {"local_ifname": "in2", "pair_name": "pod-b"}]`,
+			wantErr: "more than one link to pod-b",
+		},
+		{
+			name:    "two unnamed links to one pod, one with its namespace",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b"}, {"local_ifname": "in2", "pair_name": "default/pod-b"}]`,
+			wantErr: "more than one link to default/pod-b",
+		},
+		{
+			name:  "named links without a pair_name",
+			links: `[{"name": "left", "local_ifname": "in1"}, {"name": "right", "local_ifname": "in2"}]`,
+		},
+		{
+			name:    "unnamed links without a pair_name",
+			links:   `[{"local_ifname": "in1"}, {"local_ifname": "in2"}]`,
+			wantErr: "more than one link without a pair_name",
+		},
+		{
+			name:  "unnamed vlans",
+			links: `[{"type": "vlan", "master": "eth1", "vlan_id": 10, "local_ifname": "v10"}, {"type": "vlan", "master": "eth1", "vlan_id": 20, "local_ifname": "v20"}]`,
+		},
+		{
+			name:    "unknown type",
+			links:   `[{"type": "bond", "local_ifname": "in1"}]`,
+			wantErr: `unknown type "bond"`,
+		},
+		{
+			name:    "vlan with a pair",
+			links:   `[{"type": "vlan", "master": "eth1", "vlan_id": 10, "local_ifname": "v10", "pair_name": "pod-b"}]`,
+			wantErr: "has no pair",
+		},
+		{
+			name:    "vlan without a master",
+			links:   `[{"type": "vlan", "vlan_id": 10, "local_ifname": "v10"}]`,
+			wantErr: "needs a master",
+		},
+		{
+			name:    "vlan without an interface",
+			links:   `[{"type": "vlan", "master": "eth1", "vlan_id": 10}]`,
+			wantErr: "needs a local_ifname",
+		},
+		{
+			name:    "vlan id out of range",
+			links:   `[{"type": "vlan", "master": "eth1", "vlan_id": 4095, "local_ifname": "v10"}]`,
+			wantErr: "needs a vlan_id from 1 to 4094",
+		},
+		{
+			name:    "vlan id on a veth",
+			links:   `[{"vlan_id": 10, "local_ifname": "in1"}]`,
+			wantErr: "can't have a vlan_id",
+		},
+		{
+			name:  "macvlan",
+			links: `[{"type": "macvlan", "master": "eth1", "macvlan_mode": "private", "local_ifname": "mv0"}]`,
+		},
+		{
+			name:    "macvlan with an unknown mode",
+			links:   `[{"type": "macvlan", "master": "eth1", "macvlan_mode": "source", "local_ifname": "mv0"}]`,
+			wantErr: `unknown macvlan_mode "source"`,
+		},
+		{
+			name:    "macvlan mode on a vlan",
+			links:   `[{"type": "vlan", "master": "eth1", "vlan_id": 10, "macvlan_mode": "vepa", "local_ifname": "v10"}]`,
+			wantErr: "can't have a macvlan_mode",
+		},
+		{
+			name:  "mirror",
+			links: `[{"type": "mirror", "local_ifname": "mon0", "mirror_ifname": "in1", "mirror": "ingress", "pair_name": "ids", "pair_ifname": "in1"}]`,
+		},
+		{
+			name:    "mirror without a monitor",
+			links:   `[{"type": "mirror", "local_ifname": "mon0", "mirror_ifname": "in1"}]`,
+			wantErr: "needs the monitor pod's pair_name and pair_ifname",
+		},
+		{
+			name:    "mirror of itself",
+			links:   `[{"type": "mirror", "local_ifname": "mon0", "mirror_ifname": "mon0", "pair_name": "ids", "pair_ifname": "in1"}]`,
+			wantErr: "can't mirror itself",
+		},
+		{
+			name:    "mirror labelled the pair",
+			links:   `[{"type": "mirror", "local_ifname": "mon0", "mirror_ifname": "in1", "pair_name": "ids", "pair_ifname": "in1", "primary": "false"}]`,
+			wantErr: "always built by the pod it mirrors",
+		},
+		{
+			name:    "mirror with an unknown direction",
+			links:   `[{"type": "mirror", "local_ifname": "mon0", "mirror_ifname": "in1", "mirror": "sideways", "pair_name": "ids", "pair_ifname": "in1"}]`,
+			wantErr: `unknown mirror "sideways"`,
+		},
+		{
+			name:    "mirror_ifname on a veth",
+			links:   `[{"local_ifname": "in1", "mirror_ifname": "eth0"}]`,
+			wantErr: "can't have a mirror_ifname or mirror",
+		},
+		{
+			name:  "addresses of both families",
+			links: `[{"local_ifname": "in1", "local_ip": "10.0.0.0/31,fd00::/127", "pair_name": "pod-b", "pair_ip": "10.0.0.1/31,fd00::1/127"}]`,
+		},
+		{
+			name:    "bad local_ip",
+			links:   `[{"local_ifname": "in1", "local_ip": "192.168.2.300"}]`,
+			wantErr: "local_ip of link",
+		},
+		{
+			name:    "bad pair_ip",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b", "pair_ip": "10.0.0.0/24"}]`,
+			wantErr: "pair_ip of link pod-b",
+		},
+		{
+			name:    "one address on both ends",
+			links:   `[{"local_ifname": "in1", "local_ip": "10.0.0.1/31", "pair_name": "pod-b", "pair_ip": "10.0.0.1/31"}]`,
+			wantErr: "uses address 10.0.0.1 more than once",
+		},
+		{
+			name:    "mtu too small",
+			links:   `[{"local_ifname": "in1", "mtu": 67}]`,
+			wantErr: "mtu 67 should be from 68 to 65535",
+		},
+		{
+			name:    "mtu too small for IPv6",
+			links:   `[{"local_ifname": "in1", "local_ip": "fd00::1/64", "mtu": 1000}]`,
+			wantErr: "so its mtu can't be under 1280",
+		},
+		{
+			name:  "small mtu for IPv4",
+			links: `[{"local_ifname": "in1", "local_ip": "10.0.0.1/24", "mtu": 1000}]`,
+		},
+		{
+			name:  "both MACs",
+			links: `[{"local_ifname": "in1", "pair_name": "pod-b", "primary": "true", "local_mac": "02:00:00:00:00:01", "pair_mac": "02-00-00-00-00-02"}]`,
+		},
+		{
+			name:    "one MAC on both ends",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b", "primary": "true", "local_mac": "02:00:00:00:00:01", "pair_mac": "02-00-00-00-00-01"}]`,
+			wantErr: "uses MAC 02:00:00:00:00:01 on both ends",
+		},
+		{
+			name:    "multicast MAC",
+			links:   `[{"local_ifname": "in1", "local_mac": "01:00:5e:00:00:01"}]`,
+			wantErr: "it's a multicast address",
+		},
+		{
+			name:    "pair_mac on a vlan",
+			links:   `[{"type": "vlan", "master": "eth1", "vlan_id": 10, "local_ifname": "v10", "pair_mac": "02:00:00:00:00:01"}]`,
+			wantErr: "can't have a pair_mac",
+		},
+		{
+			name:    "local_mac on a pair that doesn't name its primary",
+			links:   `[{"local_ifname": "in1", "local_mac": "02:00:00:00:00:01"}]`,
+			wantErr: "needs a pair_name for its primary to learn its local_mac",
+		},
+		{
+			name:  "local_mac on a pair that names its primary",
+			links: `[{"local_ifname": "in1", "pair_name": "pod-b", "primary": "false", "local_mac": "02:00:00:00:00:01"}]`,
+		},
+		{
+			name:  "timing as numbers",
+			links: `[{"local_ifname": "in1", "rendezvous_timeout_seconds": 30, "koko_delay_seconds": 0}]`,
+		},
+		{
+			name:    "bad rendezvous timeout",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b", "rendezvous_timeout_seconds": "soon"}]`,
+			wantErr: `should be a number of seconds, or -1 to wait forever, not "soon"`,
+		},
+		{
+			name:    "zero rendezvous timeout",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b", "rendezvous_timeout_seconds": 0}]`,
+			wantErr: "rendezvous_timeout_seconds of link pod-b",
+		},
+		{
+			name:    "bad rendezvous retry",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b", "rendezvous_retry_seconds": "0"}]`,
+			wantErr: "rendezvous_retry_seconds of link pod-b",
+		},
+		{
+			name:    "bad koko delay",
+			links:   `[{"local_ifname": "in1", "pair_name": "pod-b", "koko_delay_seconds": -1}]`,
+			wantErr: "koko_delay_seconds of link pod-b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{LinksAnnotation: tt.links}
+			_, err := LinkInfosFromMetadata(nil, annotations, "", "")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LinkInfosFromMetadata: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LinkInfosFromMetadata error = %v, want one saying %q", err, tt.wantErr)
+			}
+		})
+	}
+}
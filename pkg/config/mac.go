@@ -0,0 +1,101 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+)
+
+// DerivedMAC is the MAC of a link end which wasn't given one: made from a
+// hash of the pod (as namespace/name) and the interface name, so the end
+// gets the same MAC each time the pod comes back. It's a locally
+// administered unicast address.
+func DerivedMAC(pod string, ifname string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(pod + "\x00" + ifname))
+
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+
+	return mac
+}
+
+// LinkMAC is the MAC of a link end: mac, when it's given, else the one
+// derived for the pod's interface.
+func LinkMAC(mac string, pod string, ifname string) (net.HardwareAddr, error) {
+	if mac == "" {
+		return DerivedMAC(pod, ifname), nil
+	}
+
+	return parseMAC(mac)
+}
+
+// parseMAC parses a MAC for a link end, which has to be an EUI-48 unicast
+// address. Labels can't hold colons, so it may be written with dashes.
+func parseMAC(mac string) (net.HardwareAddr, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC %q: %v", mac, err)
+	}
+
+	if len(hw) != 6 {
+		return nil, fmt.Errorf("invalid MAC %q: it should be 6 bytes", mac)
+	}
+
+	if hw[0]&0x01 != 0 {
+		return nil, fmt.Errorf("invalid MAC %q: it's a multicast address", mac)
+	}
+
+	if hw.String() == "00:00:00:00:00:00" {
+		return nil, fmt.Errorf("invalid MAC %q: it's all zeros", mac)
+	}
+
+	return hw, nil
+}
+
+// validateLinkMACs makes sure the MACs given for the link's ends parse,
+// and aren't the same.
+func validateLinkMACs(linki LinkInfo) error {
+	for _, mac := range []string{linki.LocalMAC, linki.PairMAC} {
+		if mac == "" {
+			continue
+		}
+
+		if _, err := parseMAC(mac); err != nil {
+			return fmt.Errorf("link %v: %v", linki.LocalIFName, err)
+		}
+	}
+
+	if linki.PairMAC != "" && !linki.HasPair() {
+		return fmt.Errorf("%v link %v has no pair, so it can't have a pair_mac", linki.LinkType(), linki.LocalIFName)
+	}
+
+	// The primary learns the pair's MAC from what the pair says to the
+	// primary it names.
+	if linki.LocalMAC != "" && linki.HasPair() && !linki.IsPrimary() && linki.PairName == "" {
+		return fmt.Errorf("link %v needs a pair_name for its primary to learn its local_mac", linki.LocalIFName)
+	}
+
+	if linki.LocalMAC != "" && linki.PairMAC != "" {
+		local, _ := parseMAC(linki.LocalMAC)
+		pair, _ := parseMAC(linki.PairMAC)
+		if local.String() == pair.String() {
+			return fmt.Errorf("link %v uses MAC %v on both ends", linki.LocalIFName, local)
+		}
+	}
+
+	return nil
+}
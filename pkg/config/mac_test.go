@@ -0,0 +1,85 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDerivedMAC(t *testing.T) {
+	mac := DerivedMAC("default/pod-a", "in1")
+	if len(mac) != 6 {
+		t.Fatalf("DerivedMAC gave %v, want 6 bytes", mac)
+	}
+	if mac[0]&0x01 != 0 {
+		t.Errorf("DerivedMAC gave %v, a multicast address", mac)
+	}
+	if mac[0]&0x02 == 0 {
+		t.Errorf("DerivedMAC gave %v, not a locally administered address", mac)
+	}
+
+	if again := DerivedMAC("default/pod-a", "in1"); again.String() != mac.String() {
+		t.Errorf("DerivedMAC gave %v then %v for the same end", mac, again)
+	}
+
+	others := []struct{ pod, ifname string }{
+		{"default/pod-a", "in2"},
+		{"default/pod-b", "in1"},
+		{"lab/pod-a", "in1"},
+		{"default/pod-ai", "n1"},
+	}
+	for _, other := range others {
+		if got := DerivedMAC(other.pod, other.ifname); got.String() == mac.String() {
+			t.Errorf("DerivedMAC(%q, %q) = %v, the same as default/pod-a's in1", other.pod, other.ifname, got)
+		}
+	}
+}
+
+func TestLinkMAC(t *testing.T) {
+	tests := []struct {
+		mac     string
+		want    string
+		wantErr string
+	}{
+		{mac: "", want: DerivedMAC("default/pod-a", "in1").String()},
+		{mac: "02:00:00:00:00:01", want: "02:00:00:00:00:01"},
+		{mac: "02-00-00-00-00-01", want: "02:00:00:00:00:01"},
+		{mac: "0A:1B:2C:3D:4E:5F", want: "0a:1b:2c:3d:4e:5f"},
+		{mac: "01:00:5e:00:00:01", wantErr: "it's a multicast address"},
+		{mac: "ff:ff:ff:ff:ff:ff", wantErr: "it's a multicast address"},
+		{mac: "00:00:00:00:00:00", wantErr: "it's all zeros"},
+		{mac: "02:00:00:00:00:00:00:01", wantErr: "it should be 6 bytes"},
+		{mac: "02:00:00:00:01", wantErr: `invalid MAC "02:00:00:00:01"`},
+	}
+
+	for _, tt := range tests {
+		mac, err := LinkMAC(tt.mac, "default/pod-a", "in1")
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LinkMAC(%q) error = %v, want one saying %q", tt.mac, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LinkMAC(%q): %v", tt.mac, err)
+			continue
+		}
+
+		if mac.String() != tt.want {
+			t.Errorf("LinkMAC(%q) = %v, want %v", tt.mac, mac, tt.want)
+		}
+	}
+}
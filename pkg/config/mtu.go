@@ -0,0 +1,93 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// VxlanOverheadIPv4 and VxlanOverheadIPv6 are what VXLAN takes of the
+// parent interface's MTU: the outer IP header, the UDP and VXLAN headers,
+// and the inner Ethernet header.
+const (
+	VxlanOverheadIPv4 = 20 + 8 + 8 + 14
+	VxlanOverheadIPv6 = 40 + 8 + 8 + 14
+)
+
+// MinMTU and MaxMTU bound a link's MTU. Links with an IPv6 address need
+// at least MinIPv6MTU.
+const (
+	MinMTU     = 68
+	MinIPv6MTU = 1280
+	MaxMTU     = 65535
+)
+
+// VxlanMTU is the largest MTU a vxlan over a parent interface with
+// parentMTU can carry without fragmenting, given the parent address the
+// vxlan is sent from.
+func VxlanMTU(parentMTU int, parentAddr string) int {
+	overhead := VxlanOverheadIPv4
+	if ip := net.ParseIP(parentAddr); ip != nil && ip.To4() == nil {
+		overhead = VxlanOverheadIPv6
+	}
+
+	return parentMTU - overhead
+}
+
+// LinkMTU is the MTU both ends of a link agree on: the smallest of mtus,
+// leaving out those which are 0 (unknown). It's 0 when they all are.
+func LinkMTU(mtus ...int) int {
+	mtu := 0
+	for _, m := range mtus {
+		if m > 0 && (mtu == 0 || m < mtu) {
+			mtu = m
+		}
+	}
+
+	return mtu
+}
+
+// ValidateMTU makes sure mtu is one an interface can have, or 0 for the
+// default.
+func ValidateMTU(mtu int) error {
+	if mtu != 0 && (mtu < MinMTU || mtu > MaxMTU) {
+		return fmt.Errorf("mtu %v should be from %v to %v", mtu, MinMTU, MaxMTU)
+	}
+
+	return nil
+}
+
+// validateLinkMTU makes sure the link's MTU is one its addresses can use.
+func validateLinkMTU(linki LinkInfo) error {
+	if err := ValidateMTU(linki.MTU); err != nil {
+		return fmt.Errorf("link %v: %v", linki.LocalIFName, err)
+	}
+
+	if linki.MTU == 0 || linki.MTU >= MinIPv6MTU {
+		return nil
+	}
+
+	// Addresses are validated on their own, so only the good ones count.
+	local, _ := ParseLinkAddrs(linki.LocalIP)
+	pair, _ := ParseLinkAddrs(linki.PairIP)
+	for _, addr := range append(local, pair...) {
+		if addr.IP.To4() == nil {
+			return fmt.Errorf("link %v has IPv6 address %v, so its mtu can't be under %v", linki.LocalIFName, addr.IP, MinIPv6MTU)
+		}
+	}
+
+	return nil
+}
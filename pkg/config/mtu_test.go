@@ -0,0 +1,78 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestVxlanMTU(t *testing.T) {
+	tests := []struct {
+		parentMTU  int
+		parentAddr string
+		want       int
+	}{
+		{1500, "192.168.1.10", 1450},
+		{9000, "192.168.1.10", 8950},
+		{1500, "fd00::10", 1430},
+		{1500, "", 1450},
+	}
+
+	for _, tt := range tests {
+		if got := VxlanMTU(tt.parentMTU, tt.parentAddr); got != tt.want {
+			t.Errorf("VxlanMTU(%v, %q) = %v, want %v", tt.parentMTU, tt.parentAddr, got, tt.want)
+		}
+	}
+}
+
+func TestLinkMTU(t *testing.T) {
+	tests := []struct {
+		mtus []int
+		want int
+	}{
+		{nil, 0},
+		{[]int{0, 0}, 0},
+		{[]int{1500}, 1500},
+		{[]int{0, 1450}, 1450},
+		{[]int{9000, 1450, 0, 1500}, 1450},
+	}
+
+	for _, tt := range tests {
+		if got := LinkMTU(tt.mtus...); got != tt.want {
+			t.Errorf("LinkMTU(%v) = %v, want %v", tt.mtus, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMTU(t *testing.T) {
+	tests := []struct {
+		mtu     int
+		wantErr bool
+	}{
+		{0, false},
+		{MinMTU, false},
+		{1500, false},
+		{MaxMTU, false},
+		{MinMTU - 1, true},
+		{MaxMTU + 1, true},
+		{-1, true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateMTU(tt.mtu); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateMTU(%v) = %v, want an error: %v", tt.mtu, err, tt.wantErr)
+		}
+	}
+}
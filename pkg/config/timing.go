@@ -0,0 +1,138 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DefaultRendezvousTimeoutSeconds is how long the ends of a link wait for
+// each other, unless configured.
+const DefaultRendezvousTimeoutSeconds = 60
+
+// DefaultRendezvousRetrySeconds is how long we wait before looking again,
+// after losing etcd, unless configured.
+const DefaultRendezvousRetrySeconds = 1
+
+// DefaultKokoDelaySeconds is how long the primary waits, once the pair is
+// up, before building the link, unless configured.
+const DefaultKokoDelaySeconds = 1
+
+// WaitForever is the rendezvous timeout which never runs out.
+const WaitForever = -1
+
+// Seconds is a number of seconds set on a link. Labels give it to us as a
+// string, annotations may give it either way.
+type Seconds string
+
+// UnmarshalJSON takes the seconds as a JSON number or string.
+func (s *Seconds) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = Seconds(str)
+		return nil
+	}
+
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return fmt.Errorf("seconds should be a number, not %s", data)
+	}
+
+	*s = Seconds(num)
+	return nil
+}
+
+// Timing is how the ends of a link wait for each other.
+type Timing struct {
+	// Timeout is how long to wait for the other end, or forever when
+	// negative.
+	Timeout time.Duration
+	// Retry is how long to wait before looking again after losing etcd,
+	// and where backing off starts from.
+	Retry time.Duration
+	// KokoDelay is how long the primary waits before building the link.
+	KokoDelay time.Duration
+}
+
+// Forever says whether we wait for the other end until our pod is deleted.
+func (t Timing) Forever() bool {
+	return t.Timeout < 0
+}
+
+// Timing gives the timing the netconf sets for all links, defaults and all.
+func (n *NetConf) Timing() Timing {
+	t := Timing{
+		Timeout:   DefaultRendezvousTimeoutSeconds * time.Second,
+		Retry:     DefaultRendezvousRetrySeconds * time.Second,
+		KokoDelay: DefaultKokoDelaySeconds * time.Second,
+	}
+
+	if n.RendezvousTimeoutSeconds > 0 {
+		t.Timeout = time.Duration(n.RendezvousTimeoutSeconds) * time.Second
+	} else if n.RendezvousTimeoutSeconds < 0 {
+		t.Timeout = WaitForever
+	}
+
+	if n.RendezvousRetrySeconds > 0 {
+		t.Retry = time.Duration(n.RendezvousRetrySeconds) * time.Second
+	}
+
+	if n.KokoDelaySeconds != nil && *n.KokoDelaySeconds >= 0 {
+		t.KokoDelay = time.Duration(*n.KokoDelaySeconds) * time.Second
+	}
+
+	return t
+}
+
+// Timing gives the link's timing: whatever the link sets for itself, and
+// the netconf's for the rest.
+func (l LinkInfo) Timing(netconf *NetConf) (Timing, error) {
+	t := netconf.Timing()
+
+	if l.RendezvousTimeoutSeconds != "" {
+		seconds, err := strconv.Atoi(string(l.RendezvousTimeoutSeconds))
+		if err != nil || seconds == 0 {
+			return t, fmt.Errorf("rendezvous_timeout_seconds of link %v should be a number of seconds, or -1 to wait forever, not %q", l.PairName, l.RendezvousTimeoutSeconds)
+		}
+
+		t.Timeout = time.Duration(seconds) * time.Second
+		if seconds < 0 {
+			t.Timeout = WaitForever
+		}
+	}
+
+	if l.RendezvousRetrySeconds != "" {
+		seconds, err := strconv.Atoi(string(l.RendezvousRetrySeconds))
+		if err != nil || seconds <= 0 {
+			return t, fmt.Errorf("rendezvous_retry_seconds of link %v should be a number of seconds, not %q", l.PairName, l.RendezvousRetrySeconds)
+		}
+
+		t.Retry = time.Duration(seconds) * time.Second
+	}
+
+	if l.KokoDelaySeconds != "" {
+		seconds, err := strconv.Atoi(string(l.KokoDelaySeconds))
+		if err != nil || seconds < 0 {
+			return t, fmt.Errorf("koko_delay_seconds of link %v should be a number of seconds, not %q", l.PairName, l.KokoDelaySeconds)
+		}
+
+		t.KokoDelay = time.Duration(seconds) * time.Second
+	}
+
+	return t, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intp(i int) *int {
+	return &i
+}
+
+func TestNetConfTiming(t *testing.T) {
+	tests := []struct {
+		name    string
+		netconf NetConf
+		want    Timing
+	}{
+		{"defaults", NetConf{}, Timing{60 * time.Second, time.Second, time.Second}},
+		{"set", NetConf{RendezvousTimeoutSeconds: 30, RendezvousRetrySeconds: 5, KokoDelaySeconds: intp(3)}, Timing{30 * time.Second, 5 * time.Second, 3 * time.Second}},
+		{"forever", NetConf{RendezvousTimeoutSeconds: -1}, Timing{WaitForever, time.Second, time.Second}},
+		{"no koko delay", NetConf{KokoDelaySeconds: intp(0)}, Timing{60 * time.Second, time.Second, 0}},
+		{"negative retry and koko delay", NetConf{RendezvousRetrySeconds: -1, KokoDelaySeconds: intp(-1)}, Timing{60 * time.Second, time.Second, time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.netconf.Timing()
+			if got != tt.want {
+				t.Errorf("Timing = %+v, want %+v", got, tt.want)
+			}
+			if got.Forever() != (tt.want.Timeout < 0) {
+				t.Errorf("Forever = %v, want %v", got.Forever(), tt.want.Timeout < 0)
+			}
+		})
+	}
+}
+
+func TestLinkTiming(t *testing.T) {
+	netconf := &NetConf{RendezvousTimeoutSeconds: 30, RendezvousRetrySeconds: 5, KokoDelaySeconds: intp(3)}
+
+	tests := []struct {
+		name    string
+		netconf *NetConf
+		link    LinkInfo
+		want    Timing
+		wantErr string
+	}{
+		{
+			name:    "defaults",
+			netconf: &NetConf{},
+			want:    Timing{60 * time.Second, time.Second, time.Second},
+		},
+		{
+			name:    "netconf's",
+			netconf: netconf,
+			want:    Timing{30 * time.Second, 5 * time.Second, 3 * time.Second},
+		},
+		{
+			name:    "link's over netconf's",
+			netconf: netconf,
+			link:    LinkInfo{RendezvousTimeoutSeconds: "10", RendezvousRetrySeconds: "2", KokoDelaySeconds: "0"},
+			want:    Timing{10 * time.Second, 2 * time.Second, 0},
+		},
+		{
+			name:    "link's over defaults",
+			netconf: &NetConf{},
+			link:    LinkInfo{KokoDelaySeconds: "4"},
+			want:    Timing{60 * time.Second, time.Second, 4 * time.Second},
+		},
+		{
+			name:    "link waits forever",
+			netconf: netconf,
+			link:    LinkInfo{RendezvousTimeoutSeconds: "-1"},
+			want:    Timing{WaitForever, 5 * time.Second, 3 * time.Second},
+		},
+		{
+			name:    "link doesn't wait forever",
+			netconf: &NetConf{RendezvousTimeoutSeconds: -1},
+			link:    LinkInfo{RendezvousTimeoutSeconds: "20"},
+			want:    Timing{20 * time.Second, time.Second, time.Second},
+		},
+		{
+			name:    "zero timeout",
+			netconf: netconf,
+			link:    LinkInfo{PairName: "b", RendezvousTimeoutSeconds: "0"},
+			wantErr: "rendezvous_timeout_seconds of link b",
+		},
+		{
+			name:    "timeout not a number",
+			netconf: netconf,
+			link:    LinkInfo{PairName: "b", RendezvousTimeoutSeconds: "soon"},
+			wantErr: "rendezvous_timeout_seconds of link b",
+		},
+		{
+			name:    "zero retry",
+			netconf: netconf,
+			link:    LinkInfo{PairName: "b", RendezvousRetrySeconds: "0"},
+			wantErr: "rendezvous_retry_seconds of link b",
+		},
+		{
+			name:    "negative koko delay",
+			netconf: netconf,
+			link:    LinkInfo{PairName: "b", KokoDelaySeconds: "-1"},
+			wantErr: "koko_delay_seconds of link b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.link.Timing(tt.netconf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Timing error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Timing: %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Timing = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecondsUnmarshal(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    Seconds
+		wantErr bool
+	}{
+		{`"30"`, "30", false},
+		{`30`, "30", false},
+		{`-1`, "-1", false},
+		{`true`, "", true},
+	}
+
+	for _, tt := range tests {
+		var got Seconds
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) error = %v, want error %v", tt.json, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %q, want %q", tt.json, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// authenticatePath is where we log in to etcd.
+const authenticatePath = "/v3/auth/authenticate"
+
+type authenticateRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type authenticateResponse struct {
+	Token string `json:"token"`
+}
+
+// login gives the token to send with requests, logging in to the endpoint
+// the request is for when we don't have one yet.
+func (c *Client) login(ctx context.Context, url string) (string, error) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(authenticateRequest{Name: c.username, Password: c.password})
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := url[:strings.Index(url, "/v3/")]
+	httpResp, err := c.post(ctx, endpoint+authenticatePath, body)
+	if err != nil {
+		return "", err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to log in to etcd as %v: %v", c.username, gatewayError(httpResp.StatusCode, data))
+	}
+
+	resp := authenticateResponse{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", fmt.Errorf("failed to parse etcd login response: %v", err)
+	}
+
+	c.token = resp.Token
+	return c.token, nil
+}
+
+func (c *Client) setToken(token string) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	c.token = token
+}
+
+// isAuthError says whether err is etcd turning down our token, which it
+// does once the token's too old.
+func isAuthError(err error) bool {
+	eerr, ok := err.(*Error)
+	return ok && strings.Contains(eerr.Message, "invalid auth token")
+}
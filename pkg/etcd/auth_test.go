@@ -0,0 +1,96 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dougbtv/ratchet-cni/pkg/etcd/etcdtest"
+	"golang.org/x/net/context"
+)
+
+// fakeEtcdAuth starts a fake etcd letting in ratchet, with password
+// secret, and gives a client of it logging in as username with password.
+func fakeEtcdAuth(t *testing.T, username string, password string) (*etcdtest.Server, *Client) {
+	srv := etcdtest.NewServer()
+	srv.EnableAuth("ratchet", "secret")
+
+	c, err := New(Config{Endpoints: []string{srv.URL}, Username: username, Password: password})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return srv, c
+}
+
+func TestLogin(t *testing.T) {
+	srv, c := fakeEtcdAuth(t, "ratchet", "secret")
+	defer srv.Close()
+	ctx := context.Background()
+
+	put(t, c, "/a", "/b")
+	if _, err := c.Get(ctx, "/a"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if srv.Logins() != 1 {
+		t.Errorf("logged in %v times, want the token kept from the first", srv.Logins())
+	}
+
+	// Once the token's too old, we log in again and have another go.
+	srv.ExpireTokens()
+	if _, err := c.Get(ctx, "/a"); err != nil {
+		t.Fatalf("Get with an expired token: %v", err)
+	}
+	if srv.Logins() != 2 {
+		t.Errorf("logged in %v times, want once more for the expired token", srv.Logins())
+	}
+
+	// A watch turned down for its token logs in again next time.
+	srv.ExpireTokens()
+	if err := c.WaitForChange(ctx, "/", 0); !isAuthError(err) {
+		t.Errorf("WaitForChange with an expired token = %v, want it turned down", err)
+	}
+	if err := c.WaitForChange(ctx, "/", 0); err != nil {
+		t.Errorf("WaitForChange after an expired token: %v", err)
+	}
+	if srv.Logins() != 3 {
+		t.Errorf("logged in %v times, want once more for the watch", srv.Logins())
+	}
+}
+
+func TestLoginFails(t *testing.T) {
+	tests := []struct {
+		name               string
+		username, password string
+		wantErr            string
+	}{
+		{"wrong password", "ratchet", "guess", "failed to log in to etcd as ratchet"},
+		{"no login", "", "", "invalid auth token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, c := fakeEtcdAuth(t, tt.username, tt.password)
+			defer srv.Close()
+
+			err := c.Put(context.Background(), "/a", "a")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Put error = %v, want one saying %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcd is a small etcd v3 client, just enough for ratchet to keep
+// its state in etcd. It talks to etcd's JSON gateway (the /v3 HTTP API), so
+// it needs nothing more than net/http.
+package etcd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultRequestTimeout bounds each request to etcd, unless configured, so
+// that we fail fast when an endpoint is unavailable. Watches aren't bounded
+// by it.
+const DefaultRequestTimeout = time.Second
+
+// Config is how to reach etcd.
+type Config struct {
+	// Endpoints are etcd's client URLs, tried in order.
+	Endpoints []string
+	// RequestTimeout bounds each request, other than watches.
+	RequestTimeout time.Duration
+	// TLS is for https endpoints, and may hold a client certificate.
+	TLS *tls.Config
+	// Username and Password log us in, when etcd has auth enabled.
+	Username string
+	Password string
+}
+
+// Client talks to an etcd cluster through its v3 JSON gateway.
+type Client struct {
+	endpoints []string
+	timeout   time.Duration
+	http      *http.Client
+	username  string
+	password  string
+
+	// token is what etcd gave us for logging in, shared by the requests.
+	tokenLock sync.Mutex
+	token     string
+}
+
+// New makes a client for the etcd cluster in cfg.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints given")
+	}
+
+	transport := http.DefaultTransport
+	if cfg.TLS != nil {
+		transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     cfg.TLS,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+
+	c := &Client{
+		timeout:  cfg.RequestTimeout,
+		http:     &http.Client{Transport: transport},
+		username: cfg.Username,
+		password: cfg.Password,
+	}
+
+	if c.timeout <= 0 {
+		c.timeout = DefaultRequestTimeout
+	}
+
+	for _, endpoint := range cfg.Endpoints {
+		c.endpoints = append(c.endpoints, strings.TrimSuffix(endpoint, "/"))
+	}
+
+	return c, nil
+}
+
+// KeyValue is a key as stored in etcd.
+type KeyValue struct {
+	Key            string
+	Value          string
+	CreateRevision int64
+	ModRevision    int64
+	Lease          int64
+}
+
+// Error is an error etcd gave us.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("etcd error %v: %v", e.Code, e.Message)
+}
+
+// ErrKeyNotFound is what Get gives for a key that isn't there.
+var ErrKeyNotFound = fmt.Errorf("etcd key not found")
+
+// IsKeyNotFound says whether err is for a key that isn't there.
+func IsKeyNotFound(err error) bool {
+	return err == ErrKeyNotFound
+}
+
+// Get reads a single key, giving ErrKeyNotFound when it isn't there.
+func (c *Client) Get(ctx context.Context, key string) (*KeyValue, error) {
+	kvs, _, err := c.rangeKeys(ctx, key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	return &kvs[0], nil
+}
+
+// GetPrefix reads all the keys starting with prefix, sorted by key, along
+// with the revision of the store they were read at.
+func (c *Client) GetPrefix(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	return c.rangeKeys(ctx, prefix, prefixEnd(prefix))
+}
+
+// Children lists the names of what's directly under dir, taking the keys
+// as paths, in order.
+func (c *Client) Children(ctx context.Context, dir string) ([]string, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	kvs, _, err := c.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for _, kv := range kvs {
+		child := strings.SplitN(strings.TrimPrefix(kv.Key, prefix), "/", 2)[0]
+		if len(children) == 0 || children[len(children)-1] != child {
+			children = append(children, child)
+		}
+	}
+
+	return children, nil
+}
+
+// Put writes a key.
+func (c *Client) Put(ctx context.Context, key string, value string) error {
+	return c.call(ctx, "/v3/kv/put", OpPut(key, value).put, nil)
+}
+
+// Delete removes a key. Removing a key that isn't there is fine.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, "/v3/kv/deleterange", OpDelete(key).del, nil)
+}
+
+// DeletePrefix removes all the keys starting with prefix.
+func (c *Client) DeletePrefix(ctx context.Context, prefix string) error {
+	return c.call(ctx, "/v3/kv/deleterange", OpDeletePrefix(prefix).del, nil)
+}
+
+func (c *Client) rangeKeys(ctx context.Context, key string, rangeEnd string) ([]KeyValue, int64, error) {
+	req := rangeRequest{
+		Key:        encode(key),
+		RangeEnd:   encode(rangeEnd),
+		SortOrder:  "ASCEND",
+		SortTarget: "KEY",
+	}
+
+	resp := rangeResponse{}
+	if err := c.call(ctx, "/v3/kv/range", req, &resp); err != nil {
+		return nil, 0, err
+	}
+
+	kvs := make([]KeyValue, 0, len(resp.Kvs))
+	for _, wkv := range resp.Kvs {
+		kv, err := wkv.keyValue()
+		if err != nil {
+			return nil, 0, err
+		}
+		kvs = append(kvs, kv)
+	}
+
+	return kvs, int64(resp.Header.Revision), nil
+}
+
+// call posts req to the gateway at path, decoding the answer into resp
+// (unless it's nil). When our login has run out, we log in again and have
+// another go.
+func (c *Client) call(ctx context.Context, path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	err = c.callOnce(ctx, path, body, resp)
+	if isAuthError(err) && c.username != "" {
+		c.setToken("")
+		err = c.callOnce(ctx, path, body, resp)
+	}
+
+	return err
+}
+
+// callOnce goes through the endpoints until one answers in time.
+func (c *Client) callOnce(ctx context.Context, path string, body []byte, resp interface{}) error {
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		data, status, err := c.postOne(ctx, endpoint+path, body)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		if status != http.StatusOK {
+			return gatewayError(status, data)
+		}
+
+		if resp == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(data, resp); err != nil {
+			return fmt.Errorf("failed to parse etcd response from %v: %v", endpoint+path, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("no etcd endpoint answered %v: %v", path, lastErr)
+}
+
+// postOne makes one request, bounded by the request timeout, giving the
+// body and status of the answer.
+func (c *Client) postOne(ctx context.Context, url string, body []byte) ([]byte, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	httpResp, err := c.post(ctx, url, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResp.Body)
+	return data, httpResp.StatusCode, err
+}
+
+func (c *Client) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if c.username != "" && !strings.HasSuffix(url, authenticatePath) {
+		token, err := c.login(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", token)
+	}
+
+	return c.http.Do(req.WithContext(ctx))
+}
+
+// gatewayError makes an Error of what the gateway said went wrong.
+func gatewayError(status int, data []byte) error {
+	werr := struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	}{}
+
+	if err := json.Unmarshal(data, &werr); err != nil {
+		return &Error{Code: status, Message: strings.TrimSpace(string(data))}
+	}
+
+	message := werr.Message
+	if message == "" {
+		message = werr.Error
+	}
+
+	return &Error{Code: werr.Code, Message: message}
+}
+
+// prefixEnd is the end of the range of keys starting with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	// All 0xff, so everything after prefix.
+	return "\x00"
+}
+
+func encode(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// num is an int64 as the gateway gives it to us: usually as a string, but
+// we take a number too.
+type num int64
+
+func (n *num) UnmarshalJSON(data []byte) error {
+	i, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected a number, not %s", data)
+	}
+
+	*n = num(i)
+	return nil
+}
+
+type responseHeader struct {
+	Revision num `json:"revision"`
+}
+
+type wireKeyValue struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	CreateRevision num    `json:"create_revision"`
+	ModRevision    num    `json:"mod_revision"`
+	Lease          num    `json:"lease"`
+}
+
+func (w wireKeyValue) keyValue() (KeyValue, error) {
+	key, err := decode(w.Key)
+	if err != nil {
+		return KeyValue{}, fmt.Errorf("bad key from etcd %q: %v", w.Key, err)
+	}
+
+	value, err := decode(w.Value)
+	if err != nil {
+		return KeyValue{}, fmt.Errorf("bad value from etcd for %v: %v", key, err)
+	}
+
+	return KeyValue{
+		Key:            key,
+		Value:          value,
+		CreateRevision: int64(w.CreateRevision),
+		ModRevision:    int64(w.ModRevision),
+		Lease:          int64(w.Lease),
+	}, nil
+}
+
+type rangeRequest struct {
+	Key        string `json:"key"`
+	RangeEnd   string `json:"range_end,omitempty"`
+	SortOrder  string `json:"sort_order,omitempty"`
+	SortTarget string `json:"sort_target,omitempty"`
+}
+
+type rangeResponse struct {
+	Header responseHeader `json:"header"`
+	Kvs    []wireKeyValue `json:"kvs"`
+}
+
+type putRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease int64  `json:"lease,omitempty"`
+}
+
+type deleteRangeRequest struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+}
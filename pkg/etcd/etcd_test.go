@@ -0,0 +1,475 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dougbtv/ratchet-cni/pkg/etcd/etcdtest"
+	"golang.org/x/net/context"
+)
+
+// fakeEtcd starts a fake etcd, and gives a client of it.
+func fakeEtcd(t *testing.T) (*etcdtest.Server, *Client) {
+	srv := etcdtest.NewServer()
+
+	c, err := New(Config{Endpoints: []string{srv.URL + "/"}})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return srv, c
+}
+
+// put writes each key as its own value.
+func put(t *testing.T, c *Client, keys ...string) {
+	for _, key := range keys {
+		if err := c.Put(context.Background(), key, key); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+	}
+}
+
+// keys gives the keys starting with prefix.
+func keys(t *testing.T, c *Client, prefix string) []string {
+	kvs, _, err := c.GetPrefix(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("GetPrefix %q: %v", prefix, err)
+	}
+
+	var got []string
+	for _, kv := range kvs {
+		if kv.Value != kv.Key {
+			t.Errorf("%q holds %q, want its own name", kv.Key, kv.Value)
+		}
+		got = append(got, kv.Key)
+	}
+
+	return got
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"/ratchet/", "/ratchet0"},
+		{"a", "b"},
+		{"a\xff", "b"},
+		{"\xff\xff", "\x00"},
+	}
+
+	for _, tt := range tests {
+		if got := prefixEnd(tt.prefix); got != tt.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	srv, c := fakeEtcd(t)
+	defer srv.Close()
+	ctx := context.Background()
+
+	// Keys and values go over the wire base64 encoded, so they can be
+	// anything at all.
+	key := "/ratchet/association/default/pod-a/\x00\xff ü"
+	if err := c.Put(ctx, key, "\xfe\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := c.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if kv.Key != key || kv.Value != "\xfe\n" || kv.CreateRevision != 1 || kv.ModRevision != 1 {
+		t.Errorf("Get gave %+v, want %q holding %q, made at revision 1", kv, key, "\xfe\n")
+	}
+
+	if _, err := c.Get(ctx, "/ratchet/association/default/pod-b"); !IsKeyNotFound(err) {
+		t.Errorf("Get of a key that isn't there = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestGetPrefix(t *testing.T) {
+	srv, c := fakeEtcd(t)
+	defer srv.Close()
+	ctx := context.Background()
+
+	put(t, c, "/ratchet/b", "/ratchet/a/y", "/ratchet/a/x", "/ratchet", "/ratchetz", "/other")
+
+	want := []string{"/ratchet/a/x", "/ratchet/a/y", "/ratchet/b"}
+	if got := keys(t, c, "/ratchet/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetPrefix gave %q, want %q", got, want)
+	}
+
+	_, rev, err := c.GetPrefix(ctx, "/nothing/")
+	if err != nil || rev != 6 {
+		t.Errorf("GetPrefix of nothing was at revision %v (%v), want 6", rev, err)
+	}
+
+	children, err := c.Children(ctx, "/ratchet")
+	if err != nil || !reflect.DeepEqual(children, []string{"a", "b"}) {
+		t.Errorf("Children gave %q (%v), want [a b]", children, err)
+	}
+
+	if err := c.DeletePrefix(ctx, "/ratchet/a/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "/ratchet/c"); err != nil {
+		t.Errorf("Delete of a key that isn't there: %v", err)
+	}
+
+	want = []string{"/ratchet/b"}
+	if got := keys(t, c, "/ratchet/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetPrefix after DeletePrefix gave %q, want %q", got, want)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	tests := []struct {
+		name          string
+		cmps          func(a *KeyValue) []Cmp
+		wantSucceeded bool
+		wantKeys      []string
+	}{
+		{
+			name:          "no compares",
+			cmps:          func(a *KeyValue) []Cmp { return nil },
+			wantSucceeded: true,
+			wantKeys:      []string{"/t/a", "/t/then"},
+		},
+		{
+			name:          "missing",
+			cmps:          func(a *KeyValue) []Cmp { return []Cmp{Missing("/t/b")} },
+			wantSucceeded: true,
+			wantKeys:      []string{"/t/a", "/t/then"},
+		},
+		{
+			name:     "not missing",
+			cmps:     func(a *KeyValue) []Cmp { return []Cmp{Missing("/t/a")} },
+			wantKeys: []string{"/t/a", "/t/otherwise"},
+		},
+		{
+			name:          "mod revision",
+			cmps:          func(a *KeyValue) []Cmp { return []Cmp{ModRevisionIs(a.Key, a.ModRevision)} },
+			wantSucceeded: true,
+			wantKeys:      []string{"/t/a", "/t/then"},
+		},
+		{
+			name:     "changed since",
+			cmps:     func(a *KeyValue) []Cmp { return []Cmp{ModRevisionIs(a.Key, a.ModRevision-1)} },
+			wantKeys: []string{"/t/a", "/t/otherwise"},
+		},
+		{
+			name:          "value",
+			cmps:          func(a *KeyValue) []Cmp { return []Cmp{ValueIs("/t/a", "/t/a")} },
+			wantSucceeded: true,
+			wantKeys:      []string{"/t/a", "/t/then"},
+		},
+		{
+			name:     "another value",
+			cmps:     func(a *KeyValue) []Cmp { return []Cmp{ValueIs("/t/a", "/t/b")} },
+			wantKeys: []string{"/t/a", "/t/otherwise"},
+		},
+		{
+			name:     "value of a key that isn't there",
+			cmps:     func(a *KeyValue) []Cmp { return []Cmp{ValueIs("/t/b", "")} },
+			wantKeys: []string{"/t/a", "/t/otherwise"},
+		},
+		{
+			name:     "one of two failing",
+			cmps:     func(a *KeyValue) []Cmp { return []Cmp{Missing("/t/b"), Missing("/t/a")} },
+			wantKeys: []string{"/t/a", "/t/otherwise"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, c := fakeEtcd(t)
+			defer srv.Close()
+			ctx := context.Background()
+
+			put(t, c, "/t/a", "/t/old/x", "/t/old/y")
+			a, err := c.Get(ctx, "/t/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			then := []Op{OpPut("/t/then", "/t/then"), OpDeletePrefix("/t/old/")}
+			otherwise := []Op{OpPut("/t/otherwise", "/t/otherwise"), OpDelete("/t/old/x"), OpDelete("/t/old/y")}
+			succeeded, err := c.Txn(ctx, tt.cmps(a), then, otherwise)
+			if err != nil {
+				t.Fatalf("Txn: %v", err)
+			}
+
+			if succeeded != tt.wantSucceeded {
+				t.Errorf("Txn succeeded: %v, want %v", succeeded, tt.wantSucceeded)
+			}
+			if got := keys(t, c, "/t/"); !reflect.DeepEqual(got, tt.wantKeys) {
+				t.Errorf("Txn left %q, want %q", got, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestCreate(t *testing.T) {
+	srv, c := fakeEtcd(t)
+	defer srv.Close()
+	ctx := context.Background()
+
+	created, err := c.Create(ctx, "/t/a", "first")
+	if err != nil || !created {
+		t.Fatalf("Create of a new key = %v, %v, want it created", created, err)
+	}
+
+	created, err = c.Create(ctx, "/t/a", "second")
+	if err != nil || created {
+		t.Fatalf("Create of a key that's there = %v, %v, want it left alone", created, err)
+	}
+
+	kv, err := c.Get(ctx, "/t/a")
+	if err != nil || kv.Value != "first" {
+		t.Errorf("/t/a holds %+v (%v), want first", kv, err)
+	}
+}
+
+// waitForChange runs WaitForChange on prefix from rev, giving what it
+// gives.
+func waitForChange(ctx context.Context, c *Client, prefix string, rev int64) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WaitForChange(ctx, prefix, rev)
+	}()
+
+	return done
+}
+
+// waitForWatches waits until srv has had n watches opened.
+func waitForWatches(t *testing.T, srv *etcdtest.Server, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Watches() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v watches were opened, want %v", srv.Watches(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWaitForChange(t *testing.T) {
+	srv, c := fakeEtcd(t)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	put(t, c, "/w/a")
+	_, rev, err := c.GetPrefix(ctx, "/w/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := waitForChange(ctx, c, "/w/", rev)
+	waitForWatches(t, srv, 1)
+
+	// Changes outside the prefix don't count.
+	put(t, c, "/x/a", "/w")
+	select {
+	case err := <-done:
+		t.Fatalf("WaitForChange gave %v for a change outside its prefix", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	put(t, c, "/w/b")
+	if err := <-done; err != nil {
+		t.Fatalf("WaitForChange: %v", err)
+	}
+
+	// A change made since rev is seen straight away.
+	if err := c.WaitForChange(ctx, "/w/", rev); err != nil {
+		t.Errorf("WaitForChange of a change already made: %v", err)
+	}
+}
+
+func TestWaitForChangeResumes(t *testing.T) {
+	srv, c := fakeEtcd(t)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, rev, err := c.GetPrefix(ctx, "/w/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := waitForChange(ctx, c, "/w/", rev)
+	waitForWatches(t, srv, 1)
+
+	// A change made while the stream is down is caught up on once it's
+	// back, as it watches again from the same revision.
+	srv.DropWatches()
+	put(t, c, "/w/a")
+
+	if err := <-done; err != nil {
+		t.Fatalf("WaitForChange across a dropped stream: %v", err)
+	}
+	if srv.Watches() != 2 {
+		t.Errorf("%v watches were opened, want one watching again", srv.Watches())
+	}
+}
+
+func TestWaitForChangeCanceled(t *testing.T) {
+	srv, c := fakeEtcd(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := c.WaitForChange(ctx, "/w/", 0)
+	if err != context.DeadlineExceeded {
+		t.Errorf("WaitForChange with nothing changing = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGatewayError(t *testing.T) {
+	tests := []struct {
+		status  int
+		data    string
+		wantErr string
+	}{
+		{400, `{"error": "etcdserver: too many operations", "code": 3}`, "etcd error 3: etcdserver: too many operations"},
+		{401, `{"error": "x", "message": "etcdserver: invalid auth token", "code": 16}`, "etcd error 16: etcdserver: invalid auth token"},
+		{502, "Bad Gateway\n", "etcd error 502: Bad Gateway"},
+	}
+
+	for _, tt := range tests {
+		err := gatewayError(tt.status, []byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("gatewayError(%v, %q) = %v, want one saying %q", tt.status, tt.data, err, tt.wantErr)
+		}
+	}
+}
+
+// hangingServer takes requests and doesn't answer them until the client
+// gives up.
+func hangingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only once the body's read does the server notice the client go.
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+}
+
+// downServer gives the URL of a server that's gone.
+func downServer() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	return srv.URL
+}
+
+func TestFailover(t *testing.T) {
+	srv := etcdtest.NewServer()
+	defer srv.Close()
+	hanging := hangingServer()
+	defer hanging.Close()
+
+	tests := []struct {
+		name      string
+		endpoints []string
+		wantErr   string
+	}{
+		{name: "first", endpoints: []string{srv.URL, downServer()}},
+		{name: "first down", endpoints: []string{downServer(), srv.URL}},
+		{name: "first timing out", endpoints: []string{hanging.URL, srv.URL}},
+		{name: "all down", endpoints: []string{downServer(), downServer()}, wantErr: "no etcd endpoint answered /v3/kv/put"},
+		{name: "all timing out", endpoints: []string{hanging.URL}, wantErr: "no etcd endpoint answered /v3/kv/put"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(Config{Endpoints: tt.endpoints, RequestTimeout: 100 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			err = c.Put(context.Background(), "/f/"+tt.name, "")
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Put took %v, want it bounded by the request timeout", elapsed)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Put error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			if _, err := c.Get(context.Background(), "/f/"+tt.name); err != nil {
+				t.Errorf("Get of what was put: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	srv := etcdtest.NewTLSServer()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name    string
+		tls     *tls.Config
+		wantErr string
+	}{
+		{name: "trusted", tls: &tls.Config{RootCAs: roots}},
+		{name: "untrusted", tls: &tls.Config{}, wantErr: "certificate"},
+		{name: "without TLS", wantErr: "certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(Config{Endpoints: []string{srv.URL}, TLS: tt.tls})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Put(context.Background(), "/t/a", "a")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Put error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Put over TLS: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// authenticatePath is where clients log in.
+const authenticatePath = "/v3/auth/authenticate"
+
+// EnableAuth has the fake turn down requests without a token, which clients
+// get by logging in as username with password.
+func (s *Server) EnableAuth(username string, password string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.username = username
+	s.password = password
+}
+
+// ExpireTokens turns down the tokens given out so far, as etcd does once
+// they're too old.
+func (s *Server) ExpireTokens() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens = make(map[string]bool)
+}
+
+// Logins says how many times clients have logged in.
+func (s *Server) Logins() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.logins
+}
+
+// checkToken turns down r when auth is enabled and it doesn't have a token
+// we gave out, as etcd does.
+func (s *Server) checkToken(r *http.Request) *gatewayError {
+	if s.username == "" || r.URL.Path == authenticatePath || s.tokens[r.Header.Get("Authorization")] {
+		return nil
+	}
+
+	message := "etcdserver: invalid auth token"
+	return &gatewayError{status: http.StatusUnauthorized, Error: message, Message: message, Code: 16}
+}
+
+func (s *Server) authenticate(body []byte) (interface{}, *gatewayError) {
+	req := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	if s.username == "" || req.Name != s.username || req.Password != s.password {
+		return nil, badRequest("etcdserver: authentication failed, invalid user ID or password")
+	}
+
+	s.logins++
+	token := "token." + strconv.Itoa(s.logins)
+	s.tokens[token] = true
+
+	return struct {
+		Header header `json:"header"`
+		Token  string `json:"token"`
+	}{header{Revision: num(s.rev)}, token}, nil
+}
@@ -0,0 +1,524 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcdtest is a fake etcd, serving the parts of the v3 JSON gateway
+// package etcd uses from memory, so that what keeps its state in etcd can
+// be tested without one.
+package etcdtest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake etcd, listening on URL.
+type Server struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	rev    int64
+	keys   map[string]keyValue
+	events []event
+
+	// changed is closed when the store changes, and dropped when the
+	// watches are dropped, each then made anew.
+	changed chan struct{}
+	dropped chan struct{}
+	watches int
+
+	leases    map[int64]int64
+	lastLease int64
+
+	// With auth enabled, only requests with one of tokens get an answer.
+	username string
+	password string
+	tokens   map[string]bool
+	logins   int
+}
+
+// NewServer starts a fake etcd with nothing in it. Close it when done.
+func NewServer() *Server {
+	return newServer(httptest.NewServer)
+}
+
+// NewTLSServer starts a fake etcd like NewServer, serving https with a
+// certificate of its own.
+func NewTLSServer() *Server {
+	return newServer(httptest.NewTLSServer)
+}
+
+func newServer(start func(http.Handler) *httptest.Server) *Server {
+	s := &Server{
+		keys:    make(map[string]keyValue),
+		changed: make(chan struct{}),
+		dropped: make(chan struct{}),
+		leases:  make(map[int64]int64),
+		tokens:  make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", s.handle(s.rangeKeys))
+	mux.HandleFunc("/v3/kv/put", s.handle(s.put))
+	mux.HandleFunc("/v3/kv/deleterange", s.handle(s.deleteRange))
+	mux.HandleFunc("/v3/kv/txn", s.handle(s.txn))
+	mux.HandleFunc("/v3/watch", s.watch)
+	mux.HandleFunc("/v3/lease/grant", s.handle(s.grant))
+	mux.HandleFunc("/v3/lease/keepalive", s.handle(s.keepAlive))
+	mux.HandleFunc("/v3/lease/revoke", s.handle(s.revoke))
+	mux.HandleFunc(authenticatePath, s.handle(s.authenticate))
+	s.Server = start(mux)
+
+	return s
+}
+
+// num is an int64 as the gateway takes it: as a string, or a number.
+type num int64
+
+func (n *num) UnmarshalJSON(data []byte) error {
+	i, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*n = num(i)
+	return err
+}
+
+func (n num) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(n), 10))
+}
+
+type keyValue struct {
+	Key            string `json:"key"`
+	Value          string `json:"value,omitempty"`
+	CreateRevision num    `json:"create_revision,omitempty"`
+	ModRevision    num    `json:"mod_revision,omitempty"`
+	Lease          num    `json:"lease,omitempty"`
+}
+
+// event is a change to a key, as a watch gives it.
+type event struct {
+	Type string   `json:"type,omitempty"`
+	Kv   keyValue `json:"kv"`
+}
+
+type header struct {
+	Revision num `json:"revision"`
+}
+
+type rangeRequest struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end"`
+}
+
+type putRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease num    `json:"lease"`
+}
+
+type compare struct {
+	Key            string `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	CreateRevision num    `json:"create_revision"`
+	ModRevision    num    `json:"mod_revision"`
+	Value          string `json:"value"`
+}
+
+type requestOp struct {
+	RequestPut         *putRequest   `json:"request_put"`
+	RequestDeleteRange *rangeRequest `json:"request_delete_range"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare"`
+	Success []requestOp `json:"success"`
+	Failure []requestOp `json:"failure"`
+}
+
+// gatewayError is how the gateway says what went wrong.
+type gatewayError struct {
+	status  int
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func badRequest(message string) *gatewayError {
+	return &gatewayError{status: http.StatusBadRequest, Error: message, Message: message, Code: 3}
+}
+
+// handle serves one of the gateway's calls: f is given the request body, and
+// gives what to answer with. It's called holding the lock.
+func (s *Server) handle(f func(body []byte) (interface{}, *gatewayError)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.lock.Lock()
+		rev := s.rev
+		var resp interface{}
+		gerr := s.checkToken(r)
+		if gerr == nil {
+			resp, gerr = f(body)
+		}
+		if s.rev != rev {
+			close(s.changed)
+			s.changed = make(chan struct{})
+		}
+		s.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if gerr != nil {
+			writeError(w, gerr)
+			return
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func writeError(w http.ResponseWriter, gerr *gatewayError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(gerr.status)
+	json.NewEncoder(w).Encode(gerr)
+}
+
+func decode(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// inRange gives the keys from key up to rangeEnd in order.
+func (s *Server) inRange(key string, rangeEnd string) []string {
+	var keys []string
+	for k := range s.keys {
+		if within(k, key, rangeEnd) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// within says whether k is from key up to rangeEnd: just key when there's no
+// rangeEnd, and everything from key on when it's "\x00".
+func within(k string, key string, rangeEnd string) bool {
+	switch rangeEnd {
+	case "":
+		return k == key
+	case "\x00":
+		return k >= key
+	}
+
+	return k >= key && k < rangeEnd
+}
+
+func (s *Server) rangeKeys(body []byte) (interface{}, *gatewayError) {
+	req := rangeRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	resp := struct {
+		Header header     `json:"header"`
+		Kvs    []keyValue `json:"kvs,omitempty"`
+		Count  num        `json:"count,omitempty"`
+	}{Header: header{Revision: num(s.rev)}}
+
+	for _, k := range s.inRange(decode(req.Key), decode(req.RangeEnd)) {
+		kv := s.keys[k]
+		kv.Key = encode(kv.Key)
+		kv.Value = encode(kv.Value)
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	resp.Count = num(len(resp.Kvs))
+
+	return resp, nil
+}
+
+func (s *Server) put(body []byte) (interface{}, *gatewayError) {
+	req := putRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	if gerr := s.checkLease(req.Lease); gerr != nil {
+		return nil, gerr
+	}
+
+	s.rev++
+	s.apply(requestOp{RequestPut: &req})
+	return struct {
+		Header header `json:"header"`
+	}{header{Revision: num(s.rev)}}, nil
+}
+
+func (s *Server) deleteRange(body []byte) (interface{}, *gatewayError) {
+	req := rangeRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	s.rev++
+	deleted := s.apply(requestOp{RequestDeleteRange: &req})
+	if !deleted {
+		// Nothing changed, so the store stays at the revision it was.
+		s.rev--
+	}
+
+	return struct {
+		Header header `json:"header"`
+	}{header{Revision: num(s.rev)}}, nil
+}
+
+// apply does op at the current revision, saying whether it changed
+// anything.
+func (s *Server) apply(op requestOp) bool {
+	if put := op.RequestPut; put != nil {
+		key := decode(put.Key)
+		kv, ok := s.keys[key]
+		if !ok {
+			kv = keyValue{Key: key, CreateRevision: num(s.rev)}
+		}
+		kv.Value = decode(put.Value)
+		kv.ModRevision = num(s.rev)
+		kv.Lease = put.Lease
+		s.keys[key] = kv
+		s.events = append(s.events, event{Kv: kv})
+		return true
+	}
+
+	keys := s.inRange(decode(op.RequestDeleteRange.Key), decode(op.RequestDeleteRange.RangeEnd))
+	for _, k := range keys {
+		delete(s.keys, k)
+		s.events = append(s.events, event{Type: "DELETE", Kv: keyValue{Key: k, ModRevision: num(s.rev)}})
+	}
+
+	return len(keys) > 0
+}
+
+// holds says whether cmp holds. As in etcd, a key that isn't there has
+// revisions of 0, and no value to compare.
+func (s *Server) holds(cmp compare) bool {
+	kv, ok := s.keys[decode(cmp.Key)]
+
+	var diff int
+	switch cmp.Target {
+	case "CREATE":
+		diff = compareNums(kv.CreateRevision, cmp.CreateRevision)
+	case "MOD":
+		diff = compareNums(kv.ModRevision, cmp.ModRevision)
+	case "VALUE":
+		if !ok {
+			return false
+		}
+		diff = strings.Compare(kv.Value, decode(cmp.Value))
+	default:
+		return false
+	}
+
+	switch cmp.Result {
+	case "", "EQUAL":
+		return diff == 0
+	case "NOT_EQUAL":
+		return diff != 0
+	case "GREATER":
+		return diff > 0
+	case "LESS":
+		return diff < 0
+	}
+
+	return false
+}
+
+func compareNums(a num, b num) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func (s *Server) txn(body []byte) (interface{}, *gatewayError) {
+	req := txnRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	for _, op := range append(req.Success, req.Failure...) {
+		if op.RequestPut == nil {
+			continue
+		}
+		if gerr := s.checkLease(op.RequestPut.Lease); gerr != nil {
+			return nil, gerr
+		}
+	}
+
+	succeeded := true
+	for _, cmp := range req.Compare {
+		if !s.holds(cmp) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := req.Failure
+	if succeeded {
+		ops = req.Success
+	}
+
+	s.rev++
+	changed := false
+	for _, op := range ops {
+		if s.apply(op) {
+			changed = true
+		}
+	}
+	if !changed {
+		s.rev--
+	}
+
+	return struct {
+		Header    header `json:"header"`
+		Succeeded bool   `json:"succeeded,omitempty"`
+	}{header{Revision: num(s.rev)}, succeeded}, nil
+}
+
+type watchRequest struct {
+	CreateRequest struct {
+		Key           string `json:"key"`
+		RangeEnd      string `json:"range_end"`
+		StartRevision num    `json:"start_revision"`
+	} `json:"create_request"`
+}
+
+// watchResult is one message of a watch's stream.
+type watchResult struct {
+	Result struct {
+		Header  header  `json:"header"`
+		Created bool    `json:"created,omitempty"`
+		Events  []event `json:"events,omitempty"`
+	} `json:"result"`
+}
+
+// watch streams the changes to the keys asked for, from the revision asked
+// for, until the client goes or the watches are dropped.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	req := watchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, rangeEnd := decode(req.CreateRequest.Key), decode(req.CreateRequest.RangeEnd)
+
+	s.lock.Lock()
+	if gerr := s.checkToken(r); gerr != nil {
+		s.lock.Unlock()
+		writeError(w, gerr)
+		return
+	}
+	s.watches++
+	dropped := s.dropped
+	wresult := watchResult{}
+	wresult.Result.Header.Revision = num(s.rev)
+	wresult.Result.Created = true
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	flusher := w.(http.Flusher)
+	encoder.Encode(wresult)
+	flusher.Flush()
+
+	// As in etcd, a watch without a revision starts from now.
+	rev := int64(req.CreateRequest.StartRevision)
+	if rev == 0 {
+		rev = int64(wresult.Result.Header.Revision) + 1
+	}
+
+	for {
+		s.lock.Lock()
+		wresult = watchResult{}
+		wresult.Result.Header.Revision = num(s.rev)
+		wresult.Result.Events = s.eventsFrom(rev, key, rangeEnd)
+		changed := s.changed
+		s.lock.Unlock()
+
+		if len(wresult.Result.Events) > 0 {
+			encoder.Encode(wresult)
+			flusher.Flush()
+			rev = int64(wresult.Result.Header.Revision) + 1
+		}
+
+		select {
+		case <-changed:
+		case <-dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// eventsFrom gives the changes to the keys from key up to rangeEnd since
+// revision rev, as a watch sends them.
+func (s *Server) eventsFrom(rev int64, key string, rangeEnd string) []event {
+	var events []event
+	for _, ev := range s.events {
+		if int64(ev.Kv.ModRevision) < rev || !within(ev.Kv.Key, key, rangeEnd) {
+			continue
+		}
+
+		ev.Kv.Key = encode(ev.Kv.Key)
+		ev.Kv.Value = encode(ev.Kv.Value)
+		events = append(events, ev)
+	}
+
+	return events
+}
+
+// DropWatches ends the streams of the watches open now, as a gateway or a
+// proxy in front of it does once a stream has been idle for long enough.
+func (s *Server) DropWatches() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	close(s.dropped)
+	s.dropped = make(chan struct{})
+}
+
+// Watches says how many watches have been opened.
+func (s *Server) Watches() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.watches
+}
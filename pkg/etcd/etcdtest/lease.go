@@ -0,0 +1,122 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdtest
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type leaseRequest struct {
+	ID  num `json:"ID"`
+	TTL num `json:"TTL"`
+}
+
+type leaseResponse struct {
+	Header header `json:"header"`
+	ID     num    `json:"ID,omitempty"`
+	TTL    num    `json:"TTL,omitempty"`
+}
+
+// checkLease turns down putting a key with a lease we don't have.
+func (s *Server) checkLease(lease num) *gatewayError {
+	if _, ok := s.leases[int64(lease)]; lease == 0 || ok {
+		return nil
+	}
+
+	return leaseNotFound()
+}
+
+func leaseNotFound() *gatewayError {
+	message := "etcdserver: requested lease not found"
+	return &gatewayError{status: http.StatusNotFound, Error: message, Message: message, Code: 5}
+}
+
+// Leases gives the leases there are, with their TTLs. The fake's leases
+// don't run out of their own accord: revoking one does what its running out
+// would.
+func (s *Server) Leases() map[int64]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	leases := make(map[int64]int64)
+	for id, ttl := range s.leases {
+		leases[id] = ttl
+	}
+
+	return leases
+}
+
+func (s *Server) grant(body []byte) (interface{}, *gatewayError) {
+	req := leaseRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	if req.TTL <= 0 {
+		return nil, badRequest("etcdserver: too small TTL")
+	}
+
+	s.lastLease++
+	s.leases[s.lastLease] = int64(req.TTL)
+
+	return leaseResponse{Header: header{Revision: num(s.rev)}, ID: num(s.lastLease), TTL: req.TTL}, nil
+}
+
+// keepAlive answers as the first message of the keepalive stream, which
+// for a lease we don't have has no TTL.
+func (s *Server) keepAlive(body []byte) (interface{}, *gatewayError) {
+	req := leaseRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	resp := leaseResponse{Header: header{Revision: num(s.rev)}, ID: req.ID}
+	if ttl, ok := s.leases[int64(req.ID)]; ok {
+		resp.TTL = num(ttl)
+	}
+
+	return struct {
+		Result leaseResponse `json:"result"`
+	}{resp}, nil
+}
+
+func (s *Server) revoke(body []byte) (interface{}, *gatewayError) {
+	req := leaseRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	if _, ok := s.leases[int64(req.ID)]; !ok {
+		return nil, leaseNotFound()
+	}
+	delete(s.leases, int64(req.ID))
+
+	// The keys go with it, all at one revision.
+	s.rev++
+	deleted := false
+	for k, kv := range s.keys {
+		if kv.Lease == req.ID {
+			delete(s.keys, k)
+			s.events = append(s.events, event{Type: "DELETE", Kv: keyValue{Key: k, ModRevision: num(s.rev)}})
+			deleted = true
+		}
+	}
+	if !deleted {
+		s.rev--
+	}
+
+	return leaseResponse{Header: header{Revision: num(s.rev)}}, nil
+}
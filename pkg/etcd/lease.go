@@ -0,0 +1,85 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// ErrLeaseNotFound is what KeepAlive gives for a lease that's run out.
+var ErrLeaseNotFound = fmt.Errorf("etcd lease not found")
+
+// IsLeaseNotFound says whether err is for a lease that's run out.
+func IsLeaseNotFound(err error) bool {
+	return err == ErrLeaseNotFound
+}
+
+type leaseGrantRequest struct {
+	TTL int64 `json:"TTL"`
+}
+
+type leaseRequest struct {
+	ID string `json:"ID"`
+}
+
+type leaseResponse struct {
+	ID  num `json:"ID"`
+	TTL num `json:"TTL"`
+}
+
+// keepAliveResponse is the one message of the keepalive stream we read.
+type keepAliveResponse struct {
+	Result *leaseResponse `json:"result"`
+}
+
+// Grant makes a lease which runs out after ttl seconds, unless kept alive,
+// taking the keys put with it along.
+func (c *Client) Grant(ctx context.Context, ttl int64) (int64, error) {
+	resp := leaseResponse{}
+	if err := c.call(ctx, "/v3/lease/grant", leaseGrantRequest{TTL: ttl}, &resp); err != nil {
+		return 0, err
+	}
+
+	return int64(resp.ID), nil
+}
+
+// KeepAlive starts the lease's ttl over, giving ErrLeaseNotFound when it's
+// already run out.
+func (c *Client) KeepAlive(ctx context.Context, lease int64) error {
+	resp := keepAliveResponse{}
+	if err := c.call(ctx, "/v3/lease/keepalive", leaseRequest{ID: strconv.FormatInt(lease, 10)}, &resp); err != nil {
+		return err
+	}
+
+	// etcd answers a lease it doesn't have with a TTL of 0.
+	if resp.Result == nil || resp.Result.TTL <= 0 {
+		return ErrLeaseNotFound
+	}
+
+	return nil
+}
+
+// Revoke ends the lease now, taking its keys with it.
+func (c *Client) Revoke(ctx context.Context, lease int64) error {
+	return c.call(ctx, "/v3/lease/revoke", leaseRequest{ID: strconv.FormatInt(lease, 10)}, nil)
+}
+
+// PutLease writes a key which goes when lease does.
+func (c *Client) PutLease(ctx context.Context, key string, value string, lease int64) error {
+	return c.call(ctx, "/v3/kv/put", OpPutLease(key, value, lease).put, nil)
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestLease(t *testing.T) {
+	srv, c := fakeEtcd(t)
+	defer srv.Close()
+	ctx := context.Background()
+
+	lease, err := c.Grant(ctx, 10)
+	if err != nil {
+		t.Fatalf("Grant: %v", err)
+	}
+	if ttl := srv.Leases()[lease]; ttl != 10 {
+		t.Errorf("lease %v has a TTL of %v, want 10", lease, ttl)
+	}
+
+	if err := c.PutLease(ctx, "/l/a", "a", lease); err != nil {
+		t.Fatalf("PutLease: %v", err)
+	}
+	if _, err := c.Txn(ctx, nil, []Op{OpPutLease("/l/b", "b", lease)}, nil); err != nil {
+		t.Fatalf("Txn with OpPutLease: %v", err)
+	}
+	put(t, c, "/l/c")
+
+	kv, err := c.Get(ctx, "/l/a")
+	if err != nil || kv.Lease != lease {
+		t.Errorf("/l/a is %+v (%v), want it on lease %v", kv, err, lease)
+	}
+
+	if err := c.KeepAlive(ctx, lease); err != nil {
+		t.Errorf("KeepAlive: %v", err)
+	}
+
+	// Its keys go with it.
+	if err := c.Revoke(ctx, lease); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	want := []string{"/l/c"}
+	if got := keys(t, c, "/l/"); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Revoke left %q, want %q", got, want)
+	}
+
+	if err := c.KeepAlive(ctx, lease); !IsLeaseNotFound(err) {
+		t.Errorf("KeepAlive of a revoked lease = %v, want ErrLeaseNotFound", err)
+	}
+
+	err = c.PutLease(ctx, "/l/a", "a", lease)
+	if err == nil || !strings.Contains(err.Error(), "lease not found") {
+		t.Errorf("PutLease on a revoked lease = %v, want it turned down", err)
+	}
+}
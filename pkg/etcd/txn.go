@@ -0,0 +1,120 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// Cmp is a condition on a key, for a transaction.
+type Cmp struct {
+	Key            string `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	ModRevision    string `json:"mod_revision,omitempty"`
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          string `json:"value,omitempty"`
+}
+
+// Missing holds when key isn't there.
+func Missing(key string) Cmp {
+	return Cmp{Key: encode(key), Target: "CREATE", Result: "EQUAL", CreateRevision: "0"}
+}
+
+// ModRevisionIs holds when key was last changed at revision rev, so that
+// nobody's changed it since we read it.
+func ModRevisionIs(key string, rev int64) Cmp {
+	return Cmp{Key: encode(key), Target: "MOD", Result: "EQUAL", ModRevision: strconv.FormatInt(rev, 10)}
+}
+
+// ValueIs holds when key holds value.
+func ValueIs(key string, value string) Cmp {
+	return Cmp{Key: encode(key), Target: "VALUE", Result: "EQUAL", Value: encode(value)}
+}
+
+// Op is something a transaction does.
+type Op struct {
+	put *putRequest
+	del *deleteRangeRequest
+}
+
+// OpPut writes a key.
+func OpPut(key string, value string) Op {
+	return Op{put: &putRequest{Key: encode(key), Value: encode(value)}}
+}
+
+// OpPutLease writes a key which goes when lease does.
+func OpPutLease(key string, value string, lease int64) Op {
+	return Op{put: &putRequest{Key: encode(key), Value: encode(value), Lease: lease}}
+}
+
+// OpDelete removes a key.
+func OpDelete(key string) Op {
+	return Op{del: &deleteRangeRequest{Key: encode(key)}}
+}
+
+// OpDeletePrefix removes all the keys starting with prefix.
+func OpDeletePrefix(prefix string) Op {
+	return Op{del: &deleteRangeRequest{Key: encode(prefix), RangeEnd: encode(prefixEnd(prefix))}}
+}
+
+type wireOp struct {
+	RequestPut         *putRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+func wireOps(ops []Op) []wireOp {
+	wops := make([]wireOp, 0, len(ops))
+	for _, op := range ops {
+		wops = append(wops, wireOp{RequestPut: op.put, RequestDeleteRange: op.del})
+	}
+
+	return wops
+}
+
+type txnRequest struct {
+	Compare []Cmp    `json:"compare,omitempty"`
+	Success []wireOp `json:"success,omitempty"`
+	Failure []wireOp `json:"failure,omitempty"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// Txn does then when all of cmps hold, and otherwise, all in one go. It
+// says whether cmps held.
+func (c *Client) Txn(ctx context.Context, cmps []Cmp, then []Op, otherwise []Op) (bool, error) {
+	req := txnRequest{
+		Compare: cmps,
+		Success: wireOps(then),
+		Failure: wireOps(otherwise),
+	}
+
+	resp := txnResponse{}
+	if err := c.call(ctx, "/v3/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+// Create writes key only if it isn't there already, and says whether it
+// did.
+func (c *Client) Create(ctx context.Context, key string, value string) (bool, error) {
+	return c.Txn(ctx, []Cmp{Missing(key)}, []Op{OpPut(key, value)}, nil)
+}
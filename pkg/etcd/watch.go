@@ -0,0 +1,151 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type watchCreateRequest struct {
+	Key           string `json:"key"`
+	RangeEnd      string `json:"range_end,omitempty"`
+	StartRevision string `json:"start_revision,omitempty"`
+}
+
+type watchRequest struct {
+	CreateRequest watchCreateRequest `json:"create_request"`
+}
+
+type watchResponse struct {
+	Result *struct {
+		Canceled        bool              `json:"canceled"`
+		CompactRevision num               `json:"compact_revision"`
+		CancelReason    string            `json:"cancel_reason"`
+		Events          []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		HTTPCode int    `json:"http_code"`
+		Message  string `json:"message"`
+	} `json:"error"`
+}
+
+// watchResumeDelay is how long we wait before watching again when a watch's
+// stream is dropped.
+const watchResumeDelay = 100 * time.Millisecond
+
+// errWatchDropped is what readWatch gives when the stream ends without any
+// events.
+var errWatchDropped = fmt.Errorf("etcd watch ended")
+
+// WaitForChange waits until any key starting with prefix changes after
+// revision rev (as GetPrefix gives it), or ctx is done. Only ctx bounds
+// how long it waits: when the gateway (or a proxy in front of it) drops the
+// watch's stream, we watch again from rev, so nothing that changed in
+// between is missed.
+func (c *Client) WaitForChange(ctx context.Context, prefix string, rev int64) error {
+	body, err := json.Marshal(watchRequest{CreateRequest: watchCreateRequest{
+		Key:           encode(prefix),
+		RangeEnd:      encode(prefixEnd(prefix)),
+		StartRevision: strconv.FormatInt(rev+1, 10),
+	}})
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := c.watch(ctx, body)
+		if err != errWatchDropped {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watchResumeDelay):
+		}
+	}
+}
+
+// watch opens a watch on the first endpoint that answers, and reads it
+// until it has events.
+func (c *Client) watch(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		resp, err := c.post(ctx, endpoint+"/v3/watch", body)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		err = readWatch(resp)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isAuthError(err) {
+			// Log in again when we next try.
+			c.setToken("")
+		}
+		return err
+	}
+
+	return fmt.Errorf("no etcd endpoint answered /v3/watch: %v", lastErr)
+}
+
+// readWatch reads the watch's stream of responses until one has events.
+func readWatch(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return gatewayError(resp.StatusCode, data)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		wresp := watchResponse{}
+		if err := decoder.Decode(&wresp); err != nil {
+			return errWatchDropped
+		}
+
+		if wresp.Error != nil {
+			return &Error{Code: wresp.Error.HTTPCode, Message: wresp.Error.Message}
+		}
+
+		if wresp.Result == nil {
+			continue
+		}
+
+		if wresp.Result.Canceled || wresp.Result.CompactRevision != 0 {
+			return fmt.Errorf("etcd watch canceled: %v (compacted to %v)", wresp.Result.CancelReason, wresp.Result.CompactRevision)
+		}
+
+		if len(wresp.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
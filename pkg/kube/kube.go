@@ -0,0 +1,125 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kube is a small Kubernetes API client, just enough for ratchet to
+// look up the pod it's been asked to network.
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// requestTimeout bounds each request to the API server.
+const requestTimeout = 10 * time.Second
+
+// K8sArgs are the CNI_ARGS the kubelet passes to CNI plugins.
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+}
+
+// PodArgs picks the pod's namespace and name out of CNI_ARGS. Both are empty
+// when we weren't called by the kubelet.
+func PodArgs(cniArgs string) (string, string, error) {
+	k8sArgs := &K8sArgs{}
+	if err := types.LoadArgs(cniArgs, k8sArgs); err != nil {
+		return "", "", fmt.Errorf("failed to load CNI_ARGS: %v", err)
+	}
+
+	return string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), nil
+}
+
+// Pod is the part of a v1.Pod that we care about.
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+// ObjectMeta is the part of a v1.ObjectMeta that we care about.
+type ObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	UID         string            `json:"uid"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Client talks to the API server named in a kubeconfig.
+type Client struct {
+	config *restConfig
+	http   *http.Client
+}
+
+// NewClient makes a client from the kubeconfig at the given path.
+func NewClient(kubeconfigPath string) (*Client, error) {
+	rc, err := loadKubeconfig(kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		config: rc,
+		http: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: rc.TLS, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// GetPod fetches a pod from the API server.
+func (c *Client) GetPod(namespace string, name string) (*Pod, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name))
+
+	req, err := http.NewRequest("GET", c.config.Server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	} else if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %v", namespace, name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pod %s/%s: %v", namespace, name, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %s: %s", namespace, name, resp.Status, body)
+	}
+
+	pod := &Pod{}
+	if err := json.Unmarshal(body, pod); err != nil {
+		return nil, fmt.Errorf("failed to decode pod %s/%s: %v", namespace, name, err)
+	}
+
+	return pod, nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePod is what the fake API server gives for default/pod-a.
+const fakePod = `{
+  "metadata": {
+    "name": "pod-a",
+    "namespace": "default",
+    "uid": "1234",
+    "labels": {"ratchet": "true", "ratchet.local_ifname": "in1"},
+    "annotations": {"ratchet.link": "{}"}
+  }
+}`
+
+// fakeAPIServer serves default/pod-a to requests with the given
+// Authorization header, and 404s everything else.
+func fakeAPIServer(auth string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != auth {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path != "/api/v1/namespaces/default/pods/pod-a" {
+			http.Error(w, `{"kind": "Status", "reason": "NotFound"}`, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, fakePod)
+	})
+}
+
+// writeKubeconfig writes a kubeconfig for server into dir, with the given
+// extra cluster and user settings.
+func writeKubeconfig(t *testing.T, dir string, server string, cluster string, user string) string {
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: test
+  cluster:
+    server: %s
+%s
+users:
+- name: test
+  user:
+%s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+`, server, indent(cluster), indent(user))
+
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func indent(lines string) string {
+	if lines == "" {
+		return ""
+	}
+
+	var out []string
+	for _, line := range strings.Split(lines, "\n") {
+		out = append(out, "    "+line)
+	}
+
+	return strings.Join(out, "\n")
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ratchet-kube")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestGetPod(t *testing.T) {
+	tests := []struct {
+		name      string
+		auth      string
+		user      string
+		namespace string
+		pod       string
+		wantErr   string
+	}{
+		{
+			name:      "found",
+			namespace: "default",
+			pod:       "pod-a",
+		},
+		{
+			name:      "not found",
+			namespace: "default",
+			pod:       "pod-b",
+			wantErr:   "404 Not Found",
+		},
+		{
+			name:      "not found in another namespace",
+			namespace: "other",
+			pod:       "pod-a",
+			wantErr:   "404 Not Found",
+		},
+		{
+			name:      "bearer token",
+			auth:      "Bearer s3cret",
+			user:      "token: s3cret",
+			namespace: "default",
+			pod:       "pod-a",
+		},
+		{
+			name:      "basic auth",
+			auth:      "Basic YWRtaW46cGFzcw==",
+			user:      "username: admin\npassword: pass",
+			namespace: "default",
+			pod:       "pod-a",
+		},
+		{
+			name:      "wrong token",
+			auth:      "Bearer s3cret",
+			user:      "token: guess",
+			namespace: "default",
+			pod:       "pod-a",
+			wantErr:   "401 Unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(fakeAPIServer(tt.auth))
+			defer srv.Close()
+
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			kc, err := NewClient(writeKubeconfig(t, dir, srv.URL, "", tt.user))
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+
+			pod, err := kc.GetPod(tt.namespace, tt.pod)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetPod error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetPod: %v", err)
+			}
+
+			if pod.Metadata.Name != "pod-a" || pod.Metadata.Namespace != "default" || pod.Metadata.UID != "1234" {
+				t.Errorf("GetPod metadata = %+v", pod.Metadata)
+			}
+			if pod.Metadata.Labels["ratchet.local_ifname"] != "in1" {
+				t.Errorf("GetPod labels = %v", pod.Metadata.Labels)
+			}
+			if pod.Metadata.Annotations["ratchet.link"] != "{}" {
+				t.Errorf("GetPod annotations = %v", pod.Metadata.Annotations)
+			}
+		})
+	}
+}
+
+func TestGetPodTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(fakeAPIServer(""))
+	defer srv.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cluster string
+		wantErr bool
+	}{
+		{
+			name:    "certificate-authority, relative to the kubeconfig",
+			cluster: "certificate-authority: ca.crt",
+		},
+		{
+			name:    "certificate-authority-data",
+			cluster: "certificate-authority-data: " + base64String(ca),
+		},
+		{
+			name:    "insecure-skip-tls-verify",
+			cluster: "insecure-skip-tls-verify: true",
+		},
+		{
+			name:    "untrusted",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kc, err := NewClient(writeKubeconfig(t, dir, srv.URL, tt.cluster, ""))
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+
+			_, err = kc.GetPod("default", "pod-a")
+			if tt.wantErr && err == nil {
+				t.Fatalf("GetPod from a server we don't trust worked")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("GetPod: %v", err)
+			}
+		})
+	}
+}
+
+func TestPodArgs(t *testing.T) {
+	tests := []struct {
+		args          string
+		wantNamespace string
+		wantName      string
+	}{
+		{"K8S_POD_NAMESPACE=lab;K8S_POD_NAME=pod-a;K8S_POD_INFRA_CONTAINER_ID=abc;IgnoreUnknown=1", "lab", "pod-a"},
+		{"IgnoreUnknown=1", "", ""},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		namespace, name, err := PodArgs(tt.args)
+		if err != nil {
+			t.Errorf("PodArgs(%q): %v", tt.args, err)
+			continue
+		}
+		if namespace != tt.wantNamespace || name != tt.wantName {
+			t.Errorf("PodArgs(%q) = %q, %q, want %q, %q", tt.args, namespace, name, tt.wantNamespace, tt.wantName)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// kubeconfig is the subset of a kubeconfig file we understand: enough to
+// talk to one API server with a token, basic auth or a client certificate.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string      `yaml:"name"`
+		Cluster kubeCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string   `yaml:"name"`
+		User kubeUser `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+type kubeCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type kubeUser struct {
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"tokenFile"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+}
+
+// restConfig is what we need out of a kubeconfig to make requests.
+type restConfig struct {
+	Server   string
+	Token    string
+	Username string
+	Password string
+	TLS      *tls.Config
+
+	// dir is where the kubeconfig lives; relative paths are relative to it.
+	dir string
+}
+
+func loadKubeconfig(path string) (*restConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig %q: %v", path, err)
+	}
+
+	kc := &kubeconfig{}
+	if err := yaml.Unmarshal(data, kc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %q: %v", path, err)
+	}
+
+	clusterName, userName := kc.CurrentContext, ""
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+
+	rc := &restConfig{TLS: &tls.Config{}, dir: filepath.Dir(path)}
+
+	for _, c := range kc.Clusters {
+		if c.Name == clusterName {
+			if err := rc.setCluster(c.Cluster); err != nil {
+				return nil, fmt.Errorf("cluster %q: %v", clusterName, err)
+			}
+		}
+	}
+
+	if rc.Server == "" {
+		return nil, fmt.Errorf("kubeconfig %q has no cluster server for context %q", path, kc.CurrentContext)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name == userName {
+			if err := rc.setUser(u.User); err != nil {
+				return nil, fmt.Errorf("user %q: %v", userName, err)
+			}
+		}
+	}
+
+	return rc, nil
+}
+
+func (rc *restConfig) resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(rc.dir, path)
+}
+
+func (rc *restConfig) setCluster(cluster kubeCluster) error {
+	rc.Server = strings.TrimSuffix(cluster.Server, "/")
+	rc.TLS.InsecureSkipVerify = cluster.InsecureSkipTLSVerify
+
+	ca, err := fileOrData(rc.resolve(cluster.CertificateAuthority), cluster.CertificateAuthorityData)
+	if err != nil || ca == nil {
+		return err
+	}
+
+	rc.TLS.RootCAs = x509.NewCertPool()
+	if !rc.TLS.RootCAs.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in the certificate-authority")
+	}
+
+	return nil
+}
+
+func (rc *restConfig) setUser(user kubeUser) error {
+	rc.Token, rc.Username, rc.Password = user.Token, user.Username, user.Password
+
+	if rc.Token == "" && user.TokenFile != "" {
+		data, err := ioutil.ReadFile(rc.resolve(user.TokenFile))
+		if err != nil {
+			return fmt.Errorf("failed to read tokenFile: %v", err)
+		}
+		rc.Token = strings.TrimSpace(string(data))
+	}
+
+	cert, err := fileOrData(rc.resolve(user.ClientCertificate), user.ClientCertificateData)
+	if err != nil {
+		return err
+	}
+
+	key, err := fileOrData(rc.resolve(user.ClientKey), user.ClientKeyData)
+	if err != nil {
+		return err
+	}
+
+	if cert != nil && key != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		rc.TLS.Certificates = []tls.Certificate{pair}
+	}
+
+	return nil
+}
+
+// fileOrData gives the contents of the file, or else the base64 decoded data,
+// or else nil.
+func fileOrData(path string, data string) ([]byte, error) {
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %v", path, err)
+		}
+		return b, nil
+	}
+
+	if data != "" {
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode kubeconfig data: %v", err)
+		}
+		return b, nil
+	}
+
+	return nil, nil
+}
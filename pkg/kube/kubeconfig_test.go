@@ -0,0 +1,184 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func base64String(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		kubeconfig string
+		wantServer string
+		wantToken  string
+		wantUser   string
+		wantErr    string
+	}{
+		{
+			name: "current context picks the cluster and user",
+			kubeconfig: `current-context: b
+clusters:
+- name: one
+  cluster: {server: "https://one:6443"}
+- name: two
+  cluster: {server: "https://two:6443/"}
+users:
+- name: alice
+  user: {token: alice-token}
+- name: bob
+  user: {username: bob, password: pass}
+contexts:
+- name: a
+  context: {cluster: one, user: alice}
+- name: b
+  context: {cluster: two, user: bob}
+`,
+			wantServer: "https://two:6443",
+			wantUser:   "bob",
+		},
+		{
+			name: "tokenFile, relative to the kubeconfig",
+			kubeconfig: `current-context: a
+clusters:
+- name: one
+  cluster: {server: "https://one:6443"}
+users:
+- name: alice
+  user: {tokenFile: token}
+contexts:
+- name: a
+  context: {cluster: one, user: alice}
+`,
+			wantServer: "https://one:6443",
+			wantToken:  "from-file",
+		},
+		{
+			name: "token wins over tokenFile",
+			kubeconfig: `current-context: a
+clusters:
+- name: one
+  cluster: {server: "https://one:6443"}
+users:
+- name: alice
+  user: {token: inline, tokenFile: token}
+contexts:
+- name: a
+  context: {cluster: one, user: alice}
+`,
+			wantServer: "https://one:6443",
+			wantToken:  "inline",
+		},
+		{
+			name: "no server for the context",
+			kubeconfig: `current-context: missing
+clusters:
+- name: one
+  cluster: {server: "https://one:6443"}
+`,
+			wantErr: "has no cluster server",
+		},
+		{
+			name: "bad certificate-authority-data",
+			kubeconfig: `current-context: a
+clusters:
+- name: one
+  cluster: {server: "https://one:6443", certificate-authority-data: "not base64!"}
+contexts:
+- name: a
+  context: {cluster: one}
+`,
+			wantErr: "failed to decode",
+		},
+		{
+			name: "certificate-authority without certificates",
+			kubeconfig: `current-context: a
+clusters:
+- name: one
+  cluster: {server: "https://one:6443", certificate-authority: token}
+contexts:
+- name: a
+  context: {cluster: one}
+`,
+			wantErr: "no certificates found",
+		},
+		{
+			name: "missing tokenFile",
+			kubeconfig: `current-context: a
+clusters:
+- name: one
+  cluster: {server: "https://one:6443"}
+users:
+- name: alice
+  user: {tokenFile: nowhere}
+contexts:
+- name: a
+  context: {cluster: one, user: alice}
+`,
+			wantErr: "failed to read tokenFile",
+		},
+		{
+			name:       "not yaml",
+			kubeconfig: "clusters: [",
+			wantErr:    "failed to parse kubeconfig",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "kubeconfig")
+			if err := ioutil.WriteFile(path, []byte(tt.kubeconfig), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			rc, err := loadKubeconfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadKubeconfig error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadKubeconfig: %v", err)
+			}
+
+			if rc.Server != tt.wantServer || rc.Token != tt.wantToken || rc.Username != tt.wantUser {
+				t.Errorf("loadKubeconfig = server %q token %q user %q, want %q %q %q", rc.Server, rc.Token, rc.Username, tt.wantServer, tt.wantToken, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestLoadKubeconfigMissing(t *testing.T) {
+	if _, err := loadKubeconfig("/nonexistent/kubeconfig"); err == nil {
+		t.Fatal("loadKubeconfig of a missing file worked")
+	}
+}
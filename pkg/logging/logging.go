@@ -0,0 +1,66 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging sets up the leveled logger ratchet and ratchet-child share.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLevel is the level we log at when the netconf doesn't say.
+const DefaultLevel = "info"
+
+// Default is a logger to stderr at the default level, for use until we've
+// read a config.
+func Default(component string) *logrus.Entry {
+	logger := logrus.New()
+	logger.Out = os.Stderr
+	logger.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	logger.Level = logrus.InfoLevel
+
+	return logger.WithField("component", component)
+}
+
+// New makes a logger for the component which logs to logFile (appending), or
+// to stderr when logFile is empty, at the given level.
+func New(component string, level string, logFile string) (*logrus.Entry, error) {
+	if level == "" {
+		level = DefaultLevel
+	}
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log_level %q: %v", level, err)
+	}
+
+	var out io.Writer = os.Stderr
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log_file %q: %v", logFile, err)
+		}
+		out = f
+	}
+
+	logger := Default(component)
+	logger.Logger.Out = out
+	logger.Logger.Level = lvl
+
+	return logger, nil
+}
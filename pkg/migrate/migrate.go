@@ -0,0 +1,93 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migrate moves ratchet's state out of the etcd v2 store. It's kept
+// apart from package etcd, so that only the command doing the move needs
+// the v2 client.
+package migrate
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/coreos/etcd/client"
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/etcd"
+	"golang.org/x/net/context"
+)
+
+// Result counts what FromV2 did.
+type Result struct {
+	Copied  int
+	Skipped int
+	// Left are the v2 keys with nowhere to go, as config.V2Keys has it.
+	Left int
+}
+
+// FromV2 copies ratchet's keys under root in the etcd v2 store to v3, where
+// config.V2Keys says they belong now. Keys already in v3 are left as they
+// are (and counted as skipped), so it's safe to run more than once.
+func FromV2(ctx context.Context, v2 client.KeysAPI, v3 *etcd.Client, root string) (Result, error) {
+	result := Result{}
+
+	resp, err := v2.Get(ctx, root, &client.GetOptions{Recursive: true, Sort: true})
+	if client.IsKeyNotFound(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to read %v from etcd v2: %v", root, err)
+	}
+
+	// v2 dirs have no v3 equivalent, v3 keys are just named like paths,
+	// so only the values are copied.
+	v2keys := make(map[string]string)
+	readNode(resp.Node, v2keys)
+
+	keys := config.V2Keys(v2keys)
+	result.Left = len(v2keys) - len(keys)
+
+	// In order, so that a run cut short leaves a tidy trail.
+	var names []string
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		created, err := v3.Create(ctx, key, keys[key])
+		if err != nil {
+			return result, fmt.Errorf("failed to copy %v to etcd v3: %v", key, err)
+		}
+
+		if created {
+			result.Copied++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	return result, nil
+}
+
+// readNode gathers the keys under node, with their values.
+func readNode(node *client.Node, keys map[string]string) {
+	if !node.Dir {
+		keys[node.Key] = node.Value
+		return
+	}
+
+	for _, child := range node.Nodes {
+		readNode(child, keys)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/etcd"
+	"golang.org/x/net/context"
+)
+
+// etcdStore keeps state in etcd.
+type etcdStore struct {
+	client *etcd.Client
+}
+
+func newEtcdStore(netconf *config.NetConf) (Store, error) {
+	cfg, err := netconf.EtcdConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := etcd.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %v", err)
+	}
+
+	return &etcdStore{client: c}, nil
+}
+
+func (s *etcdStore) Get(ctx context.Context, key string) (*KeyValue, error) {
+	kv, err := s.client.Get(ctx, key)
+	if etcd.IsKeyNotFound(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyValue{Key: kv.Key, Value: kv.Value, CreateRevision: kv.CreateRevision, ModRevision: kv.ModRevision}, nil
+}
+
+func (s *etcdStore) GetPrefix(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	ekvs, rev, err := s.client.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kvs := make([]KeyValue, 0, len(ekvs))
+	for _, kv := range ekvs {
+		kvs = append(kvs, KeyValue{Key: kv.Key, Value: kv.Value, CreateRevision: kv.CreateRevision, ModRevision: kv.ModRevision})
+	}
+
+	return kvs, rev, nil
+}
+
+func (s *etcdStore) Children(ctx context.Context, dir string) ([]string, error) {
+	return s.client.Children(ctx, dir)
+}
+
+func (s *etcdStore) Put(ctx context.Context, key string, value string) error {
+	return s.client.Put(ctx, key, value)
+}
+
+func (s *etcdStore) Delete(ctx context.Context, key string) error {
+	return s.client.Delete(ctx, key)
+}
+
+func (s *etcdStore) DeletePrefix(ctx context.Context, prefix string) error {
+	return s.client.DeletePrefix(ctx, prefix)
+}
+
+func (s *etcdStore) Txn(ctx context.Context, cmps []Cmp, then []Op, otherwise []Op) (bool, error) {
+	ecmps := make([]etcd.Cmp, 0, len(cmps))
+	for _, cmp := range cmps {
+		switch cmp.target {
+		case cmpMissing:
+			ecmps = append(ecmps, etcd.Missing(cmp.Key))
+		case cmpModRevision:
+			ecmps = append(ecmps, etcd.ModRevisionIs(cmp.Key, cmp.rev))
+		case cmpValue:
+			ecmps = append(ecmps, etcd.ValueIs(cmp.Key, cmp.value))
+		}
+	}
+
+	return s.client.Txn(ctx, ecmps, etcdOps(then), etcdOps(otherwise))
+}
+
+func (s *etcdStore) Create(ctx context.Context, key string, value string) (bool, error) {
+	return s.client.Create(ctx, key, value)
+}
+
+func (s *etcdStore) WaitForChange(ctx context.Context, prefix string, rev int64) error {
+	return s.client.WaitForChange(ctx, prefix, rev)
+}
+
+func (s *etcdStore) Grant(ctx context.Context, ttl int64) (int64, error) {
+	return s.client.Grant(ctx, ttl)
+}
+
+func (s *etcdStore) KeepAlive(ctx context.Context, lease int64) error {
+	err := s.client.KeepAlive(ctx, lease)
+	if etcd.IsLeaseNotFound(err) {
+		return ErrLeaseNotFound
+	}
+
+	return err
+}
+
+func (s *etcdStore) Revoke(ctx context.Context, lease int64) error {
+	return s.client.Revoke(ctx, lease)
+}
+
+func (s *etcdStore) PutLease(ctx context.Context, key string, value string, lease int64) error {
+	return s.client.PutLease(ctx, key, value, lease)
+}
+
+func etcdOps(ops []Op) []etcd.Op {
+	eops := make([]etcd.Op, 0, len(ops))
+	for _, op := range ops {
+		switch op.kind {
+		case opPut:
+			eops = append(eops, etcd.OpPutLease(op.Key, op.value, op.lease))
+		case opDelete:
+			eops = append(eops, etcd.OpDelete(op.Key))
+		case opDeletePrefix:
+			eops = append(eops, etcd.OpDeletePrefix(op.Key))
+		}
+	}
+
+	return eops
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// NodesDir holds what each node keeps about itself.
+const NodesDir = "/ratchet/nodes"
+
+// maxLeaseTries bounds how often we go around when other processes on the
+// node keep changing its lease under us.
+const maxLeaseTries = 10
+
+// NodeLeaseKey holds the id of the lease the node's keys are put with.
+func NodeLeaseKey(node string) string {
+	return NodesDir + "/" + node + "/lease"
+}
+
+// NodeLease gives the lease for node's keys, keeping it alive, or granting
+// a new one with ttl seconds when it's run out. Everything on the node shares
+// the one lease, so keeping it alive keeps all of the node's keys.
+func NodeLease(ctx context.Context, s Store, node string, ttl int64) (int64, error) {
+	key := NodeLeaseKey(node)
+
+	for tries := 0; tries < maxLeaseTries; tries++ {
+		kv, err := s.Get(ctx, key)
+		if err != nil && !IsKeyNotFound(err) {
+			return 0, fmt.Errorf("failed to read lease of node %v: %v", node, err)
+		}
+
+		if err == nil {
+			lease, err := strconv.ParseInt(kv.Value, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("lease of node %v is %q, not a number", node, kv.Value)
+			}
+
+			err = s.KeepAlive(ctx, lease)
+			if err == nil {
+				return lease, nil
+			}
+			if err != ErrLeaseNotFound {
+				return 0, fmt.Errorf("failed to keep lease of node %v alive: %v", node, err)
+			}
+
+			// It's run out, but its key hasn't gone yet. Take it
+			// away, unless someone's beaten us to it.
+			cmps := []Cmp{ModRevisionIs(key, kv.ModRevision)}
+			if _, err := s.Txn(ctx, cmps, []Op{OpDelete(key)}, nil); err != nil {
+				return 0, fmt.Errorf("failed to clear lease of node %v: %v", node, err)
+			}
+			continue
+		}
+
+		lease, err := s.Grant(ctx, ttl)
+		if err != nil {
+			return 0, fmt.Errorf("failed to grant lease for node %v: %v", node, err)
+		}
+
+		// The key goes along with the lease, so it's never left naming a
+		// lease that's run out for long.
+		value := strconv.FormatInt(lease, 10)
+		created, err := s.Txn(ctx, []Cmp{Missing(key)}, []Op{OpPutLease(key, value, lease)}, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to record lease of node %v: %v", node, err)
+		}
+
+		if created {
+			return lease, nil
+		}
+
+		// Another process on the node got there first, so use theirs.
+		if err := s.Revoke(ctx, lease); err != nil {
+			return 0, fmt.Errorf("failed to revoke spare lease of node %v: %v", node, err)
+		}
+	}
+
+	return 0, fmt.Errorf("failed to settle on a lease for node %v after %v tries", node, maxLeaseTries)
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testLocalStore gives a local store in a dir of its own, and a func to
+// clean it up.
+func testLocalStore(t *testing.T) (Store, func()) {
+	dir, err := ioutil.TempDir("", "ratchet-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newLocalStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestNodeLease(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	lease, err := NodeLease(ctx, s, "node1", 60)
+	if err != nil {
+		t.Fatalf("NodeLease: %v", err)
+	}
+
+	kv, err := s.Get(ctx, NodeLeaseKey("node1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv.Value != strconv.FormatInt(lease, 10) {
+		t.Errorf("lease key = %q, want %v", kv.Value, lease)
+	}
+
+	// Asking again keeps the same one alive.
+	again, err := NodeLease(ctx, s, "node1", 60)
+	if err != nil {
+		t.Fatalf("NodeLease again: %v", err)
+	}
+	if again != lease {
+		t.Errorf("NodeLease again = %v, want %v", again, lease)
+	}
+
+	// Each node has its own.
+	other, err := NodeLease(ctx, s, "node2", 60)
+	if err != nil {
+		t.Fatalf("NodeLease of node2: %v", err)
+	}
+	if other == lease {
+		t.Errorf("NodeLease of node2 = %v, the same as node1's", other)
+	}
+}
+
+func TestNodeLeaseExpired(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	lease, err := NodeLease(ctx, s, "node1", 1)
+	if err != nil {
+		t.Fatalf("NodeLease: %v", err)
+	}
+
+	if err := s.PutLease(ctx, "/ratchet/association/default/a/node", "node1", lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leases of the local store run out on the second.
+	time.Sleep(2100 * time.Millisecond)
+
+	if err := s.KeepAlive(ctx, lease); err != ErrLeaseNotFound {
+		t.Errorf("KeepAlive of a lease that's run out = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if _, err := s.Get(ctx, "/ratchet/association/default/a/node"); !IsKeyNotFound(err) {
+		t.Errorf("key of a lease that's run out: %v, want it gone", err)
+	}
+
+	renewed, err := NodeLease(ctx, s, "node1", 60)
+	if err != nil {
+		t.Fatalf("NodeLease after it ran out: %v", err)
+	}
+	if renewed == lease {
+		t.Errorf("NodeLease after it ran out = %v, want a new lease", renewed)
+	}
+}
+
+func TestNodeLeaseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		// Its key may outlast the lease for a while on etcd.
+		{"lease that's run out", "99", ""},
+		{"not a number", "lease", "not a number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cleanup := testLocalStore(t)
+			defer cleanup()
+
+			ctx := context.Background()
+			if err := s.Put(ctx, NodeLeaseKey("node1"), tt.value); err != nil {
+				t.Fatal(err)
+			}
+
+			lease, err := NodeLease(ctx, s, "node1", 60)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NodeLease error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NodeLease: %v", err)
+			}
+
+			if err := s.KeepAlive(ctx, lease); err != nil {
+				t.Errorf("KeepAlive of the lease NodeLease gave: %v", err)
+			}
+
+			kv, err := s.Get(ctx, NodeLeaseKey("node1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kv.Value != strconv.FormatInt(lease, 10) {
+				t.Errorf("lease key = %q, want %v", kv.Value, lease)
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// localStateFile is the file under the CNIDir holding the local store.
+const localStateFile = "ratchet-state.json"
+
+// localLockFile is what's locked while the local store is read or written.
+const localLockFile = "ratchet-state.lock"
+
+// localPollInterval is how often WaitForChange looks at the local store.
+const localPollInterval = 100 * time.Millisecond
+
+// localMaxChanges is how many of the latest changes the local store keeps
+// for WaitForChange to look through.
+const localMaxChanges = 1000
+
+// localStore keeps state in a JSON file, taking a file lock around each
+// read and write, so the plugin and child processes on one node can share
+// it.
+type localStore struct {
+	path string
+	lock string
+}
+
+// localData is what's in the file.
+type localData struct {
+	Revision int64               `json:"revision"`
+	Keys     map[string]localKey `json:"keys"`
+	// Changes are the latest keys written or removed, oldest first, and
+	// Compacted the revision before which we've let them go.
+	Changes   []localChange `json:"changes"`
+	Compacted int64         `json:"compacted"`
+	// Leases are by id, the last one handed out being LastLease.
+	Leases    map[int64]localLease `json:"leases"`
+	LastLease int64                `json:"last_lease"`
+
+	// dirty is whether there's anything to write back.
+	dirty bool
+}
+
+type localKey struct {
+	Value          string `json:"value"`
+	CreateRevision int64  `json:"create_revision"`
+	ModRevision    int64  `json:"mod_revision"`
+	Lease          int64  `json:"lease,omitempty"`
+}
+
+type localLease struct {
+	TTL int64 `json:"ttl"`
+	// Expires is when it runs out, in seconds since the epoch.
+	Expires int64 `json:"expires"`
+}
+
+type localChange struct {
+	Key      string `json:"key"`
+	Revision int64  `json:"revision"`
+}
+
+func newLocalStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %v for the local store: %v", dir, err)
+	}
+
+	return &localStore{
+		path: filepath.Join(dir, localStateFile),
+		lock: filepath.Join(dir, localLockFile),
+	}, nil
+}
+
+// view runs f on the data, under a shared lock.
+func (s *localStore) view(f func(*localData) error) error {
+	unlock, err := s.flock(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	// We can't write here, so just leave out what's run out.
+	data.expire(time.Now(), false)
+
+	return f(data)
+}
+
+// update runs f on the data under an exclusive lock, and writes it back
+// when f made any change.
+func (s *localStore) update(f func(*localData) error) error {
+	unlock, err := s.flock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	data.expire(time.Now(), true)
+
+	if err := f(data); err != nil {
+		return err
+	}
+
+	if !data.dirty {
+		return nil
+	}
+
+	return s.write(data)
+}
+
+func (s *localStore) flock(how int) (func(), error) {
+	f, err := os.OpenFile(s.lock, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local store lock %v: %v", s.lock, err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock local store %v: %v", s.lock, err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (s *localStore) read() (*localData, error) {
+	data := &localData{Keys: map[string]localKey{}, Leases: map[int64]localLease{}}
+
+	bytes, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local store %v: %v", s.path, err)
+	}
+
+	if err := json.Unmarshal(bytes, data); err != nil {
+		return nil, fmt.Errorf("failed to parse local store %v: %v", s.path, err)
+	}
+
+	if data.Keys == nil {
+		data.Keys = map[string]localKey{}
+	}
+
+	if data.Leases == nil {
+		data.Leases = map[int64]localLease{}
+	}
+
+	return data, nil
+}
+
+// write replaces the file, so that a crash can't leave half of it behind.
+func (s *localStore) write(data *localData) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes, 0600); err != nil {
+		return fmt.Errorf("failed to write local store %v: %v", tmp, err)
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace local store %v: %v", s.path, err)
+	}
+
+	return nil
+}
+
+// sortedKeys gives the keys starting with prefix, in order.
+func (d *localData) sortedKeys(prefix string) []string {
+	var keys []string
+	for key := range d.Keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// changed records that key changed at the revision being written.
+func (d *localData) changed(key string, rev int64) {
+	d.Changes = append(d.Changes, localChange{Key: key, Revision: rev})
+
+	if len(d.Changes) > localMaxChanges {
+		drop := len(d.Changes) - localMaxChanges
+		d.Compacted = d.Changes[drop-1].Revision
+		d.Changes = append([]localChange(nil), d.Changes[drop:]...)
+	}
+}
+
+func (d *localData) holds(cmp Cmp) bool {
+	key, ok := d.Keys[cmp.Key]
+
+	switch cmp.target {
+	case cmpMissing:
+		return !ok
+	case cmpModRevision:
+		return ok && key.ModRevision == cmp.rev
+	case cmpValue:
+		return ok && key.Value == cmp.value
+	}
+
+	return false
+}
+
+// expire removes the leases which have run out, and their keys. Unless
+// it's to record the change, it only takes them out of what's been read.
+func (d *localData) expire(now time.Time, record bool) {
+	var ops []Op
+	expired := false
+	for id, lease := range d.Leases {
+		if lease.Expires > now.Unix() {
+			continue
+		}
+
+		expired = true
+		delete(d.Leases, id)
+		for key, lkey := range d.Keys {
+			if lkey.Lease == id {
+				ops = append(ops, OpDelete(key))
+			}
+		}
+	}
+
+	if !record {
+		for _, op := range ops {
+			delete(d.Keys, op.Key)
+		}
+		return
+	}
+
+	if expired {
+		d.dirty = true
+		d.apply(ops)
+	}
+}
+
+// apply does ops, all at the one revision, as etcd does.
+func (d *localData) apply(ops []Op) error {
+	rev := d.Revision + 1
+	wrote := false
+
+	for _, op := range ops {
+		if op.lease != 0 {
+			if _, ok := d.Leases[op.lease]; !ok {
+				return ErrLeaseNotFound
+			}
+		}
+	}
+
+	for _, op := range ops {
+		switch op.kind {
+		case opPut:
+			key, ok := d.Keys[op.Key]
+			if !ok {
+				key.CreateRevision = rev
+			}
+			key.Value = op.value
+			key.ModRevision = rev
+			key.Lease = op.lease
+			d.Keys[op.Key] = key
+			d.changed(op.Key, rev)
+			wrote = true
+
+		case opDelete:
+			if _, ok := d.Keys[op.Key]; ok {
+				delete(d.Keys, op.Key)
+				d.changed(op.Key, rev)
+				wrote = true
+			}
+
+		case opDeletePrefix:
+			for _, key := range d.sortedKeys(op.Key) {
+				delete(d.Keys, key)
+				d.changed(key, rev)
+				wrote = true
+			}
+		}
+	}
+
+	if wrote {
+		d.Revision = rev
+		d.dirty = true
+	}
+
+	return nil
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (*KeyValue, error) {
+	var kv *KeyValue
+	err := s.view(func(d *localData) error {
+		lkey, ok := d.Keys[key]
+		if !ok {
+			return ErrKeyNotFound
+		}
+
+		kv = &KeyValue{Key: key, Value: lkey.Value, CreateRevision: lkey.CreateRevision, ModRevision: lkey.ModRevision}
+		return nil
+	})
+
+	return kv, err
+}
+
+func (s *localStore) GetPrefix(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	var kvs []KeyValue
+	var rev int64
+	err := s.view(func(d *localData) error {
+		for _, key := range d.sortedKeys(prefix) {
+			lkey := d.Keys[key]
+			kvs = append(kvs, KeyValue{Key: key, Value: lkey.Value, CreateRevision: lkey.CreateRevision, ModRevision: lkey.ModRevision})
+		}
+		rev = d.Revision
+		return nil
+	})
+
+	return kvs, rev, err
+}
+
+func (s *localStore) Children(ctx context.Context, dir string) ([]string, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	kvs, _, err := s.GetPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for _, kv := range kvs {
+		child := strings.SplitN(strings.TrimPrefix(kv.Key, prefix), "/", 2)[0]
+		if len(children) == 0 || children[len(children)-1] != child {
+			children = append(children, child)
+		}
+	}
+
+	return children, nil
+}
+
+func (s *localStore) Put(ctx context.Context, key string, value string) error {
+	_, err := s.Txn(ctx, nil, []Op{OpPut(key, value)}, nil)
+	return err
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	_, err := s.Txn(ctx, nil, []Op{OpDelete(key)}, nil)
+	return err
+}
+
+func (s *localStore) DeletePrefix(ctx context.Context, prefix string) error {
+	_, err := s.Txn(ctx, nil, []Op{OpDeletePrefix(prefix)}, nil)
+	return err
+}
+
+func (s *localStore) Txn(ctx context.Context, cmps []Cmp, then []Op, otherwise []Op) (bool, error) {
+	succeeded := true
+	err := s.update(func(d *localData) error {
+		for _, cmp := range cmps {
+			if !d.holds(cmp) {
+				succeeded = false
+				break
+			}
+		}
+
+		if succeeded {
+			return d.apply(then)
+		}
+		return d.apply(otherwise)
+	})
+
+	return succeeded, err
+}
+
+func (s *localStore) Create(ctx context.Context, key string, value string) (bool, error) {
+	return s.Txn(ctx, []Cmp{Missing(key)}, []Op{OpPut(key, value)}, nil)
+}
+
+// WaitForChange looks over the latest changes every so often. When the
+// changes after rev have been let go, it can't tell, so it comes back
+// straight away.
+func (s *localStore) WaitForChange(ctx context.Context, prefix string, rev int64) error {
+	for {
+		changed := false
+		err := s.view(func(d *localData) error {
+			if d.Compacted > rev {
+				changed = true
+				return nil
+			}
+
+			for _, change := range d.Changes {
+				if change.Revision > rev && strings.HasPrefix(change.Key, prefix) {
+					changed = true
+					break
+				}
+			}
+			return nil
+		})
+
+		if err != nil || changed {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(localPollInterval):
+		}
+	}
+}
+
+func (s *localStore) Grant(ctx context.Context, ttl int64) (int64, error) {
+	var id int64
+	err := s.update(func(d *localData) error {
+		d.LastLease++
+		id = d.LastLease
+		d.Leases[id] = localLease{TTL: ttl, Expires: time.Now().Unix() + ttl}
+		d.dirty = true
+		return nil
+	})
+
+	return id, err
+}
+
+func (s *localStore) KeepAlive(ctx context.Context, lease int64) error {
+	return s.update(func(d *localData) error {
+		l, ok := d.Leases[lease]
+		if !ok {
+			return ErrLeaseNotFound
+		}
+
+		l.Expires = time.Now().Unix() + l.TTL
+		d.Leases[lease] = l
+		d.dirty = true
+		return nil
+	})
+}
+
+func (s *localStore) Revoke(ctx context.Context, lease int64) error {
+	return s.update(func(d *localData) error {
+		if _, ok := d.Leases[lease]; !ok {
+			return nil
+		}
+
+		var ops []Op
+		for key, lkey := range d.Keys {
+			if lkey.Lease == lease {
+				ops = append(ops, OpDelete(key))
+			}
+		}
+
+		delete(d.Leases, lease)
+		d.dirty = true
+		return d.apply(ops)
+	})
+}
+
+func (s *localStore) PutLease(ctx context.Context, key string, value string, lease int64) error {
+	_, err := s.Txn(ctx, nil, []Op{OpPutLease(key, value, lease)}, nil)
+	return err
+}
@@ -0,0 +1,316 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testKeys gives what's under prefix, as key to value.
+func testKeys(t *testing.T, s Store, prefix string) map[string]string {
+	kvs, _, err := s.GetPrefix(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string]string)
+	for _, kv := range kvs {
+		keys[kv.Key] = kv.Value
+	}
+
+	return keys
+}
+
+func TestLocalTxn(t *testing.T) {
+	tests := []struct {
+		name string
+		// cmps are made given the revision /a was written at.
+		cmps      func(rev int64) []Cmp
+		then      []Op
+		otherwise []Op
+		wantHeld  bool
+		wantKeys  map[string]string
+	}{
+		{
+			name:     "no cmps",
+			cmps:     func(int64) []Cmp { return nil },
+			then:     []Op{OpPut("/b", "2")},
+			wantHeld: true,
+			wantKeys: map[string]string{"/a": "1", "/b": "2"},
+		},
+		{
+			name:      "missing holds",
+			cmps:      func(int64) []Cmp { return []Cmp{Missing("/b")} },
+			then:      []Op{OpPut("/b", "2")},
+			otherwise: []Op{OpPut("/c", "3")},
+			wantHeld:  true,
+			wantKeys:  map[string]string{"/a": "1", "/b": "2"},
+		},
+		{
+			name:      "missing fails",
+			cmps:      func(int64) []Cmp { return []Cmp{Missing("/a")} },
+			then:      []Op{OpPut("/a", "2")},
+			otherwise: []Op{OpPut("/c", "3")},
+			wantKeys:  map[string]string{"/a": "1", "/c": "3"},
+		},
+		{
+			name:     "mod revision holds",
+			cmps:     func(rev int64) []Cmp { return []Cmp{ModRevisionIs("/a", rev)} },
+			then:     []Op{OpPut("/a", "2")},
+			wantHeld: true,
+			wantKeys: map[string]string{"/a": "2"},
+		},
+		{
+			name:     "mod revision fails",
+			cmps:     func(rev int64) []Cmp { return []Cmp{ModRevisionIs("/a", rev-1)} },
+			then:     []Op{OpPut("/a", "2")},
+			wantKeys: map[string]string{"/a": "1"},
+		},
+		{
+			name:     "mod revision of a missing key fails",
+			cmps:     func(rev int64) []Cmp { return []Cmp{ModRevisionIs("/b", rev)} },
+			then:     []Op{OpPut("/b", "2")},
+			wantKeys: map[string]string{"/a": "1"},
+		},
+		{
+			name:     "value holds",
+			cmps:     func(int64) []Cmp { return []Cmp{ValueIs("/a", "1")} },
+			then:     []Op{OpDelete("/a")},
+			wantHeld: true,
+			wantKeys: map[string]string{},
+		},
+		{
+			name:     "value fails",
+			cmps:     func(int64) []Cmp { return []Cmp{ValueIs("/a", "2")} },
+			then:     []Op{OpDelete("/a")},
+			wantKeys: map[string]string{"/a": "1"},
+		},
+		{
+			name:     "one of several fails",
+			cmps:     func(rev int64) []Cmp { return []Cmp{ModRevisionIs("/a", rev), Missing("/a")} },
+			then:     []Op{OpPut("/b", "2")},
+			wantKeys: map[string]string{"/a": "1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cleanup := testLocalStore(t)
+			defer cleanup()
+
+			ctx := context.Background()
+			if err := s.Put(ctx, "/a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			kv, err := s.Get(ctx, "/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			held, err := s.Txn(ctx, tt.cmps(kv.ModRevision), tt.then, tt.otherwise)
+			if err != nil {
+				t.Fatalf("Txn: %v", err)
+			}
+			if held != tt.wantHeld {
+				t.Errorf("Txn = %v, want %v", held, tt.wantHeld)
+			}
+
+			if got := testKeys(t, s, "/"); !reflect.DeepEqual(got, tt.wantKeys) {
+				t.Errorf("keys after Txn = %v, want %v", got, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestLocalRevisions(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	// Everything in a transaction is written at the one revision.
+	ctx := context.Background()
+	if _, err := s.Txn(ctx, nil, []Op{OpPut("/a", "1"), OpPut("/b", "1")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "/a", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, rev, err := s.GetPrefix(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []KeyValue{
+		{Key: "/a", Value: "2", CreateRevision: 1, ModRevision: 2},
+		{Key: "/b", Value: "1", CreateRevision: 1, ModRevision: 1},
+	}
+	if !reflect.DeepEqual(kvs, want) || rev != 2 {
+		t.Errorf("GetPrefix = %+v at %v, want %+v at 2", kvs, rev, want)
+	}
+
+	// Removing what isn't there writes nothing.
+	if err := s.Delete(ctx, "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, rev, _ := s.GetPrefix(ctx, "/"); rev != 2 {
+		t.Errorf("revision after removing a missing key = %v, want 2", rev)
+	}
+
+	created, err := s.Create(ctx, "/a", "3")
+	if err != nil || created {
+		t.Errorf("Create of a key that's there = %v, %v, want false", created, err)
+	}
+}
+
+func TestLocalDeletePrefix(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, key := range []string{"/dir/a", "/dir/b/c", "/dirt", "/other"} {
+		if err := s.Put(ctx, key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	held, err := s.Txn(ctx, []Cmp{Missing("/none")}, []Op{OpDeletePrefix("/dir/"), OpPut("/dir/new", "2")}, nil)
+	if err != nil || !held {
+		t.Fatalf("Txn = %v, %v, want it to hold", held, err)
+	}
+
+	want := map[string]string{"/dir/new": "2", "/dirt": "1", "/other": "1"}
+	if got := testKeys(t, s, "/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys after removing /dir/ = %v, want %v", got, want)
+	}
+
+	children, err := s.Children(ctx, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"new"}; !reflect.DeepEqual(children, want) {
+		t.Errorf("Children of /dir = %v, want %v", children, want)
+	}
+}
+
+func TestLocalPutLease(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	// Nothing in a transaction is written with a lease that isn't there.
+	ctx := context.Background()
+	_, err := s.Txn(ctx, nil, []Op{OpPut("/a", "1"), OpPutLease("/b", "1", 99)}, nil)
+	if err != ErrLeaseNotFound {
+		t.Errorf("Txn with a missing lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if got := testKeys(t, s, "/"); len(got) != 0 {
+		t.Errorf("keys after Txn with a missing lease = %v, want none", got)
+	}
+
+	lease, err := s.Grant(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutLease(ctx, "/a", "1", lease); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "/b", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Revoke(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]string{"/b": "1"}; !reflect.DeepEqual(testKeys(t, s, "/"), want) {
+		t.Errorf("keys after Revoke = %v, want %v", testKeys(t, s, "/"), want)
+	}
+	if err := s.KeepAlive(ctx, lease); err != ErrLeaseNotFound {
+		t.Errorf("KeepAlive of a revoked lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+}
+
+func TestLocalWaitForChange(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := s.Put(ctx, "/watched/a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	_, rev, err := s.GetPrefix(ctx, "/watched/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A change elsewhere doesn't count.
+	if err := s.Put(ctx, "/other", "1"); err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 3*localPollInterval)
+	err = s.WaitForChange(wctx, "/watched/", rev)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("WaitForChange with only changes elsewhere = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// One under the prefix, made while we wait, does.
+	changed := make(chan error, 1)
+	go func() {
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		changed <- s.WaitForChange(wctx, "/watched/", rev)
+	}()
+
+	time.Sleep(2 * localPollInterval)
+	if err := s.Delete(ctx, "/watched/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-changed; err != nil {
+		t.Errorf("WaitForChange with a key removed = %v, want nil", err)
+	}
+
+	// Having missed it, we're told straight away.
+	wctx, cancel = context.WithTimeout(ctx, localPollInterval/2)
+	defer cancel()
+	if err := s.WaitForChange(wctx, "/watched/", rev); err != nil {
+		t.Errorf("WaitForChange after the change = %v, want nil", err)
+	}
+}
+
+func TestLocalWaitForChangeCompacted(t *testing.T) {
+	s, cleanup := testLocalStore(t)
+	defer cleanup()
+
+	// Once the changes after rev have been let go, it can't tell, so it
+	// says there's been one.
+	ctx := context.Background()
+	for i := 0; i <= localMaxChanges; i++ {
+		if err := s.Put(ctx, "/other", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, localPollInterval/2)
+	defer cancel()
+	if err := s.WaitForChange(wctx, "/watched/", 0); err != nil {
+		t.Errorf("WaitForChange from a compacted revision = %v, want nil", err)
+	}
+}
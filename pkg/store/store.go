@@ -0,0 +1,172 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package store is where ratchet keeps the state the plugin and the child
+// processes on each end of a link meet over: in etcd, for clusters, or in a
+// local file, for a single node.
+package store
+
+import (
+	"fmt"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"golang.org/x/net/context"
+)
+
+// BackendEtcd keeps state in etcd, and is the default.
+const BackendEtcd = "etcd"
+
+// BackendLocal keeps state in a file under the netconf's CNIDir, which is
+// only good for links between pods on the same node.
+const BackendLocal = "local"
+
+// Store is a key value store with transactions and watches, which is what
+// ratchet needs to rendezvous and hand out VXLAN ids. Keys are named like
+// paths.
+type Store interface {
+	// Get reads a single key, giving ErrKeyNotFound when it isn't there.
+	Get(ctx context.Context, key string) (*KeyValue, error)
+	// GetPrefix reads all the keys starting with prefix, sorted by key,
+	// along with the revision of the store they were read at.
+	GetPrefix(ctx context.Context, prefix string) ([]KeyValue, int64, error)
+	// Children lists the names of what's directly under dir, in order.
+	Children(ctx context.Context, dir string) ([]string, error)
+	// Put writes a key.
+	Put(ctx context.Context, key string, value string) error
+	// Delete removes a key. Removing a key that isn't there is fine.
+	Delete(ctx context.Context, key string) error
+	// DeletePrefix removes all the keys starting with prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+	// Txn does then when all of cmps hold, and otherwise, all in one go.
+	// It says whether cmps held.
+	Txn(ctx context.Context, cmps []Cmp, then []Op, otherwise []Op) (bool, error)
+	// Create writes key only if it isn't there already, and says whether
+	// it did.
+	Create(ctx context.Context, key string, value string) (bool, error)
+	// WaitForChange waits until any key starting with prefix changes after
+	// revision rev (as GetPrefix gives it), or ctx is done. It may come
+	// back early, so look again either way.
+	WaitForChange(ctx context.Context, prefix string, rev int64) error
+
+	// Grant makes a lease which runs out after ttl seconds, unless kept
+	// alive, taking the keys put with it along.
+	Grant(ctx context.Context, ttl int64) (int64, error)
+	// KeepAlive starts the lease's ttl over, giving ErrLeaseNotFound when
+	// it's already run out.
+	KeepAlive(ctx context.Context, lease int64) error
+	// Revoke ends the lease now, taking its keys with it.
+	Revoke(ctx context.Context, lease int64) error
+	// PutLease writes a key which goes when lease does. A lease of 0 is
+	// no lease, the key stays until it's removed.
+	PutLease(ctx context.Context, key string, value string, lease int64) error
+}
+
+// KeyValue is a key as stored.
+type KeyValue struct {
+	Key            string
+	Value          string
+	CreateRevision int64
+	ModRevision    int64
+}
+
+// ErrKeyNotFound is what Get gives for a key that isn't there.
+var ErrKeyNotFound = fmt.Errorf("key not found")
+
+// IsKeyNotFound says whether err is for a key that isn't there.
+func IsKeyNotFound(err error) bool {
+	return err == ErrKeyNotFound
+}
+
+// ErrLeaseNotFound is what KeepAlive gives for a lease that's run out.
+var ErrLeaseNotFound = fmt.Errorf("lease not found")
+
+type cmpTarget int
+
+const (
+	cmpMissing cmpTarget = iota
+	cmpModRevision
+	cmpValue
+)
+
+// Cmp is a condition on a key, for a transaction.
+type Cmp struct {
+	Key    string
+	target cmpTarget
+	rev    int64
+	value  string
+}
+
+// Missing holds when key isn't there.
+func Missing(key string) Cmp {
+	return Cmp{Key: key, target: cmpMissing}
+}
+
+// ModRevisionIs holds when key was last changed at revision rev, so that
+// nobody's changed it since we read it.
+func ModRevisionIs(key string, rev int64) Cmp {
+	return Cmp{Key: key, target: cmpModRevision, rev: rev}
+}
+
+// ValueIs holds when key holds value.
+func ValueIs(key string, value string) Cmp {
+	return Cmp{Key: key, target: cmpValue, value: value}
+}
+
+type opKind int
+
+const (
+	opPut opKind = iota
+	opDelete
+	opDeletePrefix
+)
+
+// Op is something a transaction does.
+type Op struct {
+	Key   string
+	kind  opKind
+	value string
+	lease int64
+}
+
+// OpPut writes a key.
+func OpPut(key string, value string) Op {
+	return Op{Key: key, kind: opPut, value: value}
+}
+
+// OpPutLease writes a key which goes when lease does.
+func OpPutLease(key string, value string, lease int64) Op {
+	return Op{Key: key, kind: opPut, value: value, lease: lease}
+}
+
+// OpDelete removes a key.
+func OpDelete(key string) Op {
+	return Op{Key: key, kind: opDelete}
+}
+
+// OpDeletePrefix removes all the keys starting with prefix.
+func OpDeletePrefix(prefix string) Op {
+	return Op{Key: prefix, kind: opDeletePrefix}
+}
+
+// New opens the store the netconf's state_backend names.
+func New(netconf *config.NetConf) (Store, error) {
+	switch netconf.StateBackend {
+	case "", BackendEtcd:
+		return newEtcdStore(netconf)
+	case BackendLocal:
+		return newLocalStore(netconf.CNIDir)
+	default:
+		return nil, fmt.Errorf("unknown state_backend %q, use %q or %q", netconf.StateBackend, BackendEtcd, BackendLocal)
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vxlan hands out VXLAN network identifiers (VNIs) to links, from
+// the state store, so that no two live links ever share one.
+package vxlan
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"golang.org/x/net/context"
+)
+
+// CounterKey holds the next VNI to hand out, that's never been used.
+const CounterKey = "/ratchet/vxlanid"
+
+// AllocatedDir holds the keys of each VNI in use, naming the link it belongs
+// to and the pods holding an end of it.
+const AllocatedDir = "/ratchet/vxlan/allocated"
+
+// FreeDir holds a key per VNI that's been used and given back.
+const FreeDir = "/ratchet/vxlan/free"
+
+// BeginningID is the first VNI we hand out, unless configured.
+const BeginningID = 11
+
+// MaxID is the largest VNI there is; they're 24 bits.
+const MaxID = 1<<24 - 1
+
+// maxAllocateTries bounds how often we go around when other allocators keep
+// beating us to the counter.
+const maxAllocateTries = 100
+
+// AllocatedKey is where we record who a VNI belongs to.
+func AllocatedKey(vni int) string {
+	return AllocatedDir + "/" + strconv.Itoa(vni)
+}
+
+// FreeKey is where we keep a VNI that can be used again.
+func FreeKey(vni int) string {
+	return FreeDir + "/" + strconv.Itoa(vni)
+}
+
+// linkKey names the link the VNI belongs to.
+func linkKey(vni int) string {
+	return AllocatedKey(vni) + "/link"
+}
+
+// endsDir holds a key for each pod with an end of the link using the VNI.
+func endsDir(vni int) string {
+	return AllocatedKey(vni) + "/ends"
+}
+
+// versionKey is written each time a pod takes an end of the VNI, so that
+// whoever would give it back can tell nobody's taken one since it looked.
+func versionKey(vni int) string {
+	return AllocatedKey(vni) + "/version"
+}
+
+// heldDir is where a pod lists the VNIs it holds an end of.
+func heldDir(podName string) string {
+	return config.AssociationDir(podName) + "/vxlanids"
+}
+
+// CheckRange makes sure start and end make a range of VNIs.
+func CheckRange(start int, end int) error {
+	if start < 1 || end > MaxID {
+		return fmt.Errorf("vxlan ids go from 1 to %v, not %v to %v", MaxID, start, end)
+	}
+
+	if start > end {
+		return fmt.Errorf("range starts at %v, after its end at %v", start, end)
+	}
+
+	return nil
+}
+
+// Allocator hands out VNIs from a range, using store transactions so that
+// allocators on different nodes can't hand out the same one.
+type Allocator struct {
+	store store.Store
+	start int
+	end   int
+}
+
+// NewAllocator makes an Allocator handing out VNIs from start to end, and
+// keeping its state in s.
+func NewAllocator(s store.Store, start int, end int) *Allocator {
+	return &Allocator{store: s, start: start, end: end}
+}
+
+// Allocate takes a VNI, given back ones first, and records it as belonging
+// to owner (the store dir of the link it's for), with podName holding the
+// first end of it (its own record of that going with lease). The ops with
+// gives for the VNI are written in the same transaction: they should hold
+// podName's association, without which the garbage collector takes the end
+// for a dead pod's, so that it's never without one.
+func (a *Allocator) Allocate(ctx context.Context, owner string, podName string, lease int64, with func(vni int) []store.Op) (int, error) {
+	// VNIs we failed to record, which we don't try again.
+	skip := make(map[int]bool)
+
+	for tries := 0; tries < maxAllocateTries; tries++ {
+
+		vni, freeRev, err := a.reuse(ctx, skip)
+		if err != nil {
+			return 0, err
+		}
+
+		if vni == 0 {
+			vni, err = a.next(ctx)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if vni == 0 {
+			// Someone else moved the counter first, go again.
+			continue
+		}
+
+		// Whichever way we got it, never hand out a VNI that's still
+		// recorded against a link, or that anyone's taken an end of.
+		cmps := []store.Cmp{store.Missing(linkKey(vni)), store.Missing(versionKey(vni))}
+		ops := append([]store.Op{store.OpPut(linkKey(vni), owner)}, holdOps(vni, podName, lease)...)
+
+		// A given back VNI comes off the free list in the same go, so it
+		// stays there unless it's ours, and only one of us gets it.
+		if freeRev != 0 {
+			cmps = append(cmps, store.ModRevisionIs(FreeKey(vni), freeRev))
+			ops = append(ops, store.OpDelete(FreeKey(vni)))
+		}
+
+		ops = append(ops, with(vni)...)
+		recorded, err := a.store.Txn(ctx, cmps, ops, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to record vxlan id %v for %v: %v", vni, owner, err)
+		}
+
+		if recorded {
+			return vni, nil
+		}
+
+		skip[vni] = true
+	}
+
+	return 0, fmt.Errorf("failed to allocate a vxlan id for %v after %v tries", owner, maxAllocateTries)
+}
+
+// reuse gives a given back VNI in our range, but for those in skip, along
+// with the revision of its key on the free list, giving 0 when there's
+// none. It's left on the free list for Allocate to take off.
+func (a *Allocator) reuse(ctx context.Context, skip map[int]bool) (int, int64, error) {
+	kvs, _, err := a.store.GetPrefix(ctx, FreeDir+"/")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read free vxlan ids: %v", err)
+	}
+
+	for _, kv := range kvs {
+		vni, err := strconv.Atoi(path.Base(kv.Key))
+		if err != nil || vni < a.start || vni > a.end || skip[vni] {
+			continue
+		}
+
+		return vni, kv.ModRevision, nil
+	}
+
+	return 0, 0, nil
+}
+
+// next moves the counter on by one, and gives the VNI it held, or 0 when
+// we lost the race for it.
+func (a *Allocator) next(ctx context.Context) (int, error) {
+	kv, err := a.store.Get(ctx, CounterKey)
+	if store.IsKeyNotFound(err) {
+		created, err := a.store.Create(ctx, CounterKey, strconv.Itoa(a.start+1))
+		if err != nil {
+			return 0, fmt.Errorf("failed to start vxlan id counter: %v", err)
+		}
+
+		if !created {
+			return 0, nil
+		}
+
+		return a.start, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read vxlan id counter: %v", err)
+	}
+
+	vni, err := strconv.Atoi(kv.Value)
+	if err != nil {
+		return 0, fmt.Errorf("vxlan id counter %v holds %q, not a number", CounterKey, kv.Value)
+	}
+
+	if vni < a.start {
+		vni = a.start
+	}
+
+	if vni > a.end {
+		return 0, fmt.Errorf("vxlan id range %v-%v is used up, and none have been given back", a.start, a.end)
+	}
+
+	cmps := []store.Cmp{store.ModRevisionIs(CounterKey, kv.ModRevision)}
+	moved, err := a.store.Txn(ctx, cmps, []store.Op{store.OpPut(CounterKey, strconv.Itoa(vni+1))}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move vxlan id counter on: %v", err)
+	}
+
+	if !moved {
+		return 0, nil
+	}
+
+	return vni, nil
+}
+
+// Hold records that podName has an end of the link using vni, so the VNI
+// isn't given back until both ends are gone. The pod's own record of it goes
+// with lease, like the rest of its association. It fails when vni no longer
+// belongs to owner, the store dir of the link, as then the link's other end
+// is gone, and the VNI may be another link's.
+func Hold(ctx context.Context, s store.Store, vni int, owner string, podName string, lease int64) error {
+	link, err := s.Get(ctx, linkKey(vni))
+	if err != nil && !store.IsKeyNotFound(err) {
+		return fmt.Errorf("failed to read vxlan id %v: %v", vni, err)
+	}
+	if err != nil || link.Value != owner {
+		return fmt.Errorf("vxlan id %v no longer belongs to %v", vni, owner)
+	}
+
+	// Nor may it change hands while we take our end.
+	cmps := []store.Cmp{store.ModRevisionIs(link.Key, link.ModRevision)}
+	held, err := s.Txn(ctx, cmps, holdOps(vni, podName, lease), nil)
+	if err != nil {
+		return fmt.Errorf("failed to record vxlan id %v for %v: %v", vni, podName, err)
+	}
+
+	if !held {
+		return fmt.Errorf("vxlan id %v was given back before %v could hold it", vni, podName)
+	}
+
+	return nil
+}
+
+// holdOps record podName's end of vni.
+func holdOps(vni int, podName string, lease int64) []store.Op {
+	return []store.Op{
+		store.OpPutLease(heldDir(podName)+"/"+strconv.Itoa(vni), "", lease),
+		store.OpPut(endsDir(vni)+"/"+podName, ""),
+		store.OpPut(versionKey(vni), podName),
+	}
+}
+
+// Release lets go of podName's end of vni, giving the VNI back when the
+// other end is gone too.
+func Release(ctx context.Context, s store.Store, vni int, podName string) error {
+	if err := s.Delete(ctx, heldDir(podName)+"/"+strconv.Itoa(vni)); err != nil {
+		return fmt.Errorf("failed to release vxlan id %v for %v: %v", vni, podName, err)
+	}
+
+	return release(ctx, s, vni, podName)
+}
+
+// ReleaseAll lets go of every VNI podName holds an end of. Each one whose
+// other end is gone too goes back on the free list.
+func ReleaseAll(ctx context.Context, s store.Store, podName string) error {
+	kvs, _, err := s.GetPrefix(ctx, heldDir(podName)+"/")
+	if err != nil {
+		return fmt.Errorf("failed to read vxlan ids of %v: %v", podName, err)
+	}
+
+	for _, kv := range kvs {
+		vni, err := strconv.Atoi(path.Base(kv.Key))
+		if err != nil {
+			continue
+		}
+
+		if err := release(ctx, s, vni, podName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func release(ctx context.Context, s store.Store, vni int, podName string) error {
+	if err := s.Delete(ctx, endsDir(vni)+"/"+podName); err != nil {
+		return fmt.Errorf("failed to release vxlan id %v for %v: %v", vni, podName, err)
+	}
+
+	_, err := freeUnheld(ctx, s, vni)
+	return err
+}
+
+// freeUnheld puts vni back on the free list when no pod holds an end of it,
+// and says whether it did.
+func freeUnheld(ctx context.Context, s store.Store, vni int) (bool, error) {
+	kvs, _, err := s.GetPrefix(ctx, AllocatedKey(vni)+"/")
+	if err != nil {
+		return false, fmt.Errorf("failed to release vxlan id %v: %v", vni, err)
+	}
+
+	var link, version *store.KeyValue
+	for i := range kvs {
+		switch {
+		case kvs[i].Key == linkKey(vni):
+			link = &kvs[i]
+		case kvs[i].Key == versionKey(vni):
+			version = &kvs[i]
+		case strings.HasPrefix(kvs[i].Key, endsDir(vni)+"/"):
+			// The other end is still up.
+			return false, nil
+		}
+	}
+
+	if link == nil {
+		// The other end beat us to it.
+		return false, nil
+	}
+
+	// Only one of us gets to give it back, and only if nobody's taken an
+	// end of it since we looked.
+	cmps := []store.Cmp{store.ModRevisionIs(link.Key, link.ModRevision), store.Missing(versionKey(vni))}
+	if version != nil {
+		cmps[1] = store.ModRevisionIs(version.Key, version.ModRevision)
+	}
+	ops := []store.Op{store.OpDeletePrefix(AllocatedKey(vni) + "/"), store.OpPut(FreeKey(vni), "")}
+	freed, err := s.Txn(ctx, cmps, ops, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to give vxlan id %v back: %v", vni, err)
+	}
+
+	return freed, nil
+}
+
+// Collected is what Collect let go of.
+type Collected struct {
+	// Ends are the ends of links dead pods still held, as vni/pod.
+	Ends []string
+	// Freed are the VNIs given back.
+	Freed []int
+}
+
+// Collect lets go of the ends of links held by pods alive says are gone,
+// giving back each VNI left without any.
+func Collect(ctx context.Context, s store.Store, alive func(podName string) (bool, error)) (Collected, error) {
+	collected := Collected{}
+
+	vnis, err := s.Children(ctx, AllocatedDir)
+	if err != nil {
+		return collected, fmt.Errorf("failed to list vxlan ids in use: %v", err)
+	}
+
+	for _, child := range vnis {
+		vni, err := strconv.Atoi(child)
+		if err != nil {
+			continue
+		}
+
+		ends, _, err := s.GetPrefix(ctx, endsDir(vni)+"/")
+		if err != nil {
+			return collected, fmt.Errorf("failed to read ends of vxlan id %v: %v", vni, err)
+		}
+
+		for _, end := range ends {
+			podName := strings.TrimPrefix(end.Key, endsDir(vni)+"/")
+			ok, err := alive(podName)
+			if err != nil {
+				return collected, err
+			}
+			if ok {
+				continue
+			}
+
+			if err := s.Delete(ctx, end.Key); err != nil {
+				return collected, fmt.Errorf("failed to release vxlan id %v for %v: %v", vni, podName, err)
+			}
+			collected.Ends = append(collected.Ends, child+"/"+podName)
+		}
+
+		freed, err := freeUnheld(ctx, s, vni)
+		if err != nil {
+			return collected, err
+		}
+		if freed {
+			collected.Freed = append(collected.Freed, vni)
+		}
+	}
+
+	return collected, nil
+}
@@ -0,0 +1,433 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"golang.org/x/net/context"
+)
+
+// localStore gives a local store in a dir of its own, and a func to clean
+// it up.
+func localStore(t *testing.T) (store.Store, func()) {
+	dir, err := ioutil.TempDir("", "ratchet-vxlan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.New(&config.NetConf{StateBackend: store.BackendLocal, CNIDir: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func noOps(vni int) []store.Op {
+	return nil
+}
+
+// allocate takes a VNI for the link owner, with podName holding its first
+// end.
+func allocate(t *testing.T, a *Allocator, owner string, podName string) int {
+	vni, err := a.Allocate(context.Background(), owner, podName, 0, noOps)
+	if err != nil {
+		t.Fatalf("Allocate for %v: %v", owner, err)
+	}
+
+	return vni
+}
+
+// isFree says whether vni is on the free list.
+func isFree(t *testing.T, s store.Store, vni int) bool {
+	_, err := s.Get(context.Background(), FreeKey(vni))
+	if err != nil && !store.IsKeyNotFound(err) {
+		t.Fatal(err)
+	}
+
+	return err == nil
+}
+
+func TestCheckRange(t *testing.T) {
+	tests := []struct {
+		start, end int
+		wantErr    bool
+	}{
+		{BeginningID, MaxID, false},
+		{1, 1, false},
+		{0, 10, true},
+		{1, MaxID + 1, true},
+		{20, 10, true},
+	}
+
+	for _, tt := range tests {
+		if err := CheckRange(tt.start, tt.end); (err != nil) != tt.wantErr {
+			t.Errorf("CheckRange(%v, %v) = %v, want an error: %v", tt.start, tt.end, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	s, cleanup := localStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	a := NewAllocator(s, 100, 102)
+
+	for _, want := range []int{100, 101, 102} {
+		if vni := allocate(t, a, "link"+strconv.Itoa(want), "default/pod-a"); vni != want {
+			t.Errorf("Allocate gave %v, want %v", vni, want)
+		}
+	}
+
+	_, err := a.Allocate(ctx, "linkd", "default/pod-a", 0, noOps)
+	if err == nil || !strings.Contains(err.Error(), "is used up") {
+		t.Fatalf("Allocate from a used up range = %v, want it to say so", err)
+	}
+
+	if err := Release(ctx, s, 101, "default/pod-a"); err != nil {
+		t.Fatal(err)
+	}
+	if !isFree(t, s, 101) {
+		t.Fatalf("vxlan id 101 isn't free once its only end let go of it")
+	}
+
+	if vni := allocate(t, a, "linkd", "default/pod-b"); vni != 101 {
+		t.Errorf("Allocate gave %v, want the given back 101", vni)
+	}
+	if isFree(t, s, 101) {
+		t.Errorf("vxlan id 101 is still free once it's been taken again")
+	}
+
+	link, err := s.Get(ctx, linkKey(101))
+	if err != nil || link.Value != "linkd" {
+		t.Errorf("vxlan id 101 belongs to %v (%v), want linkd", link, err)
+	}
+}
+
+func TestAllocateSkipsHeld(t *testing.T) {
+	s, cleanup := localStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	a := NewAllocator(s, 100, 200)
+
+	// A free VNI that's still recorded against a link mustn't be handed
+	// out again, nor may the counter hand out one in use.
+	if err := s.Put(ctx, FreeKey(150), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, linkKey(150), "linkz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, versionKey(100), "default/pod-z"); err != nil {
+		t.Fatal(err)
+	}
+
+	if vni := allocate(t, a, "linka", "default/pod-a"); vni != 101 {
+		t.Errorf("Allocate gave %v, want 101", vni)
+	}
+}
+
+func TestAllocateKeepsFree(t *testing.T) {
+	s, cleanup := localStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	a := NewAllocator(s, 100, 200)
+
+	// Should recording a given back VNI fail, it stays on the free list:
+	// here, as someone's taken an end of it since it was given back.
+	if err := s.Put(ctx, FreeKey(150), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, versionKey(150), "default/pod-z"); err != nil {
+		t.Fatal(err)
+	}
+
+	if vni := allocate(t, a, "linka", "default/pod-a"); vni != 100 {
+		t.Errorf("Allocate gave %v, want 100", vni)
+	}
+	if !isFree(t, s, 150) {
+		t.Errorf("vxlan id 150 was taken off the free list, though Allocate couldn't record it")
+	}
+
+	// Nor is it taken off when the transaction recording it fails.
+	if err := s.Delete(ctx, versionKey(150)); err != nil {
+		t.Fatal(err)
+	}
+	with := func(vni int) []store.Op {
+		return []store.Op{store.OpPutLease("/ratchet/test/vxlanid", strconv.Itoa(vni), 99)}
+	}
+	if _, err := a.Allocate(ctx, "linkb", "default/pod-b", 0, with); err == nil {
+		t.Fatalf("Allocate with a lease that isn't there succeeded, want it to fail")
+	}
+	if !isFree(t, s, 150) {
+		t.Errorf("vxlan id 150 was taken off the free list, though Allocate failed")
+	}
+
+	if vni := allocate(t, a, "linkb", "default/pod-b"); vni != 150 {
+		t.Errorf("Allocate gave %v, want the given back 150", vni)
+	}
+	if isFree(t, s, 150) {
+		t.Errorf("vxlan id 150 is still free once it's been taken again")
+	}
+}
+
+func TestAllocateBadCounter(t *testing.T) {
+	s, cleanup := localStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := s.Put(ctx, CounterKey, "eleven"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewAllocator(s, BeginningID, MaxID).Allocate(ctx, "linka", "default/pod-a", 0, noOps)
+	if err == nil || !strings.Contains(err.Error(), "not a number") {
+		t.Errorf("Allocate with a bad counter = %v, want it to say so", err)
+	}
+}
+
+func TestAllocateWith(t *testing.T) {
+	s, cleanup := localStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	a := NewAllocator(s, BeginningID, MaxID)
+
+	with := func(vni int) []store.Op {
+		return []store.Op{store.OpPut("/ratchet/test/vxlanid", strconv.Itoa(vni))}
+	}
+	vni, err := a.Allocate(ctx, "linka", "default/pod-a", 0, with)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := s.Get(ctx, "/ratchet/test/vxlanid")
+	if err != nil || kv.Value != strconv.Itoa(vni) {
+		t.Errorf("Allocate of %v wrote %v (%v), want the ops it was given", vni, kv, err)
+	}
+
+	held, err := s.Children(ctx, heldDir("default/pod-a"))
+	if err != nil || !reflect.DeepEqual(held, []string{"11"}) {
+		t.Errorf("default/pod-a holds %v (%v), want [11]", held, err)
+	}
+}
+
+func TestHold(t *testing.T) {
+	tests := []struct {
+		name    string
+		owner   string
+		release bool
+		wantErr string
+	}{
+		{name: "owner", owner: "linka"},
+		{name: "another link", owner: "linkb", wantErr: "no longer belongs to linkb"},
+		{name: "given back", owner: "linka", release: true, wantErr: "no longer belongs to linka"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cleanup := localStore(t)
+			defer cleanup()
+			ctx := context.Background()
+
+			vni := allocate(t, NewAllocator(s, BeginningID, MaxID), "linka", "default/pod-a")
+			if tt.release {
+				if err := Release(ctx, s, vni, "default/pod-a"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := Hold(ctx, s, vni, tt.owner, "default/pod-b", 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Hold error = %v, want one saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Hold: %v", err)
+			}
+
+			if _, err := s.Get(ctx, endsDir(vni)+"/default/pod-b"); err != nil {
+				t.Errorf("default/pod-b's end of vxlan id %v isn't recorded: %v", vni, err)
+			}
+		})
+	}
+}
+
+func TestRelease(t *testing.T) {
+	s, cleanup := localStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	a := NewAllocator(s, BeginningID, MaxID)
+
+	vni := allocate(t, a, "linka", "default/pod-a")
+	if err := Hold(ctx, s, vni, "linka", "default/pod-b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Release(ctx, s, vni, "default/pod-a"); err != nil {
+		t.Fatal(err)
+	}
+	if isFree(t, s, vni) {
+		t.Fatalf("vxlan id %v is free while default/pod-b still holds an end of it", vni)
+	}
+
+	if err := ReleaseAll(ctx, s, "default/pod-b"); err != nil {
+		t.Fatal(err)
+	}
+	if !isFree(t, s, vni) {
+		t.Fatalf("vxlan id %v isn't free once both ends let go of it", vni)
+	}
+
+	kvs, _, err := s.GetPrefix(ctx, AllocatedKey(vni)+"/")
+	if err != nil || len(kvs) != 0 {
+		t.Errorf("vxlan id %v is still recorded as %v (%v)", vni, kvs, err)
+	}
+
+	// Letting go again, as a DEL that's retried does, changes nothing.
+	if err := Release(ctx, s, vni, "default/pod-b"); err != nil {
+		t.Errorf("Release of a given back vxlan id: %v", err)
+	}
+	if !isFree(t, s, vni) {
+		t.Errorf("vxlan id %v isn't free after it was released twice", vni)
+	}
+}
+
+func TestReleaseAll(t *testing.T) {
+	s, cleanup := localStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	a := NewAllocator(s, BeginningID, MaxID)
+
+	// pod-a and pod-b share one link, pod-a and pod-c another.
+	ab := allocate(t, a, "linkab", "default/pod-a")
+	ac := allocate(t, a, "linkac", "default/pod-a")
+	holds := []struct {
+		vni        int
+		owner, pod string
+	}{{ab, "linkab", "default/pod-b"}, {ac, "linkac", "default/pod-c"}}
+	for _, hold := range holds {
+		if err := Hold(ctx, s, hold.vni, hold.owner, hold.pod, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ReleaseAll(ctx, s, "default/pod-a"); err != nil {
+		t.Fatal(err)
+	}
+	if isFree(t, s, ab) || isFree(t, s, ac) {
+		t.Fatalf("vxlan ids were given back while their far ends still hold them")
+	}
+
+	if err := ReleaseAll(ctx, s, "default/pod-b"); err != nil {
+		t.Fatal(err)
+	}
+	if !isFree(t, s, ab) {
+		t.Errorf("vxlan id %v isn't free once both ends let go of it", ab)
+	}
+	if isFree(t, s, ac) {
+		t.Errorf("vxlan id %v is free while default/pod-c still holds it", ac)
+	}
+	if kvs, _, err := s.GetPrefix(ctx, AllocatedKey(ab)+"/"); err != nil || len(kvs) > 0 {
+		t.Errorf("vxlan id %v is still recorded as %v (%v)", ab, kvs, err)
+	}
+
+	// A pod that holds nothing has nothing to let go of.
+	if err := ReleaseAll(ctx, s, "default/pod-z"); err != nil {
+		t.Errorf("ReleaseAll of a pod holding nothing: %v", err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	tests := []struct {
+		name      string
+		dead      []string
+		wantEnds  []string
+		wantFreed []int
+	}{
+		{name: "all alive"},
+		{
+			name:     "one end dead",
+			dead:     []string{"default/pod-a"},
+			wantEnds: []string{"11/default/pod-a"},
+		},
+		{
+			name:      "both ends of one link dead",
+			dead:      []string{"default/pod-a", "default/pod-b"},
+			wantEnds:  []string{"11/default/pod-a", "11/default/pod-b", "12/default/pod-b"},
+			wantFreed: []int{11},
+		},
+		{
+			name:      "all dead",
+			dead:      []string{"default/pod-a", "default/pod-b", "lab/pod-c"},
+			wantEnds:  []string{"11/default/pod-a", "11/default/pod-b", "12/default/pod-b", "12/lab/pod-c"},
+			wantFreed: []int{11, 12},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cleanup := localStore(t)
+			defer cleanup()
+			ctx := context.Background()
+			a := NewAllocator(s, BeginningID, MaxID)
+
+			// pod-a and pod-b share link 11, pod-b and pod-c link 12.
+			vni := allocate(t, a, "linka", "default/pod-a")
+			if err := Hold(ctx, s, vni, "linka", "default/pod-b", 0); err != nil {
+				t.Fatal(err)
+			}
+			vni = allocate(t, a, "linkb", "default/pod-b")
+			if err := Hold(ctx, s, vni, "linkb", "lab/pod-c", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			alive := func(podName string) (bool, error) {
+				for _, dead := range tt.dead {
+					if podName == dead {
+						return false, nil
+					}
+				}
+				return true, nil
+			}
+
+			collected, err := Collect(ctx, s, alive)
+			if err != nil {
+				t.Fatalf("Collect: %v", err)
+			}
+
+			if !reflect.DeepEqual(collected.Ends, tt.wantEnds) {
+				t.Errorf("Collect released ends %v, want %v", collected.Ends, tt.wantEnds)
+			}
+			if !reflect.DeepEqual(collected.Freed, tt.wantFreed) {
+				t.Errorf("Collect freed %v, want %v", collected.Freed, tt.wantFreed)
+			}
+			for _, vni := range tt.wantFreed {
+				if !isFree(t, s, vni) {
+					t.Errorf("vxlan id %v isn't on the free list", vni)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"golang.org/x/net/context"
+)
+
+// leaseLockName is the file, under the CNIDir, locked by whichever
+// ratchet-child on the node keeps the node's lease alive, so there's only
+// ever the one.
+const leaseLockName = "ratchet-lease.lock"
+
+// keepNodeLease keeps the node's lease alive, for as long as the node has
+// pods in the store, unless another ratchet-child on the node already does.
+// It returns once done is closed (our links are built), and either another
+// ratchet-child keeps the lease, or the node has no pods left.
+func keepNodeLease(netconf *config.NetConf, done <-chan struct{}) {
+
+	if netconf.LeaseTTLSeconds <= 0 {
+		return
+	}
+
+	// Well within the lease's ttl, so a slow store doesn't cost it.
+	interval := time.Duration(netconf.LeaseTTLSeconds) * time.Second / 3
+	lockPath := filepath.Join(netconf.CNIDir, leaseLockName)
+
+	var lock *os.File
+	var keys map[string][]store.KeyValue
+	lease := stateLease
+	finished := false
+	for {
+		if lock == nil {
+			lock = tryLock(lockPath)
+		}
+
+		if finished && lock == nil {
+			// Another ratchet-child keeps it, and sees our pod.
+			return
+		}
+
+		// Before looking for pods, as the keys of those the node has left
+		// are put back when the lease has run out.
+		if lock != nil {
+			lease, keys = renewNodeLease(netconf, lease, keys)
+		}
+
+		if finished {
+			if !nodeHasPods() {
+				lock.Close()
+				lock = nil
+
+				// A pod that came up on the node as we let go may have
+				// tried the lock before we did, so look again.
+				if !nodeHasPods() {
+					logger.Infof("no pods left on node %v, no longer keeping its lease", nodeName)
+					return
+				}
+				continue
+			}
+		}
+
+		select {
+		case <-done:
+			finished = true
+			done = nil
+		case <-time.After(interval):
+		}
+	}
+
+}
+
+// renewNodeLease keeps the node's lease alive, giving the lease the node's
+// keys go with from now on, and what they are. When the lease has run out,
+// taking the keys with it, it puts back keys as they were when we last saw
+// them, with the new lease.
+func renewNodeLease(netconf *config.NetConf, lease int64, keys map[string][]store.KeyValue) (int64, map[string][]store.KeyValue) {
+
+	kept, err := store.NodeLease(context.Background(), stateStore, nodeName, int64(netconf.LeaseTTLSeconds))
+	if err != nil {
+		logger.Errorf("LEASE ERROR: %v", err)
+		return lease, keys
+	}
+
+	if kept != lease {
+		logger.Errorf("LEASE ERROR: lease of node %v ran out, and its keys went with it, putting them back", nodeName)
+		republish(netconf, keys, kept)
+	}
+
+	current, err := nodeKeys()
+	if err != nil {
+		logger.Errorf("LEASE ERROR: %v", err)
+		return kept, keys
+	}
+
+	return kept, current
+
+}
+
+// republish puts back the keys of each pod, given by nodeKeys, with lease.
+// Only pods ratchet still has state for come back, as the rest have had
+// their DEL since. Nor does a pod whose association is back already, as
+// it's been set up again in the meantime.
+func republish(netconf *config.NetConf, keys map[string][]store.KeyValue, lease int64) {
+
+	for pod, kvs := range keys {
+		idKey := config.AssociationDir(pod) + "/id"
+
+		var ops []store.Op
+		id := ""
+		for _, kv := range kvs {
+			ops = append(ops, store.OpPutLease(kv.Key, kv.Value, lease))
+			if kv.Key == idKey {
+				id = kv.Value
+			}
+		}
+
+		if id == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(netconf.CNIDir, id)); err != nil {
+			logger.Infof("pod %v is gone, not putting its keys back", pod)
+			continue
+		}
+
+		put, err := stateStore.Txn(context.Background(), []store.Cmp{store.Missing(idKey)}, ops, nil)
+		if err != nil {
+			logger.Errorf("LEASE ERROR: failed to put back keys of pod %v: %v", pod, err)
+		} else if put {
+			logger.Infof("put back %v keys of pod %v", len(ops), pod)
+		}
+	}
+
+}
+
+// tryLock takes the lock at path, giving nil when another process has it.
+func tryLock(path string) *os.File {
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		logger.Errorf("LEASE ERROR: failed to open %v: %v", path, err)
+		return nil
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil
+	}
+
+	return f
+
+}
+
+// nodeHasPods says whether any pod's association is on our node. When we
+// can't tell, it says there are, so we go on keeping the lease.
+func nodeHasPods() bool {
+
+	keys, err := nodeKeys()
+	if err != nil {
+		logger.Errorf("LEASE ERROR: %v", err)
+		return true
+	}
+
+	return len(keys) > 0
+
+}
+
+// nodeKeys gives the keys which go with our node's lease, by the pod on our
+// node they're of: its association, but for the links its primaries told it
+// about, and the links it's the primary of, which are under its pair's.
+func nodeKeys() (map[string][]store.KeyValue, error) {
+
+	root := config.AssociationDir("")
+	kvs, _, err := stateStore.GetPrefix(context.Background(), root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list associations: %v", err)
+	}
+
+	// Associations are namespace/name/node, and links are
+	// namespace/name/links/id/primaryname.
+	ours := make(map[string]bool)
+	primaries := make(map[string]string)
+	for _, kv := range kvs {
+		parts := strings.Split(strings.TrimPrefix(kv.Key, root), "/")
+		if len(parts) == 3 && parts[2] == "node" && kv.Value == nodeName {
+			ours[parts[0]+"/"+parts[1]] = true
+		}
+		if len(parts) == 5 && parts[2] == "links" && parts[4] == "primaryname" {
+			primaries[path.Dir(kv.Key)] = kv.Value
+		}
+	}
+
+	keys := make(map[string][]store.KeyValue)
+	for _, kv := range kvs {
+		parts := strings.SplitN(strings.TrimPrefix(kv.Key, root), "/", 5)
+		if len(parts) < 3 {
+			continue
+		}
+
+		pod := parts[0] + "/" + parts[1]
+		if parts[2] == "links" {
+			if len(parts) < 5 {
+				continue
+			}
+			pod = primaries[root+strings.Join(parts[:4], "/")]
+		}
+
+		if ours[pod] {
+			keys[pod] = append(keys[pod], kv)
+		}
+	}
+
+	return keys, nil
+
+}
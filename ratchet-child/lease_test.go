@@ -0,0 +1,215 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"golang.org/x/net/context"
+)
+
+// useLocalStore points stateStore at a local store in a dir of its own,
+// with us on node1, and gives the netconf and a func to clean it all up.
+func useLocalStore(t *testing.T, ttl int) (*config.NetConf, func()) {
+	dir, err := ioutil.TempDir("", "ratchet-child")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	netconf := &config.NetConf{StateBackend: store.BackendLocal, CNIDir: dir, LeaseTTLSeconds: ttl}
+	s, err := store.New(netconf)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	stateStore, nodeName, stateLease = s, "node1", 0
+	return netconf, func() {
+		stateStore, nodeName, stateLease = nil, "", 0
+		os.RemoveAll(dir)
+	}
+}
+
+// putKeys writes each key to value, with lease.
+func putKeys(t *testing.T, keys map[string]string, lease int64) {
+	for key, value := range keys {
+		if err := stateStore.PutLease(context.Background(), key, value, lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// keyNames gives the names of kvs, in order.
+func keyNames(kvs []store.KeyValue) []string {
+	var names []string
+	for _, kv := range kvs {
+		names = append(names, kv.Key)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// waitForKey says whether key holds value within timeout.
+func waitForKey(key string, value string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		kv, err := stateStore.Get(context.Background(), key)
+		if err == nil && kv.Value == value {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestNodeKeys(t *testing.T) {
+	_, cleanup := useLocalStore(t, 0)
+	defer cleanup()
+
+	// default/a is ours, and primary of its link to default/b, which is
+	// on node2 and primary of its link to default/c, on our node too.
+	a, b, c := config.AssociationDir("default/a"), config.AssociationDir("default/b"), config.AssociationDir("default/c")
+	ab := config.LinkDir("default/b", "default/a", "")
+	bc := config.LinkDir("default/c", "default/b", "")
+	putKeys(t, map[string]string{
+		a + "/node":                 "node1",
+		a + "/id":                   "ida",
+		a + "/peers/default.b/role": "primary",
+		a + "/vxlanids/11":          "",
+		ab + "/vxlanid":             "11",
+		ab + "/primaryname":         "default/a",
+		b + "/node":                 "node2",
+		b + "/id":                   "idb",
+		bc + "/vxlanid":             "12",
+		bc + "/primaryname":         "default/b",
+		c + "/node":                 "node1",
+	}, 0)
+
+	keys, err := nodeKeys()
+	if err != nil {
+		t.Fatalf("nodeKeys: %v", err)
+	}
+
+	got := make(map[string][]string)
+	for pod, kvs := range keys {
+		got[pod] = keyNames(kvs)
+	}
+
+	want := map[string][]string{
+		"default/a": {a + "/id", a + "/node", a + "/peers/default.b/role", a + "/vxlanids/11", ab + "/primaryname", ab + "/vxlanid"},
+		"default/c": {c + "/node"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nodeKeys = %v, want %v", got, want)
+	}
+
+	if !nodeHasPods() {
+		t.Errorf("nodeHasPods = false, want true")
+	}
+
+	nodeName = "node3"
+	if nodeHasPods() {
+		t.Errorf("nodeHasPods on a node without pods = true, want false")
+	}
+}
+
+func TestKeepNodeLease(t *testing.T) {
+	// The local store's leases run out on the second, so with less than
+	// a few seconds, it may run out between keeping it alive.
+	netconf, cleanup := useLocalStore(t, 3)
+	defer cleanup()
+
+	ctx := context.Background()
+	lease, err := store.NodeLease(ctx, stateStore, nodeName, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateLease = lease
+
+	// default/a still has its state, default/gone has had its DEL.
+	a, gone := config.AssociationDir("default/a"), config.AssociationDir("default/gone")
+	link := config.LinkDir("default/b", "default/a", "")
+	putKeys(t, map[string]string{
+		a + "/node":           "node1",
+		a + "/id":             "ida",
+		link + "/vxlanid":     "11",
+		link + "/primaryname": "default/a",
+		gone + "/node":        "node1",
+		gone + "/id":          "idgone",
+	}, lease)
+	if err := ioutil.WriteFile(filepath.Join(netconf.CNIDir, "ida"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		keepNodeLease(netconf, done)
+	}()
+	close(done)
+
+	// It keeps the lease alive past its ttl.
+	time.Sleep(3500 * time.Millisecond)
+	if _, err := stateStore.Get(ctx, a+"/id"); err != nil {
+		t.Fatalf("association after the lease's ttl: %v, want it kept", err)
+	}
+
+	// Once it's run out, what's left of the node's pods comes back.
+	if err := stateStore.Revoke(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitForKey(link+"/vxlanid", "11", 5*time.Second) {
+		t.Fatalf("link record after the lease ran out is gone, want it put back")
+	}
+
+	if _, err := stateStore.Get(ctx, a+"/id"); err != nil {
+		t.Errorf("association after the lease ran out: %v, want it put back", err)
+	}
+	if _, err := stateStore.Get(ctx, gone+"/id"); !store.IsKeyNotFound(err) {
+		t.Errorf("association of a pod without state after the lease ran out: %v, want it left gone", err)
+	}
+
+	kv, err := stateStore.Get(ctx, store.NodeLeaseKey(nodeName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv.Value == strconv.FormatInt(lease, 10) {
+		t.Errorf("node lease = %v, want a new one", kv.Value)
+	}
+
+	// And it lets go once the node has no pods left.
+	if err := stateStore.DeletePrefix(ctx, config.AssociationDir("")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Errorf("keepNodeLease still going with no pods left")
+	}
+}
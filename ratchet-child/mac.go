@@ -0,0 +1,87 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/vishvananda/netlink"
+)
+
+// localMAC is the MAC of our end of the link.
+func localMAC(linki config.LinkInfo) (net.HardwareAddr, error) {
+
+	return config.LinkMAC(linki.LocalMAC, linki.PodKey(), linki.LocalIFName)
+
+}
+
+// pairMAC is the MAC of the pair's end of a link we build: the one we were
+// given, else the one the pair asked for, else the pair's derived MAC.
+func pairMAC(linki config.LinkInfo) (net.HardwareAddr, error) {
+
+	mac := linki.PairMAC
+	if mac == "" && linki.PairName != "" {
+		if peer, err := peerInfo(linki); err == nil {
+			mac = peer["localmac"]
+		}
+	}
+
+	return config.LinkMAC(mac, linki.PairKey(), linki.PairIFName)
+
+}
+
+// setLinkMAC sets the MAC of the interface in netns, taking it down while
+// it does, as not every driver will change it on a live interface.
+func setLinkMAC(netns string, ifname string, mac net.HardwareAddr) error {
+
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return err
+		}
+
+		if err := netlink.LinkSetDown(link); err != nil {
+			return err
+		}
+
+		if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return err
+		}
+
+		return netlink.LinkSetUp(link)
+	})
+	if err != nil {
+		logger.Errorf("MAC ERROR: %v", err)
+		return fmt.Errorf("failed to set the MAC of %v to %v: %v", ifname, mac, err)
+	}
+
+	logger.Infof("set the MAC of %v to %v", ifname, mac)
+	return nil
+
+}
+
+// setLinkEnd sets the MTU (unless it's 0) and the MAC of an end of a link.
+func setLinkEnd(netns string, ifname string, mtu int, mac net.HardwareAddr) error {
+
+	if err := setLinkMTU(netns, ifname, mtu); err != nil {
+		return err
+	}
+
+	return setLinkMAC(netns, ifname, mac)
+
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	koko "github.com/redhat-nfvpe/koko/api"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+)
+
+// mirrorPollInterval is how often we look for the interface a mirror link
+// mirrors, which may be another of our links still being built.
+const mirrorPollInterval = 100 * time.Millisecond
+
+// waitForMirrored waits until the interface the mirror link mirrors is in
+// our netns, or ctx is done.
+func waitForMirrored(ctx context.Context, netns string, linki config.LinkInfo) error {
+
+	for {
+
+		found := false
+		err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+			_, err := netlink.LinkByName(linki.MirrorIFName)
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			found = err == nil
+			return err
+		})
+		if err != nil || found {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Timeout: interface %v to mirror to %v never showed up: %v", linki.MirrorIFName, linki.PairKey(), ctx.Err())
+		case <-time.After(mirrorPollInterval):
+		}
+
+	}
+
+}
+
+// setMirror has tc copy the mirrored interface's traffic to our end of the
+// mirror link, now that it's built. It does nothing for other links.
+func setMirror(netns string, linki config.LinkInfo) error {
+
+	if linki.LinkType() != config.LinkTypeMirror {
+		return nil
+	}
+
+	mirror := koko.VEth{}
+	mirror.NsName = netns
+	mirror.LinkName = linki.LocalIFName
+	if linki.MirrorsIngress() {
+		mirror.MirrorIngress = linki.MirrorIFName
+	}
+	if linki.MirrorsEgress() {
+		mirror.MirrorEgress = linki.MirrorIFName
+	}
+
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		if mirror.MirrorIngress != "" {
+			if err := mirror.SetIngressMirror(); err != nil {
+				return fmt.Errorf("failed to mirror ingress of %v to %v: %v", linki.MirrorIFName, linki.LocalIFName, err)
+			}
+		}
+
+		if mirror.MirrorEgress != "" {
+			if err := mirror.SetEgressMirror(); err != nil {
+				return fmt.Errorf("failed to mirror egress of %v to %v: %v", linki.MirrorIFName, linki.LocalIFName, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("MIRROR ERROR: %v", err)
+		return err
+	}
+
+	logger.Infof("mirroring %v of %v to %v", linki.MirrorDirection(), linki.MirrorIFName, linki.PairKey())
+	return nil
+
+}
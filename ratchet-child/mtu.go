@@ -0,0 +1,66 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/vishvananda/netlink"
+)
+
+// parentVxlanMTU is the largest MTU a vxlan over our parent interface can
+// have, or 0 when we can't tell.
+func parentVxlanMTU(linki config.LinkInfo) int {
+
+	if linki.ParentIface == "" {
+		return 0
+	}
+
+	parent, err := netlink.LinkByName(linki.ParentIface)
+	if err != nil {
+		logger.Errorf("failed to read the MTU of parent interface %v: %v", linki.ParentIface, err)
+		return 0
+	}
+
+	return config.VxlanMTU(parent.Attrs().MTU, linki.ParentAddr)
+
+}
+
+// setLinkMTU sets the MTU of the interface in netns, unless mtu is 0.
+func setLinkMTU(netns string, ifname string, mtu int) error {
+
+	if mtu == 0 {
+		return nil
+	}
+
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return err
+		}
+
+		return netlink.LinkSetMTU(link, mtu)
+	})
+	if err != nil {
+		logger.Errorf("MTU ERROR: %v", err)
+		return fmt.Errorf("failed to set the MTU of %v to %v: %v", ifname, mtu, err)
+	}
+
+	logger.Infof("set the MTU of %v to %v", ifname, mtu)
+	return nil
+
+}
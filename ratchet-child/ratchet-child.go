@@ -22,14 +22,14 @@ package main
 import (
 	// "encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"time"
 	// "io/ioutil"
 	// "reflect"
 	"os"
-	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
 	// "path/filepath"
 
 	// "github.com/containernetworking/cni/pkg/invoke"
@@ -39,291 +39,206 @@ import (
 
 	// dockerclient "github.com/docker/docker/client"
 	// "github.com/davecgh/go-spew/spew"
-	"github.com/coreos/etcd/client"
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/logging"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"github.com/dougbtv/ratchet-cni/pkg/vxlan"
 	koko "github.com/redhat-nfvpe/koko/api"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 )
 
-const aliveWaitSeconds = 1
-const aliveWaitRetries = 60
-const delayKokoSeconds = 1
 const defaultCNIDir = "/var/lib/cni/multus"
-const debug = true
-const beginningVxlanID = 11
 
-var kapi client.KeysAPI
+var stateStore store.Store
 
-var masterpluginEnabled bool
+// stateLease is the lease our node's keys go with (0 for none), and
+// nodeName the node.
+var stateLease int64
+var nodeName string
 
-// LinkInfo is a detail of the link we're going to create.
-type LinkInfo struct {
-	PodName         string
-	TargetPod       string
-	TargetContainer string
-	PublicIP        string
-	LocalIP         string
-	LocalIFName     string
-	PairName        string
-	PairIP          string
-	PairIFName      string
-	Primary         string
-	ParentIface     string
-	ParentAddr      string
-}
+// logger goes to stderr until we've read our config from the handoff.
+var logger = logging.Default("ratchet-child")
 
-func isContainerAlive(containername string) bool {
-	isalive := false
+var masterpluginEnabled bool
 
-	targetKey := "/ratchet/byname/" + containername
-	_, err := kapi.Get(context.Background(), targetKey, nil)
-	if err != nil {
+// associateEtcdInfo writes our association, and (when we're primary) what
+// the pair needs to know about the link, all in one transaction, so nobody
+// ever reads half of it. Should the write fail, nothing's left behind.
+func associateEtcdInfo(vniRange *config.VxlanIDRange, containerid string, netns string, linki config.LinkInfo) (int, error) {
 
-		// ErrorCodeKeyNotFound = Key not found, that's exactly the one we know is good.
-		// So let's log when it's not that.
-		// Passing along on this.
-		/*
-			 if (err != client.ErrorCodeKeyNotFound) {
-				 logger.Println(fmt.Errorf("isContainerAlive - possible missing value %s: %v", targetKey, err))
-			 }
-		*/
+	assocdir := config.AssociationDir(linki.PodKey())
 
-	} else {
-		// no error? must be there.
-		isalive = true
+	// Publish our netns, so our primary can find it without asking a
+	// runtime, our node, so its garbage collector knows the pod is its to
+	// check, and associate the containerid to the name.
+	ops := []store.Op{
+		store.OpPutLease(assocdir+"/netns", netns, stateLease),
+		store.OpPutLease(assocdir+"/node", nodeName, stateLease),
+		store.OpPutLease(assocdir+"/id", containerid, stateLease),
+		store.OpPutLease(assocdir+"/parentiface", linki.ParentIface, stateLease),
+		store.OpPutLease(assocdir+"/parentaddr", linki.ParentAddr, stateLease),
+		store.OpPutLease(assocdir+"/vxlanmtu", strconv.Itoa(parentVxlanMTU(linki)), stateLease),
 	}
 
-	return isalive
-
-}
-
-func amIAlive(containerid string) bool {
-	isalive := false
-
-	targetKey := "/ratchet/" + containerid + "/pod_name"
-	_, err := kapi.Get(context.Background(), targetKey, nil)
-	if err != nil {
-
-		// ErrorCodeKeyNotFound = Key not found, that's exactly the one we know is good.
-		// So let's log when it's not that.
-		// Passing along on this.
-		/*
-			 if (err != client.ErrorCodeKeyNotFound) {
-				 logger.Println(fmt.Errorf("isContainerAlive - possible missing value %s: %v", targetKey, err))
-			 }
-		*/
+	// Tell the peer we name which role we take, so it can tell whether we
+	// agree on who builds the link, and about our end, in case it's the one
+	// to build it.
+	if linki.PairName != "" {
+		peerdir := config.PeerDir(linki.PodKey(), linki.PairKey(), linki.Name)
+		ops = append(ops,
+			store.OpPutLease(peerdir+"/role", linki.Role(), stateLease),
+			store.OpPutLease(peerdir+"/localip", linki.LocalIP, stateLease),
+			store.OpPutLease(peerdir+"/localifname", linki.LocalIFName, stateLease),
+			store.OpPutLease(peerdir+"/localmac", linki.LocalMAC, stateLease),
+		)
+	}
 
-	} else {
-		// no error? must be there.
-		isalive = true
+	if !linki.IsPrimary() {
+		return 0, commitLink(ops)
 	}
 
-	return isalive
+	return publishLink(vniRange, linki, ops)
 
 }
 
-// get the full meta data for a container given the containerid
-// if setalive is true, it also sets an "isalive" flag for the container.
-// is the isalive necessary?
-func getEtcdMetaData(containerid string, setalive bool) map[string]string {
-
-	all := make(map[string]string)
-
-	// All the properties we can have.
-	all["pod_name"] = ""
-	all["pair_name"] = ""
-	all["public_ip"] = ""
-	all["local_ip"] = ""
-	all["local_ifname"] = ""
-	all["pair_ip"] = ""
-	all["pair_ifname"] = ""
-	all["primary"] = ""
-	all["isalive"] = ""
-
-	for k := range all {
-		// Print all possibilities...
-		// logger(fmt.Sprintf("key[%s] value[%s]\n", k, v))
-
-		// get a key's value
-		// logger.Print("Getting '/ratchet/" + containerid + "/" + k + "' key value")
-		getcfg := &client.GetOptions{Recursive: true}
-		targetKey := "/ratchet/" + containerid + "/" + k
-		messageResp, err := kapi.Get(context.Background(), targetKey, getcfg)
-		if err != nil {
+// publishLink allocates the link's vxlan id and writes, along with ops, what
+// the pair needs to know about the link. It's all written in the one
+// transaction that takes the vxlan id, so the id is never recorded against
+// us without our association, or the other way around.
+func publishLink(vniRange *config.VxlanIDRange, linki config.LinkInfo, ops []store.Op) (int, error) {
 
-			// For now, this seems to be just the missing values.
-			// ...which are generally fine.
-			// logger.Println(fmt.Errorf("possible missing value %s: %v", targetKey, err))
+	linkdir := config.LinkDir(linki.PairKey(), linki.PodKey(), linki.Name)
 
-		} else {
-			// print common key info
-			// logger(fmt.Sprintf("Get is done. Metadata is %q\n", messageResp))
-			// print value
+	// The vxlan id is the link's from now on, and ours until our DEL gives
+	// it back. The pair needs it, its address and interface, and to know
+	// how to find the primary.
+	linkOps := func(vxlanid int) []store.Op {
+		return append(append([]store.Op{}, ops...),
+			store.OpPutLease(linkdir+"/vxlanid", strconv.Itoa(vxlanid), stateLease),
+			store.OpPutLease(linkdir+"/pairip", linki.PairIP, stateLease),
+			store.OpPutLease(linkdir+"/pairifname", linki.PairIFName, stateLease),
+			store.OpPutLease(linkdir+"/mtu", strconv.Itoa(linki.MTU), stateLease),
+			store.OpPutLease(linkdir+"/pairmac", linki.PairMAC, stateLease),
+			store.OpPutLease(linkdir+"/primaryname", linki.PodKey(), stateLease),
+		)
+	}
 
-			// dump_resp := spew.Sdump(messageResp)
-			// os.Stderr.WriteString("DOUG !trace messageResp ----------\n" + dump_resp)
+	allocator := vxlan.NewAllocator(stateStore, vniRange.Start, vniRange.End)
+	vxlanid, errvni := allocator.Allocate(context.Background(), linkdir, linki.PodKey(), stateLease, linkOps)
+	if errvni != nil {
+		logger.Errorf("SETETCD vxlanid allocate ERROR: %v", errvni)
+		return 0, errvni
+	}
+	logger.Infof("allocated vxlan id %v to link %v", vxlanid, linkdir)
 
-			// dump_adata := spew.Sdump(adata)
-			// os.Stderr.WriteString("DOUG !trace adata ----------\n" + dump_adata)
+	return vxlanid, nil
 
-			all[k] = messageResp.Node.Value
+}
 
-			// logger(fmt.Sprintf("%q key has %q value\n", messageResp.Node.Key, messageResp.Node.Value))
-		}
+// commitLink writes ops in one transaction.
+func commitLink(ops []store.Op) error {
 
+	_, err := stateStore.Txn(context.Background(), nil, ops, nil)
+	if err != nil {
+		logger.Errorf("SETETCD ASSOC ERROR: %v", err)
+		return err
 	}
 
-	if setalive {
+	return nil
 
-		// set "/foo" key with "bar" value
-		// log.Print("Setting '/foo' key with 'bar' value")
-		_, err := kapi.Set(context.Background(), "/ratchet/"+containerid+"/isalive", "true", nil)
-		if err != nil {
-			log.Fatal(err)
-		} else {
-			// print common key info
-			// log.Printf("Set is done. Metadata is %q\n", resp)
-		}
+}
 
-	}
+// peerInfo reads what the peer we name told us about its end of the link.
+// It's empty until the peer is up, or when the peer doesn't name us.
+func peerInfo(linki config.LinkInfo) (map[string]string, error) {
 
-	return all
+	return readDir(config.PeerDir(linki.PairKey(), linki.PodKey(), linki.Name))
 
 }
 
-func associateEtcdInfo(containerid string, linki LinkInfo) (int, error) {
-
-	var vxlanid = 0
+// roleConflict says what's wrong when we and the peer we name are labelled
+// such that both would build the link, or neither would.
+func roleConflict(linki config.LinkInfo) error {
 
-	// Associate the containerid to the name.
-	_, err := kapi.Set(context.Background(), "/ratchet/association/"+linki.PodName+"/id", containerid, nil)
-	if err != nil {
-		logger(fmt.Sprintf("SETETCD ASSOC ERROR: %v", err))
-		return 0, err
-	}
-
-	_, err2 := kapi.Set(context.Background(), "/ratchet/association/"+linki.PodName+"/parentiface", linki.ParentIface, nil)
-	if err2 != nil {
-		logger(fmt.Sprintf("SETETCD parentiface ERROR: %v", err2))
-		return 0, err2
+	if linki.PairName == "" {
+		return nil
 	}
 
-	_, err3 := kapi.Set(context.Background(), "/ratchet/association/"+linki.PodName+"/parentaddr", linki.ParentAddr, nil)
-	if err3 != nil {
-		logger(fmt.Sprintf("SETETCD parentaddr ERROR: %v", err3))
-		return 0, err3
+	peer, err := peerInfo(linki)
+	if err != nil {
+		return err
 	}
 
-	// Things the primary also stores....
-	if linki.Primary == "true" {
-
-		// we should handle the vxlan id now.
-		vxlanid, _ = getVxLanID()
+	return linki.RoleConflict(peer["role"])
 
-		// and we have to store it.
-		_, err5 := kapi.Set(context.Background(), "/ratchet/association/"+linki.PairName+"/vxlanid", strconv.Itoa(vxlanid), nil)
-		if err5 != nil {
-			logger(fmt.Sprintf("SETETCD vxlanid assoc ERROR: %v", err5))
-			return 0, err5
-		}
+}
 
-		// and we have to save the pair IP.
-		_, err6 := kapi.Set(context.Background(), "/ratchet/association/"+linki.PairName+"/pairip", linki.PairIP, nil)
-		if err6 != nil {
-			logger(fmt.Sprintf("SETETCD primaryname ERROR: %v", err6))
-			return 0, err6
-		}
+// elect has us stand for building the link, against the peer. The first to
+// claim the link's election key wins, and keeps winning should it ask
+// again.
+func elect(ctx context.Context, linki config.LinkInfo) (bool, error) {
 
-		// and we have to save the pair interface.
-		_, err7 := kapi.Set(context.Background(), "/ratchet/association/"+linki.PairName+"/pairifname", linki.PairIFName, nil)
-		if err7 != nil {
-			logger(fmt.Sprintf("SETETCD primaryname ERROR: %v", err7))
-			return 0, err7
-		}
+	key := config.ElectionKey(linki.PodKey(), linki.PairKey(), linki.Name)
 
-		// we're primary, we need to let the pair know how to find the primary.
-		_, err4 := kapi.Set(context.Background(), "/ratchet/association/"+linki.PairName+"/primaryname", linki.PodName, nil)
-		if err4 != nil {
-			logger(fmt.Sprintf("SETETCD primaryname ERROR: %v", err4))
-			return 0, err4
-		}
+	won, err := stateStore.Txn(ctx, []store.Cmp{store.Missing(key)}, []store.Op{store.OpPutLease(key, linki.PodKey(), stateLease)}, nil)
+	if err != nil || won {
+		return won, err
+	}
 
+	kv, err := stateStore.Get(ctx, key)
+	if err != nil {
+		return false, err
 	}
 
-	return vxlanid, nil
+	return kv.Value == linki.PodKey(), nil
 
 }
 
-func getVxLanParentInfo(podname string) (string, string, error) {
+// readDir reads all the keys under dir at once, by their names under it.
+func readDir(dir string) (map[string]string, error) {
 
-	var parentiface = ""
-	var parentaddr = ""
-
-	targetKey := "/ratchet/association/" + podname + "/parentiface"
-	ifResp, err := kapi.Get(context.Background(), targetKey, nil)
+	kvs, _, err := stateStore.GetPrefix(context.Background(), dir+"/")
 	if err != nil {
-		logger(fmt.Sprintf("ERROR GETTING PARENTIF FROM ETCD: %v / %v @ %v", podname, err, targetKey))
-		return parentiface, parentaddr, err
+		return nil, err
 	}
 
-	// We properly have a parent interface.
-	parentiface = ifResp.Node.Value
-
-	targetKey2 := "/ratchet/association/" + podname + "/parentaddr"
-	addrResp, err2 := kapi.Get(context.Background(), targetKey2, nil)
-	if err2 != nil {
-		logger(fmt.Sprintf("ERROR GETTING PARENTADDR FROM ETCD: %v / %v / %v", podname, err2, targetKey2))
-		return parentiface, parentaddr, err2
+	values := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		values[strings.TrimPrefix(kv.Key, dir+"/")] = kv.Value
 	}
 
-	parentaddr = addrResp.Node.Value
-
-	return parentiface, parentaddr, nil
+	return values, nil
 
 }
 
-func getVxLanID() (int, error) {
+// getVxLanParentInfo gives the parent interface and address the pod (given
+// as namespace/name) published, and the MTU a vxlan over it can have (0 if
+// it didn't say).
+func getVxLanParentInfo(podname string) (string, string, int, error) {
 
-	targetKey := "/ratchet/vxlanid"
-	vxlanidResp, err := kapi.Get(context.Background(), targetKey, nil)
+	assoc, err := readDir(config.AssociationDir(podname))
 	if err != nil {
-		// if (err != client.ErrorCodeKeyNotFound) {
-		// 	// That's a real error?
-		// 	logger("UNEXCEPTED getVxLan-Id ERROR CODE? %v",err)
-		// }
-
-		// Let's assume that means we don't have this set.
-		// so let's default it.
-		_, err2 := kapi.Set(context.Background(), targetKey, strconv.Itoa(beginningVxlanID+1), nil)
-		if err2 != nil {
-			logger(fmt.Sprintf("SETETCD getVxLan-Id ERROR: %v", err2))
-			return 0, err2
-		}
-
-		return beginningVxlanID, nil
-
+		logger.Errorf("ERROR GETTING PARENT INFO FROM ETCD: %v / %v", podname, err)
+		return "", "", 0, err
 	}
 
-	// Ok pick up the current one.
-	vxlanstring := vxlanidResp.Node.Value
-
-	// Convert it to an int
-	vxlanid, _ := strconv.Atoi(vxlanstring)
-
-	// Increment it, and set it.
-	_, err2 := kapi.Set(context.Background(), targetKey, strconv.Itoa(vxlanid+1), nil)
-	if err2 != nil {
-		logger(fmt.Sprintf("SETETCD increment getVxLan-Id ERROR: %v", err2))
-		return 0, err2
+	parentiface, ok1 := assoc["parentiface"]
+	parentaddr, ok2 := assoc["parentaddr"]
+	if !ok1 || !ok2 {
+		return "", "", 0, fmt.Errorf("no parent interface info for %v", podname)
 	}
 
-	// Return the current one.
-	return vxlanid, nil
+	vxlanmtu, _ := strconv.Atoi(assoc["vxlanmtu"])
+
+	return parentiface, parentaddr, vxlanmtu, nil
 
 }
 
 func isPairContainerAlive(podname string) string {
 
-	targetKey := "/ratchet/association/" + podname + "/id"
-	respContainerID, err := kapi.Get(context.Background(), targetKey, nil)
+	targetKey := config.AssociationDir(podname) + "/id"
+	respContainerID, err := stateStore.Get(context.Background(), targetKey)
 	if err != nil {
 
 		// ErrorCodeKeyNotFound = Key not found, that's exactly the one we know is good.
@@ -337,84 +252,103 @@ func isPairContainerAlive(podname string) string {
 
 	} else {
 		// no error? must be there.
-		return respContainerID.Node.Value
+		return respContainerID.Value
 	}
 
 	return ""
 
 }
 
-func isPrimaryContainerAlive(podname string) (string, string, string, string) {
+// getPairNetns gives the netns path the pair published when it came up.
+func getPairNetns(podname string) (string, error) {
 
-	targetKey := "/ratchet/association/" + podname + "/primaryname"
-	respPrimaryName, err := kapi.Get(context.Background(), targetKey, nil)
+	kv, err := stateStore.Get(context.Background(), config.AssociationDir(podname)+"/netns")
 	if err != nil {
+		return "", err
+	}
 
-		// ErrorCodeKeyNotFound = Key not found, that's exactly the one we know is good.
-		// So let's log when it's not that.
-		// Passing along on this.
-		/*
-			 if (err != client.ErrorCodeKeyNotFound) {
-				 logger.Println(fmt.Errorf("isPairContainerAlive - possible missing value %s: %v", targetKey, err))
-			 }
-		*/
-
-	} else {
-		// no error? must be there.
+	if kv.Value == "" {
+		return "", fmt.Errorf("pair %v published an empty netns", podname)
+	}
 
-		respVxlanID, _ := kapi.Get(context.Background(), "/ratchet/association/"+podname+"/vxlanid", nil)
-		// above needs error handling.
+	return kv.Value, nil
 
-		// and we need the pair ip.
-		respPairIP, _ := kapi.Get(context.Background(), "/ratchet/association/"+podname+"/pairip", nil)
+}
 
-		// and we need the pair if.
-		respPairIF, _ := kapi.Get(context.Background(), "/ratchet/association/"+podname+"/pairifname", nil)
+// findLinkDir is where our primary tells us about the link. When we (the
+// pair) don't know who our primary is, we take the link of our link's name
+// that it tells us of.
+func findLinkDir(linki config.LinkInfo) string {
 
-		return respPrimaryName.Node.Value, respVxlanID.Node.Value, respPairIP.Node.Value, respPairIF.Node.Value
+	if linki.PairName != "" {
+		return config.LinkDir(linki.PodKey(), linki.PairKey(), linki.Name)
+	}
 
+	links, err := stateStore.Children(context.Background(), config.LinksDir(linki.PodKey()))
+	if err != nil {
+		return ""
 	}
 
-	return "", "", "", ""
+	return config.FindLinkDir(linki.PodKey(), links, linki.Name)
 
 }
 
-func pairWait(containerid string, linki LinkInfo) error {
+func isPrimaryContainerAlive(linkdir string) (string, string, string, string, string, string) {
 
-	// Ok, we're not primary (we are the pair). So, go into a wait loop.
-	// we need to find out when the primary finishes.
-	// then we can create our vxlan, if need be.
-	primarytries := 0
+	// The primary writes the link all at once, so one read gets all of it,
+	// or none.
+	link, err := readDir(linkdir)
+	if err != nil {
+		logger.Errorf("failed to read link info in %v: %v", linkdir, err)
+		return "", "", "", "", "", ""
+	}
 
-	var primaryname, primaryvxlanid, pairip, pairifname string
+	if link["primaryname"] == "" {
+		return "", "", "", "", "", ""
+	}
 
-	for {
+	return link["primaryname"], link["vxlanid"], link["pairip"], link["pairifname"], link["mtu"], link["pairmac"]
 
-		primaryname, primaryvxlanid, pairip, pairifname = isPrimaryContainerAlive(linki.PodName)
+}
 
-		if len(primaryname) >= 1 {
-			// We found it.
-			logger(fmt.Sprintf("FOUND PRIMARY: %v", primaryname))
-			break
-		}
+func pairWait(ctx context.Context, r rendezvous, netconf *config.NetConf, netns string, linki config.LinkInfo) error {
+
+	// Ok, we're not primary (we are the pair). So, wait for the primary to
+	// tell us about the link (the primaryname goes last), then we can
+	// create our vxlan, if need be.
+	var linkdir, primaryname, primaryvxlanid, pairip, pairifname, linkmtu, pairmac string
 
-		primarytries++
+	if err := roleConflict(linki); err != nil {
+		return err
+	}
 
-		if debug {
-			logger(fmt.Sprintf("Is PRIMARY alive? primaryname: %v (%v retries)", linki.PodName, primarytries))
+	err := r.watchFor(ctx, config.LinksDir(linki.PodKey())+"/", func() bool {
+		if linkdir = findLinkDir(linki); linkdir != "" {
+			primaryname, primaryvxlanid, pairip, pairifname, linkmtu, pairmac = isPrimaryContainerAlive(linkdir)
 		}
 
-		// We either timeout, or, we're alive.
-		if primarytries >= aliveWaitRetries {
-			return fmt.Errorf("Timeout: could not find that PRIMARY container is alive via metadata in %v tries", primarytries)
+		logger.Debugf("Is PRIMARY alive? primaryname: %v", primaryname)
+		return len(primaryname) >= 1
+	})
+	if err != nil {
+		// The peer may have come up labelled as the pair too, since we
+		// started waiting.
+		if errconflict := roleConflict(linki); errconflict != nil {
+			return errconflict
 		}
+		return fmt.Errorf("Timeout: could not find that PRIMARY container is alive via metadata: %v", err)
+	}
 
-		// Wait for however long.
-		time.Sleep(aliveWaitSeconds * time.Second)
+	logger.Infof("FOUND PRIMARY: %v", primaryname)
 
+	// A primary we didn't name could be in any namespace, so make sure
+	// it's one we may link to.
+	primarynamespace, _ := config.SplitPodName(primaryname, linki.Namespace)
+	if !netconf.MayLink(linki.Namespace, primarynamespace) {
+		return fmt.Errorf("primary %v is in namespace %v, which pods in namespace %v may not link to (see peer_namespaces)", primaryname, primarynamespace, linki.Namespace)
 	}
 
-	_, primaryparentaddr, primaryparentinfoerr := getVxLanParentInfo(primaryname)
+	_, primaryparentaddr, primaryvxlanmtu, primaryparentinfoerr := getVxLanParentInfo(primaryname)
 	if primaryparentinfoerr != nil {
 		return primaryparentinfoerr
 	}
@@ -432,23 +366,16 @@ func pairWait(containerid string, linki LinkInfo) error {
 		// Alright, create a vxlan interface, w00t.
 
 		// We need a veth generally.
-		pairns, errpairns := koko.GetDockerContainerNS(containerid)
-		if errpairns != nil {
-			return fmt.Errorf("failed to get pairns (pair) %v: %v", containerid, errpairns)
-		}
+		pairns := netns
 
-		ippair, maskpair, errpairparsecidr := net.ParseCIDR(pairip + "/24")
-		if errpairparsecidr != nil {
-			return fmt.Errorf("failed to parse IP (pairparse) %s: %v", linki.LocalIP+"/24", errpairparsecidr)
-		}
-		ipaddrpair := net.IPNet{
-			IP:   ippair,
-			Mask: maskpair.Mask,
+		ipaddrpair, errpairparse := config.ParseLinkAddrs(pairip)
+		if errpairparse != nil {
+			return fmt.Errorf("failed to parse IP (pairparse) %s: %v", pairip, errpairparse)
 		}
 
 		vethpair := koko.VEth{}
 		vethpair.NsName = pairns
-		vethpair.IPAddr = append(vethpair.IPAddr, ipaddrpair)
+		vethpair.IPAddr = ipaddrpair
 		vethpair.LinkName = pairifname
 
 		// Set the vxlan properties.
@@ -459,18 +386,41 @@ func pairWait(containerid string, linki LinkInfo) error {
 		vxlanpair.ID = useprimaryvxlanid
 
 		// Log it all.
-		logger(fmt.Sprintf("(pair) VXLAN INFO: %v", vxlanpair))
-		logger(fmt.Sprintf("(pair) VETH INFO: %v", vethpair))
+		logger.Infof("(pair) VXLAN INFO: %v", vxlanpair)
+		logger.Infof("(pair) VETH INFO: %v", vethpair)
+
+		// Hold on to the vxlan id too, so it's not reused while our end is up.
+		errhold := vxlan.Hold(context.Background(), stateStore, useprimaryvxlanid, linkdir, linki.PodKey(), stateLease)
+		if errhold != nil {
+			logger.Errorf("(pair) SETETCD vxlanid hold ERROR: %v", errhold)
+			return errhold
+		}
 
 		// Now ask koko to do it?
 		errvxlan := koko.MakeVxLan(vethpair, vxlanpair)
 
 		if errvxlan != nil {
-			logger(fmt.Sprintf("(pair) VXLAN ERROR: %v", errvxlan))
+			logger.Errorf("(pair) VXLAN ERROR: %v", errvxlan)
 			return errvxlan
 		}
 
-		logger("Koko VXLAN creation, success (pair)")
+		logger.Info("Koko VXLAN creation, success (pair)")
+
+		// The primary works the MTU out from the same numbers, so both
+		// ends match.
+		configuredmtu, _ := strconv.Atoi(linkmtu)
+		mtu := config.LinkMTU(configuredmtu, parentVxlanMTU(linki), primaryvxlanmtu)
+
+		// A MAC the primary was given for our end goes before our own.
+		if pairmac == "" {
+			pairmac = linki.LocalMAC
+		}
+		mac, err := config.LinkMAC(pairmac, linki.PodKey(), pairifname)
+		if err != nil {
+			return err
+		}
+
+		return setLinkEnd(netns, pairifname, mtu, mac)
 
 	}
 
@@ -478,57 +428,65 @@ func pairWait(containerid string, linki LinkInfo) error {
 
 }
 
-func primaryWait(linki LinkInfo) (string, error) {
+func primaryWait(ctx context.Context, r rendezvous, linki config.LinkInfo) (string, error) {
 
 	var pairContainerID string
-	tries := 0
-
-	for {
-
-		pairContainerID = isPairContainerAlive(linki.PairName)
-
-		if len(pairContainerID) >= 1 {
-			// We found it.
-			break
-		}
-
-		tries++
-
-		if debug {
-			logger(fmt.Sprintf("Is pair alive? pair_name: %v (%v retries)", linki.PairName, tries))
-		}
-
-		// We either timeout, or, we're alive.
-		if tries >= aliveWaitRetries {
-			return "", fmt.Errorf("Timeout: could not find that pair container is alive via metadata in %v tries", tries)
-		}
 
-		// Wait for however long.
-		time.Sleep(aliveWaitSeconds * time.Second)
+	err := r.watchFor(ctx, config.AssociationDir(linki.PairKey())+"/id", func() bool {
+		pairContainerID = isPairContainerAlive(linki.PairKey())
 
+		logger.Debugf("Is pair alive? pair_name: %v", linki.PairKey())
+		return len(pairContainerID) >= 1
+	})
+	if err != nil {
+		return "", fmt.Errorf("Timeout: could not find that pair container is alive via metadata: %v", err)
 	}
 
 	return pairContainerID, nil
 
 }
 
-func ratchet(argif string, containerid string, linki LinkInfo) error {
+func ratchet(netconf *config.NetConf, argif string, containerid string, netns string, linki config.LinkInfo) error {
 
-	logger(fmt.Sprintf("ratchet LinkInfo: %v", linki))
+	logger.Infof("ratchet LinkInfo: %v", linki)
 
 	// If this is up, we can assume the infra container is good to go.
 	// So all we need to do is associate our containerid with our name.
-	vxlanid, _ := associateEtcdInfo(containerid, linki)
+	if netns == "" {
+		return fmt.Errorf("no netns given for container %v", containerid)
+	}
+
+	timing, err := linki.Timing(netconf)
+	if err != nil {
+		return err
+	}
+
+	vxlanid, err := associateEtcdInfo(netconf.VxlanIDRange, containerid, netns, linki)
+	if err != nil {
+		return err
+	}
+
+	// A link without a pair is ours to make, straight away.
+	if !linki.HasPair() {
+		return makeLocalLink(netns, linki)
+	}
+
+	// However the other end of the link shows up, it has to be in time
+	// (unless we're to wait forever).
+	r := rendezvous{timing: timing, podName: linki.PodKey(), containerID: containerid}
+	ctx, cancel := r.context()
+	defer cancel()
 
 	// !bang
 	// If it's determined that we're alive, now we can see if we're primary.
 	// If we're not primary, we can just exit right now.
 	// Cause the primary side will add to this pair.
 
-	if linki.Primary != "true" {
-
-		return pairWait(containerid, linki)
-
+	switch linki.Role() {
+	case config.RolePair:
+		return pairWait(ctx, r, netconf, netns, linki)
+	case config.RoleElect:
+		return electWait(ctx, r, netconf, netns, linki)
 	}
 
 	// Check to see there's a valid pair name.
@@ -541,26 +499,166 @@ func ratchet(argif string, containerid string, linki LinkInfo) error {
 	// So it's time to go into a loop and do that.
 	// if the pair container is alive -- bada bing, we can execute koko.
 
-	pairContainerID, waiterror := primaryWait(linki)
+	pairContainerID, waiterror := primaryWait(ctx, r, linki)
 	if waiterror != nil {
 		return waiterror
 	}
 
+	if err := roleConflict(linki); err != nil {
+		return err
+	}
+
+	// A mirror link copies one of our other links, so that has to be up.
+	if linki.LinkType() == config.LinkTypeMirror {
+		if err := waitForMirrored(ctx, netns, linki); err != nil {
+			return err
+		}
+	}
+
+	return buildLink(r, netns, linki, vxlanid, pairContainerID)
+
+}
+
+// macvlanModes are netlink's names for the MACVLAN modes.
+var macvlanModes = map[string]netlink.MacvlanMode{
+	config.MacvlanBridge:   netlink.MACVLAN_MODE_BRIDGE,
+	config.MacvlanPrivate:  netlink.MACVLAN_MODE_PRIVATE,
+	config.MacvlanVepa:     netlink.MACVLAN_MODE_VEPA,
+	config.MacvlanPassthru: netlink.MACVLAN_MODE_PASSTHRU,
+}
+
+// makeLocalLink makes a link with no pair, of one of the node's interfaces,
+// and moves it into our netns.
+func makeLocalLink(netns string, linki config.LinkInfo) error {
+
+	ipaddr, err := config.ParseLinkAddrs(linki.LocalIP)
+	if err != nil {
+		return fmt.Errorf("failed to parse IP %s: %v", linki.LocalIP, err)
+	}
+
+	veth := koko.VEth{}
+	veth.NsName = netns
+	veth.IPAddr = ipaddr
+	veth.LinkName = linki.LocalIFName
+
+	switch linki.LinkType() {
+	case config.LinkTypeVlan:
+		vlan := koko.VLan{}
+		vlan.ParentIF = linki.Master
+		vlan.ID = linki.VlanID
+
+		logger.Infof("VLAN INFO: %v", vlan)
+
+		if err := koko.MakeVLan(veth, vlan); err != nil {
+			logger.Errorf("VLAN ERROR: %v", err)
+			return err
+		}
+	case config.LinkTypeMacvlan:
+		macvlan := koko.MacVLan{}
+		macvlan.ParentIF = linki.Master
+		macvlan.Mode = macvlanModes[linki.Mode()]
+
+		logger.Infof("MACVLAN INFO: %v", macvlan)
+
+		if err := koko.MakeMacVLan(veth, macvlan); err != nil {
+			logger.Errorf("MACVLAN ERROR: %v", err)
+			return err
+		}
+	default:
+		return fmt.Errorf("don't know how to make a %v link", linki.LinkType())
+	}
+
+	logger.Infof("Koko %v creation, success", linki.LinkType())
+
+	// A passthru macvlan shares its MAC with the node's interface, so we
+	// leave it be unless we're asked for one.
+	if linki.LinkType() == config.LinkTypeMacvlan && linki.Mode() == config.MacvlanPassthru && linki.LocalMAC == "" {
+		return setLinkMTU(netns, linki.LocalIFName, linki.MTU)
+	}
+
+	mac, err := localMAC(linki)
+	if err != nil {
+		return err
+	}
+	return setLinkEnd(netns, linki.LocalIFName, linki.MTU, mac)
+
+}
+
+// electWait waits for the peer, then settles with it which of us builds the
+// link: a peer labelled primary does, otherwise whoever wins the election.
+// The winner takes the pair's address and interface from what the pair
+// said of its own end, unless we were told them.
+func electWait(ctx context.Context, r rendezvous, netconf *config.NetConf, netns string, linki config.LinkInfo) error {
+
+	pairContainerID, err := primaryWait(ctx, r, linki)
+	if err != nil {
+		return err
+	}
+
+	// The peer said what it makes of the link along with its id.
+	peer, err := peerInfo(linki)
+	if err != nil {
+		return err
+	}
+
+	if peer["role"] == config.RolePrimary {
+		logger.Infof("peer %v is labelled primary, so we're its pair", linki.PairKey())
+		return pairWait(ctx, r, netconf, netns, linki)
+	}
+
+	leader, err := elect(ctx, linki)
+	if err != nil {
+		return fmt.Errorf("failed to elect the primary of link to %v: %v", linki.PairKey(), err)
+	}
+
+	if !leader {
+		logger.Infof("peer %v was elected primary", linki.PairKey())
+		return pairWait(ctx, r, netconf, netns, linki)
+	}
+
+	logger.Infof("elected primary of link to %v", linki.PairKey())
+
+	if linki.PairIP == "" {
+		linki.PairIP = peer["localip"]
+	}
+	if linki.PairIFName == "" {
+		linki.PairIFName = peer["localifname"]
+	}
+	if linki.PairMAC == "" {
+		linki.PairMAC = peer["localmac"]
+	}
+	if linki.PairIFName == "" {
+		return fmt.Errorf("no interface name for %v's end of the link: set pair_ifname, or local_ifname on %v", linki.PairKey(), linki.PairKey())
+	}
+
+	vxlanid, err := publishLink(netconf.VxlanIDRange, linki, nil)
+	if err != nil {
+		return err
+	}
+
+	return buildLink(r, netns, linki, vxlanid, pairContainerID)
+
+}
+
+// buildLink has us, the primary, make both ends of the link, now that the
+// pair's up: a veth when we're on the same node, else our vxlan end.
+func buildLink(r rendezvous, netns string, linki config.LinkInfo, vxlanid int, pairContainerID string) error {
+
 	// Now, we can probably rock out all the
-	logger(fmt.Sprintf("And my pair's container id is: %v", pairContainerID))
+	logger.Infof("And my pair's container id is: %v", pairContainerID)
 
 	// What about a healthy delay?
 	// TODO: This may or may not be necessary.
-	logger(fmt.Sprintf("Pre koko-delay, %v SECONDS", delayKokoSeconds))
-	time.Sleep(delayKokoSeconds * time.Second)
+	logger.Infof("Pre koko-delay, %v", r.timing.KokoDelay)
+	time.Sleep(r.timing.KokoDelay)
 
 	// Let's pick up the pair's parent interface info.
-	pairparentiface, pairparentaddr, parentinfoerr := getVxLanParentInfo(linki.PairName)
+	pairparentiface, pairparentaddr, pairvxlanmtu, parentinfoerr := getVxLanParentInfo(linki.PairKey())
 	if parentinfoerr != nil {
 		return parentinfoerr
 	}
 
-	logger(fmt.Sprintf("Got parent info, OK: %v / %v", pairparentiface, pairparentaddr))
+	logger.Infof("Got parent info, OK: %v / %v", pairparentiface, pairparentaddr)
 
 	// Ok, so now that we have the parent interface information for the pair...
 	// We can now decide if we want to use vxlan.
@@ -573,40 +671,26 @@ func ratchet(argif string, containerid string, linki LinkInfo) error {
 		usevxlan = true
 	}
 
-	// Parse addr/cidr into net objects.
-	ip1, mask1, err1 := net.ParseCIDR(linki.LocalIP + "/24")
-	ip2, mask2, err2 := net.ParseCIDR(linki.PairIP + "/24")
-
-	// Check those worked.
+	// Parse addr/cidr lists into net objects.
+	ipaddr1, err1 := config.ParseLinkAddrs(linki.LocalIP)
 	if err1 != nil {
-		return fmt.Errorf("failed to parse IP addr1 %s: %v", linki.LocalIP+"/24", err1)
+		return fmt.Errorf("failed to parse IP addr1 %s: %v", linki.LocalIP, err1)
 	}
 
+	ipaddr2, err2 := config.ParseLinkAddrs(linki.PairIP)
 	if err2 != nil {
-		return fmt.Errorf("failed to parse IP addr2 %s: %v", linki.PairIP+"/24", err1)
-	}
-
-	// Make a IPNet object for each of these.
-	ipaddr1 := net.IPNet{
-		IP:   ip1,
-		Mask: mask1.Mask,
+		return fmt.Errorf("failed to parse IP addr2 %s: %v", linki.PairIP, err2)
 	}
 
-	ipaddr2 := net.IPNet{
-		IP:   ip2,
-		Mask: mask2.Mask,
-	}
-
-	// Get the net namespaces
-	ns1, err1 := koko.GetDockerContainerNS(containerid)
-	if err1 != nil {
-		return fmt.Errorf("failed to get containerns1 (primary) %v: %v", containerid, err1)
+	mac1, errmac := localMAC(linki)
+	if errmac != nil {
+		return errmac
 	}
 
 	// And assign those to the initial veth data structure.
 	veth1 := koko.VEth{}
-	veth1.NsName = ns1
-	veth1.IPAddr = append(veth1.IPAddr, ipaddr1)
+	veth1.NsName = netns
+	veth1.IPAddr = ipaddr1
 	veth1.LinkName = linki.LocalIFName
 
 	if usevxlan {
@@ -625,17 +709,23 @@ func ratchet(argif string, containerid string, linki LinkInfo) error {
 		vxlan.ID = vxlanid
 
 		// Log it all.
-		logger(fmt.Sprintf("VXLAN INFO: %v", vxlan))
+		logger.Infof("VXLAN INFO: %v", vxlan)
 
 		// Now ask koko to do it?
 		errvxlan := koko.MakeVxLan(veth1, vxlan)
 
 		if errvxlan != nil {
-			logger(fmt.Sprintf("VXLAN ERROR: %v", errvxlan))
+			logger.Errorf("VXLAN ERROR: %v", errvxlan)
 			return errvxlan
 		}
 
-		logger("Koko VXLAN creation, success (primary)")
+		logger.Info("Koko VXLAN creation, success (primary)")
+
+		// No bigger than either parent interface can carry.
+		mtu := config.LinkMTU(linki.MTU, parentVxlanMTU(linki), pairvxlanmtu)
+		if err := setLinkEnd(netns, linki.LocalIFName, mtu, mac1); err != nil {
+			return err
+		}
 
 	} else {
 
@@ -644,7 +734,7 @@ func ratchet(argif string, containerid string, linki LinkInfo) error {
 		// os.Stderr.WriteString("The containerid: " + containerid + "\n")
 		// os.Stderr.WriteString("DOUG !trace my_meta ----------\n" + dump_my_meta)
 		// os.Stderr.WriteString("DOUG !trace pair_alive ----------" + fmt.Sprintf("%t",pair_alive) + "\n")
-		ns2, err2 := koko.GetDockerContainerNS(pairContainerID)
+		ns2, err2 := getPairNetns(linki.PairKey())
 		if err2 != nil {
 			return fmt.Errorf("failed to get containerns2 (pair) %v: %v", pairContainerID, err2)
 		}
@@ -653,115 +743,151 @@ func ratchet(argif string, containerid string, linki LinkInfo) error {
 		veth2 := koko.VEth{}
 
 		veth2.NsName = ns2
-		veth2.IPAddr = append(veth2.IPAddr, ipaddr2)
+		veth2.IPAddr = ipaddr2
 		veth2.LinkName = linki.PairIFName
 
 		kokoErr := koko.MakeVeth(veth1, veth2)
 
 		// kokoErr := koko.VethCreator(
 		// 	containerid,
-		// 	linki.LocalIP+"/24",
+		// 	linki.LocalIP,
 		// 	linki.LocalIFName,
 		// 	pairContainerID,
-		// 	linki.PairIP+"/24",
+		// 	linki.PairIP,
 		// 	linki.PairIFName,
 		// )
 
 		if kokoErr != nil {
-			logger(fmt.Sprintf("koko error in child: %v", kokoErr))
+			logger.Errorf("koko error in child: %v", kokoErr)
 			return kokoErr
 		}
 
-		logger("Koko VETH creation, success (primary)")
+		logger.Info("Koko VETH creation, success (primary)")
+
+		mac2, errmac := pairMAC(linki)
+		if errmac != nil {
+			return errmac
+		}
+		if err := setLinkEnd(netns, linki.LocalIFName, linki.MTU, mac1); err != nil {
+			return err
+		}
+		if err := setLinkEnd(ns2, linki.PairIFName, linki.MTU, mac2); err != nil {
+			return err
+		}
 
 	}
 
-	return nil
+	return setMirror(netns, linki)
 
 }
 
-func logger(input string) {
+func initStore(netconf *config.NetConf) {
 
-	// exec_command :=
-	// os.Stderr.WriteString("!trace alive The containerid: |" + exec_command + "|||\n")
+	// Open the state store (etcd, usually). Then we reuse the "stateStore"
 
-	// This is a total hack.
-	// cmd := exec.Command("/bin/bash", "-c", "echo \"ratchet-child: " + input + "\" | systemd-cat")
+	s, err := store.New(netconf)
+	if err != nil {
+		logger.Fatalf("failed to open state store: %v", err)
+	}
+	stateStore = s
 
-	// This is even MORE of a hack.
-	cmd := exec.Command("/bin/bash", "-c", "echo \"ratchet-child: "+input+"\" >> /tmp/ratchet-child.log")
-	cmd.Start()
+	nodeName, err = netconf.Node()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
 
+	// Our keys go with the node's lease, when there's one, so they go
+	// when the node does.
+	if netconf.LeaseTTLSeconds > 0 {
+		stateLease, err = store.NodeLease(context.Background(), stateStore, nodeName, int64(netconf.LeaseTTLSeconds))
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+	}
 }
 
-func initEtcd(etcdHost string, etcdPort string) {
+// readHandoff reads the handoff from the spool file ratchet names as our
+// argument (and removes it), or from stdin when there's no argument.
+func readHandoff() (*config.Handoff, error) {
 
-	// Make a connection to etcd. Then we reuse the "kapi"
+	if len(os.Args) < 2 || os.Args[1] == "-" {
+		return config.ReadHandoff(os.Stdin)
+	}
 
-	cfg := client.Config{
-		Endpoints: []string{"http://" + etcdHost + ":" + etcdPort},
-		Transport: client.DefaultTransport,
-		// set timeout per request to fail fast when the target endpoint is unavailable
-		HeaderTimeoutPerRequest: time.Second,
+	f, err := os.Open(os.Args[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to open handoff: %v", err)
 	}
-	c, err := client.New(cfg)
+	defer os.Remove(os.Args[1])
+	defer f.Close()
+
+	return config.ReadHandoff(f)
+
+}
+
+func ratchetLink(netconf *config.NetConf, args config.CNIArgs, linki config.LinkInfo) {
+
+	linklogger := logger.WithFields(logrus.Fields{
+		"local_ifname": linki.LocalIFName,
+		"peer":         linki.PairName,
+	})
+
+	err := ratchet(netconf, args.IfName, args.ContainerID, args.Netns, linki)
 	if err != nil {
-		log.Fatal(err)
+		linklogger.Errorf("completition WITH ERROR: %v", err)
+	} else {
+		linklogger.Info("ratchet completition, success.")
 	}
-	kapi = client.NewKeysAPI(c)
+
 }
 
 func main() {
 
-	// arg := os.Args[3]
+	handoff, err := readHandoff()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	netconf := handoff.NetConf
+	l, err := logging.New("ratchet-child", netconf.LogLevel, netconf.LogFile)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	logger = l.WithFields(logrus.Fields{
+		"container_id": handoff.Args.ContainerID,
+		"pod_name":     handoff.Links[0].PodKey(),
+	})
 
-	initEtcd(os.Args[3], os.Args[4])
+	initStore(netconf)
 
-	if debug {
-		logger("[LOGGING ENABLED]")
-		logger(fmt.Sprintf("Interface: %v", os.Args[1]))
-		logger(fmt.Sprintf("ContainerID: %v", os.Args[2]))
-		// Inspect all the arguments.
-		for idx, element := range os.Args {
-			logger(fmt.Sprintf("arg[%v]: %v", idx, element))
-		}
+	if netconf.VxlanIDRange == nil {
+		netconf.VxlanIDRange = &config.VxlanIDRange{Start: vxlan.BeginningID, End: vxlan.MaxID}
 	}
 
-	// Apr 29 00:43:30 cni unknown[14497]: ratchet-child: arg[0]: /home/centos/cni/bin/ratchet-child
-	// Apr 29 00:43:30 cni unknown[14499]: ratchet-child: arg[1]: eth0
-	// Apr 29 00:43:30 cni unknown[14503]: ratchet-child: arg[2]: a3a3cb196700434c0ff58f0c07c8c51b95d2404826a017799b49c6a61224af1a
-	// Apr 29 00:43:30 cni cat[14507]: ratchet-child: arg[3]: localhost
-	// Apr 29 00:43:30 cni cat[14510]: ratchet-child: arg[4]: primary-pod
-	// Apr 29 00:43:30 cni unknown[14515]: ratchet-child: arg[5]: primary-pod
-	// Apr 29 00:43:30 cni unknown[14518]: ratchet-child: arg[6]: primary-pod
-	// Apr 29 00:43:30 cni unknown[14522]: ratchet-child: arg[7]: 1.1.1.1
-	// Apr 29 00:43:30 cni cat[14524]: ratchet-child: arg[8]: 192.168.2.100
-	// Apr 29 00:43:30 cni cat[14527]: ratchet-child: arg[9]: in1
-	// Apr 29 00:43:30 cni cat[14532]: ratchet-child: arg[10]: pair-pod
-	// Apr 29 00:43:30 cni cat[14539]: ratchet-child: arg[13]: true
-	// Apr 29 00:43:30 cni unknown[14537]: ratchet-child: arg[12]: in2
-	// Apr 29 00:43:30 cni unknown[14534]: ratchet-child: arg[11]: 192.168.2.101
-
-	linki := LinkInfo{}
-	linki.PodName = os.Args[5]
-	linki.TargetPod = os.Args[6]
-	linki.TargetContainer = os.Args[7]
-	linki.PublicIP = os.Args[8]
-	linki.LocalIP = os.Args[9]
-	linki.LocalIFName = os.Args[10]
-	linki.PairName = os.Args[11]
-	linki.PairIP = os.Args[12]
-	linki.PairIFName = os.Args[13]
-	linki.Primary = os.Args[14]
-	linki.ParentIface = os.Args[15]
-	linki.ParentAddr = os.Args[16]
-
-	err := ratchet(os.Args[1], os.Args[2], linki)
-	if err != nil {
-		logger("completition WITH ERROR")
-		logger(fmt.Sprintf("%v", err))
-	} else {
-		logger("ratchet completition, success. (containerid: " + os.Args[2] + ")")
+	logger.Debugf("Interface: %v", handoff.Args.IfName)
+	logger.Debugf("Handoff: %+v", handoff)
+
+	// Our keys go with the node's lease, so somebody on the node has to
+	// keep it alive, for as long as it has pods.
+	done := make(chan struct{})
+	kept := make(chan struct{})
+	go func() {
+		defer close(kept)
+		keepNodeLease(netconf, done)
+	}()
+
+	// Each link waits on its own peer, so build them all side by side.
+	var wg sync.WaitGroup
+	for _, linki := range handoff.Links {
+		wg.Add(1)
+		go func(linki config.LinkInfo) {
+			defer wg.Done()
+			ratchetLink(netconf, handoff.Args, linki)
+		}(linki)
 	}
+	wg.Wait()
+
+	close(done)
+	<-kept
 
 }
@@ -0,0 +1,121 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"golang.org/x/net/context"
+)
+
+// maxBackoff caps how long we go between looks, when waiting forever or
+// when etcd keeps dropping our watch.
+const maxBackoff = 5 * time.Minute
+
+// rendezvous is how one end of a link waits for the other.
+type rendezvous struct {
+	timing config.Timing
+	// podName and containerID are our own, so we can tell when our pod
+	// has been deleted, and there's no more use waiting.
+	podName     string
+	containerID string
+}
+
+// context gives the context bounding the whole wait.
+func (r rendezvous) context() (context.Context, context.CancelFunc) {
+	if r.timing.Forever() {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), r.timing.Timeout)
+}
+
+// watchFor waits until found says what it's looking for is there, looking
+// again each time a key starting with prefix changes in the store. It gives up with
+// ctx's error once ctx is done, or once our pod is gone. Waiting forever,
+// it wakes up every so often (backing off) to make sure we're still wanted.
+func (r rendezvous) watchFor(ctx context.Context, prefix string, found func() bool) error {
+
+	backoff := r.timing.Retry
+
+	for {
+
+		// Take the revision before we look, so we can't miss a change
+		// made between looking and watching.
+		_, rev, err := stateStore.GetPrefix(ctx, prefix)
+
+		if found() {
+			return nil
+		}
+
+		if r.isGone() {
+			return fmt.Errorf("pod %v was deleted while waiting", r.podName)
+		}
+
+		wakeup := false
+		if err == nil {
+			wctx, cancel := ctx, context.CancelFunc(func() {})
+			if r.timing.Forever() {
+				wctx, cancel = context.WithTimeout(ctx, backoff)
+			}
+
+			err = stateStore.WaitForChange(wctx, prefix, rev)
+			wakeup = wctx.Err() != nil
+			cancel()
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == nil {
+			// Something changed, go and look.
+			backoff = r.timing.Retry
+			continue
+		}
+
+		if !wakeup {
+			// We lost etcd (or the revision we watched from has been
+			// compacted), so catch our breath and start over.
+			logger.Debugf("watch on %v interrupted, watching again in %v: %v", prefix, backoff, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+	}
+
+}
+
+// isGone says whether our pod's DEL has already cleared our association
+// (or another container took over our pod's name).
+func (r rendezvous) isGone() bool {
+	kv, err := stateStore.Get(context.Background(), config.AssociationDir(r.podName)+"/id")
+	if store.IsKeyNotFound(err) {
+		return true
+	}
+
+	return err == nil && kv.Value != r.containerID
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/etcd"
+	"github.com/dougbtv/ratchet-cni/pkg/migrate"
+)
+
+// defaultConfPath is where we look for our netconf, when run by hand.
+const defaultConfPath = "/etc/cni/net.d/ratchet.conf"
+
+// runCommand runs ratchet as an admin tool, rather than as a plugin, and
+// gives the exit code.
+func runCommand(args []string) int {
+	var err error
+
+	switch args[0] {
+	case "migrate-v2":
+		err = migrateV2(args[1:])
+	case "gc":
+		err = gc(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q, use migrate-v2 or gc", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ratchet %v: %v\n", args[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+// loadConfFile reads the netconf from a file, for the commands.
+func loadConfFile(path string) (*config.NetConf, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadNetConf(bytes)
+}
+
+// migrateV2 copies ratchet's associations, links and vxlan id counter from
+// the etcd v2 store into etcd v3.
+func migrateV2(args []string) error {
+	flags := flag.NewFlagSet("migrate-v2", flag.ContinueOnError)
+	confPath := flags.String("config", defaultConfPath, "ratchet netconf, naming the etcd to migrate into")
+	v2Endpoint := flags.String("v2-endpoint", "", "etcd to migrate from, when not the same one (like http://10.0.0.1:2379)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	netconf, err := loadConfFile(*confPath)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := netconf.EtcdConfig()
+	if err != nil {
+		return err
+	}
+
+	v3, err := etcd.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create etcd client: %v", err)
+	}
+
+	if *v2Endpoint == "" {
+		*v2Endpoint = cfg.Endpoints[0]
+	}
+
+	transport := client.DefaultTransport
+	if cfg.TLS != nil {
+		transport = &http.Transport{TLSClientConfig: cfg.TLS}
+	}
+
+	c, err := client.New(client.Config{
+		Endpoints:               []string{*v2Endpoint},
+		Transport:               transport,
+		Username:                cfg.Username,
+		Password:                cfg.Password,
+		HeaderTimeoutPerRequest: 10 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create etcd v2 client: %v", err)
+	}
+
+	result, err := migrate.FromV2(context.Background(), client.NewKeysAPI(c), v3, "/ratchet")
+	fmt.Printf("copied %v keys from %v, skipped %v already in etcd v3, left %v that don't carry over\n", result.Copied, *v2Endpoint, result.Skipped, result.Left)
+	return err
+}
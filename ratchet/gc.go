@@ -0,0 +1,410 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"github.com/dougbtv/ratchet-cni/pkg/vxlan"
+)
+
+// associationRoot holds the association of every pod, by namespace.
+const associationRoot = "/ratchet/association"
+
+// gcReport is what a pass of the garbage collector removed.
+type gcReport struct {
+	// Pods are the pods whose association was removed.
+	Pods []string
+	// Ends and Freed are as vxlan.Collect gives them.
+	Ends  []string
+	Freed []int
+	// Elections are the election keys whose winner was gone.
+	Elections []string
+	// Mirrors are the mirror links removed from our pods, as pod ifname,
+	// since their monitor pod was gone.
+	Mirrors []string
+}
+
+// gc removes what's left in the store of pods on this node that are gone
+// without a DEL, and the VXLAN ids left held by pods gone from any node.
+// It keeps the node's lease alive too, so run it more often than the lease
+// runs out.
+func gc(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	confPath := flags.String("config", defaultConfPath, "ratchet netconf, naming the store to clean up")
+	every := flags.Duration("every", 0, "go again at this interval (like 1m), rather than just once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	netconf, err := loadConfFile(*confPath)
+	if err != nil {
+		return err
+	}
+
+	if err := initStore(netconf); err != nil {
+		return err
+	}
+
+	node, err := netconf.Node()
+	if err != nil {
+		return err
+	}
+
+	for {
+		report, err := collectGarbage(netconf, node)
+		printReport(report)
+
+		if *every <= 0 {
+			return err
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ratchet gc: %v\n", err)
+		}
+
+		time.Sleep(*every)
+	}
+}
+
+func collectGarbage(netconf *config.NetConf, node string) (gcReport, error) {
+	ctx := context.Background()
+	report := gcReport{}
+
+	var lease int64
+	if netconf.LeaseTTLSeconds > 0 {
+		var err error
+		lease, err = store.NodeLease(ctx, stateStore, node, int64(netconf.LeaseTTLSeconds))
+		if err != nil {
+			return report, err
+		}
+	}
+
+	pods, err := associatedPods(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for _, pod := range pods {
+		dead, err := isDeadPod(netconf, node, pod)
+		if err != nil {
+			return report, err
+		}
+		if !dead {
+			continue
+		}
+
+		if err := vxlan.ReleaseAll(ctx, stateStore, pod); err != nil {
+			return report, err
+		}
+
+		if err := clearEtcdAssociation(pod); err != nil {
+			return report, err
+		}
+
+		report.Pods = append(report.Pods, pod)
+	}
+
+	report.Mirrors, err = collectMirrors(netconf, node, pods, lease)
+	if err != nil {
+		return report, err
+	}
+
+	// Now the ends of links held by pods which have no association left,
+	// wherever they were.
+	collected, err := vxlan.Collect(ctx, stateStore, func(pod string) (bool, error) {
+		id, err := associationValue(ctx, pod, "id")
+		return id != "", err
+	})
+	report.Ends = collected.Ends
+	report.Freed = collected.Freed
+	if err != nil {
+		return report, err
+	}
+
+	report.Elections, err = collectElections(ctx)
+	return report, err
+}
+
+// collectElections removes the elections won by pods which have no
+// association left, so that the other end can stand again.
+func collectElections(ctx context.Context) ([]string, error) {
+	kvs, _, err := stateStore.GetPrefix(ctx, config.ElectionsDir+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list elections: %v", err)
+	}
+
+	var removed []string
+	for _, kv := range kvs {
+		id, err := associationValue(ctx, kv.Value, "id")
+		if err != nil {
+			return removed, err
+		}
+		if id != "" {
+			continue
+		}
+
+		// Only if nobody's won it again in the meantime.
+		ok, err := stateStore.Txn(ctx, []store.Cmp{store.ModRevisionIs(kv.Key, kv.ModRevision)}, []store.Op{store.OpDelete(kv.Key)}, nil)
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove election %v: %v", kv.Key, err)
+		}
+
+		if ok {
+			removed = append(removed, kv.Key)
+		}
+	}
+
+	return removed, nil
+}
+
+// collectMirrors removes the mirror links of this node's pods whose monitor
+// pod is gone, so that they stop copying traffic nobody's there to take.
+func collectMirrors(netconf *config.NetConf, node string, pods []string, lease int64) ([]string, error) {
+	ctx := context.Background()
+
+	var removed []string
+	for _, pod := range pods {
+		netns, links, err := podMirrors(netconf, node, pod)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, linki := range links {
+			gone, err := monitorGone(ctx, netconf, linki, lease)
+			if err != nil {
+				return removed, err
+			}
+			if !gone {
+				continue
+			}
+
+			exists, err := linkExists(netns, linki.LocalIFName)
+			if err != nil {
+				return removed, err
+			}
+
+			// Even when the link's already gone with the monitor's veth
+			// end, its filters may not be.
+			if err := removeRatchetLink(netns, linki); err != nil {
+				return removed, err
+			}
+
+			if exists {
+				removed = append(removed, pod+" "+linki.LocalIFName)
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// monitorGone says whether the monitor pod of the mirror link is gone for
+// good, rather than on its way, or away for a while: either its association
+// is gone altogether, the record of the link its primary keeps there and
+// all, as it is once it's had its DEL, or it's been without an id for
+// longer than the node's lease. For the latter, the first time we find it
+// without one is kept with lease.
+func monitorGone(ctx context.Context, netconf *config.NetConf, linki config.LinkInfo, lease int64) (bool, error) {
+	monitor := config.AssociationDir(linki.PairKey())
+	kvs, _, err := stateStore.GetPrefix(ctx, monitor+"/")
+	if err != nil {
+		return false, fmt.Errorf("failed to read association of %v: %v", linki.PairKey(), err)
+	}
+
+	key := monitorGoneKey(linki)
+	for _, kv := range kvs {
+		if kv.Key == monitor+"/id" && kv.Value != "" {
+			// It's here, or back.
+			if err := stateStore.Delete(ctx, key); err != nil {
+				return false, fmt.Errorf("failed to clear %v: %v", key, err)
+			}
+			return false, nil
+		}
+	}
+
+	if len(kvs) == 0 {
+		return true, nil
+	}
+
+	if netconf.LeaseTTLSeconds <= 0 {
+		return false, nil
+	}
+
+	now := time.Now().Unix()
+	first, err := stateStore.Txn(ctx, []store.Cmp{store.Missing(key)}, []store.Op{store.OpPutLease(key, strconv.FormatInt(now, 10), lease)}, nil)
+	if err != nil || first {
+		return false, err
+	}
+
+	kv, err := stateStore.Get(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %v: %v", key, err)
+	}
+
+	since, err := strconv.ParseInt(kv.Value, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("%v is %q, not a time", key, kv.Value)
+	}
+
+	return now-since > int64(netconf.LeaseTTLSeconds), nil
+}
+
+// monitorGoneKey holds when the monitor of the mirror link was first found
+// without an id, in seconds since the epoch, kept with the mirrored pod's
+// association.
+func monitorGoneKey(linki config.LinkInfo) string {
+	return config.AssociationDir(linki.PodKey()) + "/monitorgone/" + linki.LocalIFName
+}
+
+// podMirrors gives the netns and the mirror links of pod, when it's on our
+// node and ratchet has its state.
+func podMirrors(netconf *config.NetConf, node string, pod string) (string, []config.LinkInfo, error) {
+	ctx := context.Background()
+
+	podNode, err := associationValue(ctx, pod, "node")
+	if err != nil || podNode != node {
+		return "", nil, err
+	}
+
+	id, err := associationValue(ctx, pod, "id")
+	if err != nil || id == "" {
+		return "", nil, err
+	}
+
+	netns, err := associationValue(ctx, pod, "netns")
+	if err != nil {
+		return "", nil, err
+	}
+
+	state, err := loadPodState(id, netconf.CNIDir)
+	if err != nil || state == nil {
+		return "", nil, err
+	}
+
+	var mirrors []config.LinkInfo
+	for _, linki := range state.Links {
+		if linki.LinkType() == config.LinkTypeMirror {
+			mirrors = append(mirrors, linki)
+		}
+	}
+
+	return netns, mirrors, nil
+}
+
+// associatedPods lists the pods with an association, as namespace/name.
+func associatedPods(ctx context.Context) ([]string, error) {
+	namespaces, err := stateStore.Children(ctx, associationRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %v", err)
+	}
+
+	var pods []string
+	for _, namespace := range namespaces {
+		names, err := stateStore.Children(ctx, associationRoot+"/"+namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods in namespace %v: %v", namespace, err)
+		}
+
+		for _, name := range names {
+			pods = append(pods, config.QualifiedName(namespace, name))
+		}
+	}
+
+	return pods, nil
+}
+
+// isDeadPod says whether pod is on our node, and gone: its netns is gone, or
+// ratchet has no state for its container, so there'll never be a DEL to
+// clean up after it.
+func isDeadPod(netconf *config.NetConf, node string, pod string) (bool, error) {
+	ctx := context.Background()
+
+	podNode, err := associationValue(ctx, pod, "node")
+	if err != nil || podNode != node {
+		return false, err
+	}
+
+	netns, err := associationValue(ctx, pod, "netns")
+	if err != nil {
+		return false, err
+	}
+
+	if netns != "" {
+		if _, err := os.Stat(netns); os.IsNotExist(err) {
+			return true, nil
+		}
+	}
+
+	id, err := associationValue(ctx, pod, "id")
+	if err != nil || id == "" {
+		// Without an id, the child may still be on its way.
+		return false, err
+	}
+
+	state, err := loadPodState(id, netconf.CNIDir)
+	if err != nil {
+		return false, err
+	}
+
+	return state == nil, nil
+}
+
+// associationValue reads one of the values stored about a pod, giving an
+// empty string when there's no such value. Unlike getAssociation, it tells
+// a missing value from a store we couldn't reach.
+func associationValue(ctx context.Context, pod string, key string) (string, error) {
+	kv, err := stateStore.Get(ctx, config.AssociationDir(pod)+"/"+key)
+	if store.IsKeyNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v of %v: %v", key, pod, err)
+	}
+
+	return kv.Value, nil
+}
+
+func printReport(report gcReport) {
+	for _, pod := range report.Pods {
+		fmt.Printf("removed association of %v\n", pod)
+	}
+
+	for _, end := range report.Ends {
+		fmt.Printf("released vxlan id end %v\n", end)
+	}
+
+	for _, vni := range report.Freed {
+		fmt.Printf("freed vxlan id %v\n", vni)
+	}
+
+	for _, mirror := range report.Mirrors {
+		fmt.Printf("removed mirror link %v\n", mirror)
+	}
+
+	for _, election := range report.Elections {
+		fmt.Printf("removed election %v\n", election)
+	}
+
+	fmt.Printf("removed %v associations, %v mirror links, %v vxlan id ends and %v elections, freed %v vxlan ids\n", len(report.Pods), len(report.Mirrors), len(report.Ends), len(report.Elections), len(report.Freed))
+}
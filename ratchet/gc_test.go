@@ -0,0 +1,258 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"github.com/dougbtv/ratchet-cni/pkg/vxlan"
+	"golang.org/x/net/context"
+)
+
+// useLocalStore points stateStore at a local store in a dir of its own,
+// and gives the netconf and a func to clean it all up.
+func useLocalStore(t *testing.T) (*config.NetConf, func()) {
+	dir, err := ioutil.TempDir("", "ratchet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	netconf := &config.NetConf{StateBackend: store.BackendLocal, CNIDir: dir}
+	if err := initStore(netconf); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return netconf, func() {
+		stateStore = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// associate writes each of the values of pod's association.
+func associate(t *testing.T, pod string, values map[string]string) {
+	for key, value := range values {
+		if err := stateStore.Put(context.Background(), config.AssociationDir(pod)+"/"+key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	netconf, cleanup := useLocalStore(t)
+	defer cleanup()
+
+	// A netns that's still there, and one that's gone.
+	netns := filepath.Join(netconf.CNIDir, "netns")
+	if err := ioutil.WriteFile(netns, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	goneNetns := filepath.Join(netconf.CNIDir, "gone")
+
+	for _, id := range []string{"idlive", "idnonetns"} {
+		if err := savePodState(id, netconf.CNIDir, PodState{Ratcheted: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	associate(t, "default/live", map[string]string{"node": "node1", "netns": netns, "id": "idlive"})
+	associate(t, "default/nonetns", map[string]string{"node": "node1", "netns": goneNetns, "id": "idnonetns"})
+	associate(t, "default/nostate", map[string]string{"node": "node1", "netns": netns, "id": "idnostate"})
+	// Its child hasn't written its id yet.
+	associate(t, "default/noid", map[string]string{"node": "node1", "netns": netns})
+	// It's for node2's garbage collector to say.
+	associate(t, "default/elsewhere", map[string]string{"node": "node2", "netns": goneNetns, "id": "idelsewhere"})
+
+	// The link between live and nostate, which nostate won the election
+	// for, and which nostate holds the other end of.
+	ctx := context.Background()
+	allocator := vxlan.NewAllocator(stateStore, vxlan.BeginningID, vxlan.MaxID)
+	owner := config.LinkDir("default/live", "default/nostate", "")
+	vni, err := allocator.Allocate(ctx, owner, "default/nostate", 0, func(int) []store.Op { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vxlan.Hold(ctx, stateStore, vni, owner, "default/live", 0); err != nil {
+		t.Fatal(err)
+	}
+	election := config.ElectionKey("default/live", "default/nostate", "")
+	if err := stateStore.Put(ctx, election, "default/nostate"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := collectGarbage(netconf, "node1")
+	if err != nil {
+		t.Fatalf("collectGarbage: %v", err)
+	}
+
+	if want := []string{"default/nonetns", "default/nostate"}; !reflect.DeepEqual(report.Pods, want) {
+		t.Errorf("collectGarbage removed associations %v, want %v", report.Pods, want)
+	}
+	if want := []string{election}; !reflect.DeepEqual(report.Elections, want) {
+		t.Errorf("collectGarbage removed elections %v, want %v", report.Elections, want)
+	}
+
+	pods, err := associatedPods(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantPods := []string{"default/elsewhere", "default/live", "default/noid"}; !reflect.DeepEqual(pods, wantPods) {
+		t.Errorf("pods left = %v, want %v", pods, wantPods)
+	}
+
+	// Live's end keeps the VNI from being given back.
+	if _, err := stateStore.Get(ctx, vxlan.FreeKey(vni)); !store.IsKeyNotFound(err) {
+		t.Errorf("vxlan id %v with live's end left: %v, want it still in use", vni, err)
+	}
+}
+
+func TestCollectGarbageEnds(t *testing.T) {
+	netconf, cleanup := useLocalStore(t)
+	defer cleanup()
+
+	// Both ends of the link were on node2, and its garbage collector
+	// has taken their associations away, but not the VNI.
+	ctx := context.Background()
+	allocator := vxlan.NewAllocator(stateStore, vxlan.BeginningID, vxlan.MaxID)
+	owner := config.LinkDir("default/b", "default/a", "")
+	vni, err := allocator.Allocate(ctx, owner, "default/a", 0, func(int) []store.Op { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vxlan.Hold(ctx, stateStore, vni, owner, "default/b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := collectGarbage(netconf, "node1")
+	if err != nil {
+		t.Fatalf("collectGarbage: %v", err)
+	}
+
+	if len(report.Pods) != 0 {
+		t.Errorf("collectGarbage removed associations %v, want none", report.Pods)
+	}
+	if want := []int{vni}; !reflect.DeepEqual(report.Freed, want) {
+		t.Errorf("collectGarbage freed %v, want %v", report.Freed, want)
+	}
+	if len(report.Ends) != 2 {
+		t.Errorf("collectGarbage released ends %v, want both", report.Ends)
+	}
+}
+
+func TestMonitorGone(t *testing.T) {
+	linki := config.LinkInfo{Type: config.LinkTypeMirror, PodName: "watched", PairName: "monitor", LocalIFName: "mirror0"}
+	longAgo := strconv.FormatInt(time.Now().Unix()-60, 10)
+
+	tests := []struct {
+		name string
+		ttl  int
+		// monitor is what's left of the monitor's association, and
+		// goneSince when we first found it without an id, if we have.
+		monitor   map[string]string
+		goneSince string
+		want      bool
+		// wantKept is whether we're to go on keeping when it was first
+		// found without an id.
+		wantKept bool
+	}{
+		{
+			name:    "monitor up",
+			ttl:     30,
+			monitor: map[string]string{"id": "idmonitor", "links/default.watched/vxlanid": "11"},
+		},
+		{
+			name:      "monitor back",
+			ttl:       30,
+			monitor:   map[string]string{"id": "idmonitor"},
+			goneSince: longAgo,
+		},
+		{
+			name: "monitor had its DEL",
+			ttl:  30,
+			want: true,
+		},
+		{
+			name:     "monitor on its way",
+			ttl:      30,
+			monitor:  map[string]string{"links/default.watched/vxlanid": "11"},
+			wantKept: true,
+		},
+		{
+			name:      "monitor away for less than the lease",
+			ttl:       90,
+			monitor:   map[string]string{"links/default.watched/vxlanid": "11"},
+			goneSince: longAgo,
+			wantKept:  true,
+		},
+		{
+			name:      "monitor away for longer than the lease",
+			ttl:       30,
+			monitor:   map[string]string{"links/default.watched/vxlanid": "11"},
+			goneSince: longAgo,
+			want:      true,
+			wantKept:  true,
+		},
+		{
+			name:    "monitor away without leases",
+			monitor: map[string]string{"links/default.watched/vxlanid": "11"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			netconf, cleanup := useLocalStore(t)
+			defer cleanup()
+			netconf.LeaseTTLSeconds = tt.ttl
+
+			ctx := context.Background()
+			var lease int64
+			if tt.ttl > 0 {
+				var err error
+				lease, err = store.NodeLease(ctx, stateStore, "node1", int64(tt.ttl))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			associate(t, "default/monitor", tt.monitor)
+			if tt.goneSince != "" {
+				if err := stateStore.Put(ctx, monitorGoneKey(linki), tt.goneSince); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			gone, err := monitorGone(ctx, netconf, linki, lease)
+			if err != nil {
+				t.Fatalf("monitorGone: %v", err)
+			}
+			if gone != tt.want {
+				t.Errorf("monitorGone = %v, want %v", gone, tt.want)
+			}
+
+			_, err = stateStore.Get(ctx, monitorGoneKey(linki))
+			if kept := err == nil; kept != tt.wantKept {
+				t.Errorf("kept when the monitor was first found gone = %v (%v), want %v", kept, err, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/vishvananda/netlink"
+)
+
+// mirrorQdiscs are the handles of the qdiscs koko hangs mirror filters
+// off: the ingress qdisc for ingress, and the root prio qdisc for egress.
+var mirrorQdiscs = []uint32{
+	netlink.MakeHandle(0xffff, 0),
+	netlink.MakeHandle(1, 0),
+}
+
+// unmirror removes the tc filters copying the mirrored interface's traffic
+// to our end of the mirror link, along with any left copying it to
+// interfaces that are gone. It does nothing for other links.
+func unmirror(netns string, linki config.LinkInfo) error {
+	if linki.LinkType() != config.LinkTypeMirror || netns == "" {
+		return nil
+	}
+
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		source, err := netlink.LinkByName(linki.MirrorIFName)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dest := 0
+		if link, err := netlink.LinkByName(linki.LocalIFName); err == nil {
+			dest = link.Attrs().Index
+		}
+
+		return removeMirrorFilters(source, dest)
+	})
+
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to stop mirroring %v to %v: %v", linki.MirrorIFName, linki.LocalIFName, err)
+	}
+
+	return nil
+}
+
+// removeMirrorFilters removes source's filters mirroring to dest, or to an
+// interface that's gone.
+func removeMirrorFilters(source netlink.Link, dest int) error {
+	qdiscs, err := netlink.QdiscList(source)
+	if err != nil {
+		return err
+	}
+
+	for _, qdisc := range qdiscs {
+		if !isMirrorQdisc(qdisc) {
+			continue
+		}
+
+		filters, err := netlink.FilterList(source, qdisc.Attrs().Handle)
+		if err != nil {
+			return err
+		}
+
+		for _, filter := range filters {
+			if !mirrorsTo(filter, dest) {
+				continue
+			}
+			if err := netlink.FilterDel(filter); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func isMirrorQdisc(qdisc netlink.Qdisc) bool {
+	for _, handle := range mirrorQdiscs {
+		if qdisc.Attrs().Handle == handle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mirrorsTo says whether filter mirrors to the interface dest, or to one
+// that's gone.
+func mirrorsTo(filter netlink.Filter, dest int) bool {
+	u32, ok := filter.(*netlink.U32)
+	if !ok {
+		return false
+	}
+
+	for _, action := range u32.Actions {
+		mirred, ok := action.(*netlink.MirredAction)
+		if !ok || mirred.MirredAction != netlink.TCA_EGRESS_MIRROR {
+			continue
+		}
+
+		if mirred.Ifindex == dest {
+			return true
+		}
+
+		if _, err := netlink.LinkByIndex(mirred.Ifindex); err != nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -23,67 +23,56 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	// "reflect"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
 	"golang.org/x/net/context"
 
 	"github.com/davecgh/go-spew/spew"
 	dockerclient "github.com/docker/docker/client"
-	// "github.com/redhat-nfvpe/koko"
-	"github.com/coreos/etcd/client"
+	"github.com/dougbtv/ratchet-cni/pkg/config"
+	"github.com/dougbtv/ratchet-cni/pkg/kube"
+	"github.com/dougbtv/ratchet-cni/pkg/logging"
+	"github.com/dougbtv/ratchet-cni/pkg/store"
+	"github.com/dougbtv/ratchet-cni/pkg/vxlan"
+	koko "github.com/redhat-nfvpe/koko/api"
 )
 
 const defaultCNIDir = "/var/lib/cni/multus"
 
-// DEBUG Set to enable some debugging output
-const DEBUG = true
+// defaultLinkWaitSeconds is how long wait_for_links waits, unless configured.
+const defaultLinkWaitSeconds = 60
 
-// PerformDelete tell us to actually do anything on CNI delete instruction (not implemented, yet)
-const PerformDelete = false
+// linkWaitPerSecond is how many times a second we look for the link.
+const linkWaitPerSecond = 4
 
-var kapi client.KeysAPI
+var stateStore store.Store
 
-var logger = log.New(os.Stderr, "", 0)
+// logger goes to stderr until we've read the netconf.
+var logger = logging.Default("ratchet")
 
 var masterpluginEnabled bool
 
-// NetConf is our network configuration as passed in as json
-type NetConf struct {
-	types.NetConf
-	CNIDir      string                 `json:"cniDir"`
-	Delegate    map[string]interface{} `json:"delegate"`
-	EtcdHost    string                 `json:"etcd_host"`
-	EtcdPort    string                 `json:"etcd_port"`
-	UseLabels   bool                   `json:"use_labels"`
-	ChildPath   string                 `json:"child_path"`
-	BootNetwork map[string]interface{} `json:"boot_network"`
-	ParentIface string                 `json:"parent_interface"`
-	ParentAddr  string                 `json:"parent_address"`
-}
-
-// LinkInfo defines the paid of links we're going to create
-type LinkInfo struct {
-	PodName         string
-	TargetPod       string
-	TargetContainer string
-	PublicIP        string
-	LocalIP         string
-	LocalIFName     string
-	PairName        string
-	PairIP          string
-	PairIFName      string
-	Primary         string
-}
-
-//taken from cni/plugins/meta/flannel/flannel.go
+// PodState is what we remember about a pod between ADD and DEL (or CHECK).
+type PodState struct {
+	Ratcheted      bool
+	Links          []config.LinkInfo
+	DelegateResult json.RawMessage
+}
+
+// taken from cni/plugins/meta/flannel/flannel.go
 func isString(i interface{}) bool {
 	_, ok := i.(string)
 	return ok
@@ -94,8 +83,8 @@ func isBool(i interface{}) bool {
 	return ok
 }
 
-func loadNetConf(bytes []byte) (*NetConf, error) {
-	netconf := &NetConf{}
+func loadNetConf(bytes []byte) (*config.NetConf, error) {
+	netconf := &config.NetConf{}
 	if err := json.Unmarshal(bytes, netconf); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
@@ -111,10 +100,46 @@ func loadNetConf(bytes []byte) (*NetConf, error) {
 		netconf.CNIDir = defaultCNIDir
 	}
 
+	if netconf.LinkWaitSeconds <= 0 {
+		netconf.LinkWaitSeconds = defaultLinkWaitSeconds
+	}
+
+	if netconf.VxlanIDRange == nil {
+		netconf.VxlanIDRange = &config.VxlanIDRange{Start: vxlan.BeginningID, End: vxlan.MaxID}
+	}
+
+	if err := vxlan.CheckRange(netconf.VxlanIDRange.Start, netconf.VxlanIDRange.End); err != nil {
+		return nil, fmt.Errorf("bad vxlan_id_range: %v", err)
+	}
+
+	if err := config.ValidateMTU(netconf.MTU); err != nil {
+		return nil, err
+	}
+
+	// Newer runtimes won't CHECK a delegate which doesn't declare a version.
+	inheritNetConf(netconf, netconf.Delegate)
+	inheritNetConf(netconf, netconf.BootNetwork)
+
 	return netconf, nil
 
 }
 
+// inheritNetConf fills in the name and cniVersion of a delegate from our own
+// config, unless the delegate sets them itself.
+func inheritNetConf(netconf *config.NetConf, delegate map[string]interface{}) {
+	if delegate == nil {
+		return
+	}
+
+	if _, ok := delegate["name"]; !ok && netconf.Name != "" {
+		delegate["name"] = netconf.Name
+	}
+
+	if _, ok := delegate["cniVersion"]; !ok && netconf.CNIVersion != "" {
+		delegate["cniVersion"] = netconf.CNIVersion
+	}
+}
+
 func saveScratchNetConf(containerID, dataDir string, netconf []byte) error {
 	if err := os.MkdirAll(dataDir, 0700); err != nil {
 		return fmt.Errorf("failed to create the multus data directory(%q): %v", dataDir, err)
@@ -142,6 +167,57 @@ func consumeScratchNetConf(containerID, dataDir string) ([]byte, error) {
 	return data, err
 }
 
+func savePodState(containerID, dataDir string, state PodState) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error serializing pod state: %v", err)
+	}
+
+	return saveScratchNetConf(containerID, dataDir, stateBytes)
+}
+
+// savePodResult records the delegate's result, so we can hand it back to the
+// delegate as its prevResult on CHECK.
+func savePodResult(containerID, dataDir string, state PodState, result types.Result) error {
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("error serializing delegate result: %v", err)
+	}
+
+	state.DelegateResult = resultBytes
+	return savePodState(containerID, dataDir, state)
+}
+
+// loadPodState returns nil (and no error) when there's no state saved for the
+// container, e.g. when DEL has already run once.
+func loadPodState(containerID, dataDir string) (*PodState, error) {
+	path := filepath.Join(dataDir, containerID)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container data in the path(%q): %v", path, err)
+	}
+
+	state := &PodState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to load pod state in the path(%q): %v", path, err)
+	}
+
+	return state, nil
+}
+
+func removePodState(containerID, dataDir string) error {
+	err := os.Remove(filepath.Join(dataDir, containerID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
 func getifname() (f func() string) {
 	var interfaceIndex int
 	f = func() string {
@@ -204,22 +280,22 @@ func isMasterplugin(netconf map[string]interface{}) bool {
 }
 
 // !bang
-func delegateAdd(podif func() string, argif string, netconf map[string]interface{}, onlyMaster bool) (bool, error) {
+func delegateAdd(podif func() string, argif string, netconf map[string]interface{}, onlyMaster bool) (types.Result, error) {
 	netconfBytes, err := json.Marshal(netconf)
 	if err != nil {
-		return true, fmt.Errorf("Ratchet: error serializing multus delegate netconf: %v", err)
+		return nil, fmt.Errorf("Ratchet: error serializing multus delegate netconf: %v", err)
 	}
 
 	if os.Setenv("CNI_IFNAME", argif) != nil {
-		return true, fmt.Errorf("Ratchet: error in setting CNI_IFNAME")
+		return nil, fmt.Errorf("Ratchet: error in setting CNI_IFNAME")
 	}
 
-	result, err := invoke.DelegateAdd(netconf["type"].(string), netconfBytes)
+	result, err := invoke.DelegateAdd(context.Background(), netconf["type"].(string), netconfBytes, nil)
 	if err != nil {
-		return true, fmt.Errorf("Ratchet: error in invoke Delegate add - %q: %v", netconf["type"].(string), err)
+		return nil, fmt.Errorf("Ratchet: error in invoke Delegate add - %q: %v", netconf["type"].(string), err)
 	}
 
-	return false, result.Print()
+	return result, nil
 
 }
 
@@ -229,17 +305,12 @@ func delegateDel(podif func() string, argif string, netconf map[string]interface
 		return fmt.Errorf("Ratchet: error serializing multus delegate netconf: %v", err)
 	}
 
-	if !isMasterplugin(netconf) {
-		if os.Setenv("CNI_IFNAME", podif()) != nil {
-			return fmt.Errorf("Ratchet: error in setting CNI_IFNAME")
-		}
-	} else {
-		if os.Setenv("CNI_IFNAME", argif) != nil {
-			return fmt.Errorf("Ratchet: error in setting CNI_IFNAME")
-		}
+	// Mirror delegateAdd, which always hands the delegate the runtime's ifname.
+	if os.Setenv("CNI_IFNAME", argif) != nil {
+		return fmt.Errorf("Ratchet: error in setting CNI_IFNAME")
 	}
 
-	err = invoke.DelegateDel(netconf["type"].(string), netconfBytes)
+	err = invoke.DelegateDel(context.Background(), netconf["type"].(string), netconfBytes, nil)
 	if err != nil {
 		return fmt.Errorf("Ratchet: error in invoke Delegate del - %q: %v", netconf["type"].(string), err)
 	}
@@ -247,23 +318,91 @@ func delegateDel(podif func() string, argif string, netconf map[string]interface
 	return err
 }
 
-func clearPlugins(mIdx int, pIdx int, argIfname string, delegates []map[string]interface{}) error {
+// isNotFound says whether err is a delegate saying what it was to remove
+// isn't there, which for DEL is as good as done.
+func isNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "no such") || strings.Contains(msg, "does not exist")
+}
+
+// podMetadata gets the pod's labels and annotations: from the Kubernetes API
+// when we've a kubeconfig, and otherwise from the labels dockershim copies
+// onto the infra container.
+func podMetadata(netconf *config.NetConf, args *skel.CmdArgs) (map[string]string, map[string]string, error) {
 
-	if os.Setenv("CNI_COMMAND", "DEL") != nil {
-		return fmt.Errorf("Ratchet: error in setting CNI_COMMAND to DEL")
+	if netconf.Kubeconfig == "" {
+		labels, err := dockerLabels(args.ContainerID)
+		return labels, nil, err
 	}
 
-	podifName := getifname()
-	r := delegateDel(podifName, argIfname, delegates[mIdx])
-	if r != nil {
-		return r
+	namespace, name, err := kube.PodArgs(args.Args)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	for idx := 0; idx < pIdx && idx != mIdx; idx++ {
-		r := delegateDel(podifName, argIfname, delegates[idx])
-		if r != nil {
-			return r
-		}
+	// Not a pod, so nothing in the API to tell us it's eligible.
+	if name == "" {
+		return nil, nil, nil
+	}
+
+	logger = logger.WithField("pod", namespace+"/"+name)
+
+	kc, err := kube.NewClient(netconf.Kubeconfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pod, err := kc.GetPod(namespace, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pod.Metadata.Labels, pod.Metadata.Annotations, nil
+
+}
+
+func dockerLabels(containerid string) (map[string]string, error) {
+
+	ctx := context.Background()
+	cli, errDocker := dockerclient.NewEnvClient()
+	if errDocker != nil {
+		return nil, fmt.Errorf("failed to create docker client (set kubeconfig to use the Kubernetes API instead): %v", errDocker)
+	}
+
+	// cli.UpdateClientVersion("1.24")
+	cli.NegotiateAPIVersion(ctx)
+
+	json, dockerclienterr := cli.ContainerInspect(ctx, containerid)
+	if dockerclienterr != nil {
+		return nil, fmt.Errorf("Dockerclient err: %v", dockerclienterr)
+	}
+
+	return json.Config.Labels, nil
+
+}
+
+func delegateCheck(argif string, netconf map[string]interface{}, prevResult json.RawMessage) error {
+	// The delegate wants to see its own result from ADD, not ours.
+	checkconf := make(map[string]interface{})
+	for k, v := range netconf {
+		checkconf[k] = v
+	}
+	if len(prevResult) > 0 {
+		checkconf["prevResult"] = prevResult
+	}
+
+	netconfBytes, err := json.Marshal(checkconf)
+	if err != nil {
+		return fmt.Errorf("Ratchet: error serializing delegate netconf: %v", err)
+	}
+
+	if os.Setenv("CNI_IFNAME", argif) != nil {
+		return fmt.Errorf("Ratchet: error in setting CNI_IFNAME")
+	}
+
+	err = invoke.DelegateCheck(context.Background(), netconf["type"].(string), netconfBytes, nil)
+	if err != nil {
+		return fmt.Errorf("Ratchet: error in invoke Delegate check - %q: %v", netconf["type"].(string), err)
 	}
 
 	return nil
@@ -273,9 +412,11 @@ func clearPlugins(mIdx int, pIdx int, argIfname string, delegates []map[string]i
 // 	return delresult.Print()
 // }
 
-func ratchet(netconf *NetConf, argif string, containerid string) error {
+func ratchet(netconf *config.NetConf, args *skel.CmdArgs) (types.Result, error) {
+
+	argif := args.IfName
+	containerid := args.ContainerID
 
-	var result error
 	// Alright first few things:
 	// 1. Here is where I'd add that we check the k8s api
 	//    in order to see if there's a label that makes this applicable to ratcheting.
@@ -290,62 +431,42 @@ func ratchet(netconf *NetConf, argif string, containerid string) error {
 
 	// This is a weak check, fwiw.
 	if err := checkDelegate(netconf.Delegate); err != nil {
-		return fmt.Errorf("Ratchet delegate: Err in delegate conf: %v", err)
+		return nil, fmt.Errorf("Ratchet delegate: Err in delegate conf: %v", err)
 	}
 
 	if err := checkDelegate(netconf.BootNetwork); err != nil {
-		return fmt.Errorf("Ratchet BootNetwork: Err in delegate conf: %v", err)
+		return nil, fmt.Errorf("Ratchet BootNetwork: Err in delegate conf: %v", err)
 	}
 
 	podifName := getifname()
 
 	// ------------------------ Check label
-	ctx := context.Background()
-	cli, errDocker := dockerclient.NewEnvClient()
-	if errDocker != nil {
-		panic(errDocker)
-	}
-
-	// cli.UpdateClientVersion("1.24")
-	cli.NegotiateAPIVersion(ctx)
-
-	json, dockerclienterr := cli.ContainerInspect(ctx, containerid)
-	if dockerclienterr != nil {
-		return fmt.Errorf("Dockerclient err: %v", dockerclienterr)
+	labels, annotations, err := podMetadata(netconf, args)
+	if err != nil {
+		return nil, err
 	}
 
-	logger.Printf("DOUG !trace json >>>>>>>>>>>>>>>>>>>>>----------%v\n", json.Config.Labels)
+	logger.Debugf("pod labels: %v / annotations: %v", labels, annotations)
 
 	// ------------------------ Determine container eligibility.
 
-	if _, useRatchet := json.Config.Labels["ratchet"]; useRatchet {
-
-		logger.Println("USE RATCHET ----------------------->>>>>>>>>>>>>>>")
-		// We want to use the ratchet "boot_network"
-		// !bang
-		err, r := delegateAdd(podifName, argif, netconf.BootNetwork, false)
-		if err != true {
-			result = r
-		} else if (err != false) && r != nil {
-			logger.Printf("ratchet delegateAdd boot_network error ----------%v / %v", err, r)
-			return r
-		}
-
-	} else {
+	if !config.IsEligible(labels, annotations) {
 
 		// We used to switch here depending on the use_labels flag, which is seemingly obsolete.
 		// But, now, we just use the delegate.
-		// var mIndex int
-		logger.Println("DO NOT USE RATCHET (passthrough)----------------------->>>>>>>>>>>>>>>")
-		err, r := delegateAdd(podifName, argif, netconf.Delegate, false)
-		if err != true {
-			result = r
-		} else if (err != false) && r != nil {
-			logger.Printf("ratchet delegateAdd passthrough error ----------%v", err)
-			return r
+		logger.Info("not eligible for ratchet, passing through to the delegate")
+		state := PodState{Ratcheted: false}
+		if err := savePodState(containerid, netconf.CNIDir, state); err != nil {
+			return nil, err
+		}
+
+		result, err := delegateAdd(podifName, argif, netconf.Delegate, false)
+		if err != nil {
+			logger.Errorf("delegateAdd passthrough error: %v", err)
+			return nil, err
 		}
 
-		return r
+		return result, savePodResult(containerid, netconf.CNIDir, state, result)
 
 	}
 
@@ -353,89 +474,739 @@ func ratchet(netconf *NetConf, argif string, containerid string) error {
 
 	// Populate all the possible link info.
 
-	linki := LinkInfo{}
-	linki.PodName = json.Config.Labels["ratchet.pod_name"]
-	linki.TargetPod = json.Config.Labels["ratchet.target_pod"]
-	linki.TargetContainer = json.Config.Labels["ratchet.target_container"]
-	linki.PublicIP = json.Config.Labels["ratchet.public_ip"]
-	linki.LocalIP = json.Config.Labels["ratchet.local_ip"]
-	linki.LocalIFName = json.Config.Labels["ratchet.local_ifname"]
-	linki.PairName = json.Config.Labels["ratchet.pair_name"]
-	linki.PairIP = json.Config.Labels["ratchet.pair_ip"]
-	linki.PairIFName = json.Config.Labels["ratchet.pair_ifname"]
-	linki.Primary = json.Config.Labels["ratchet.primary"]
-
-	dumpLinki := spew.Sdump(linki)
-	logger.Printf("...............DOUG !trace linki ----------%v\n", dumpLinki)
+	links, err := podLinks(netconf, args, labels, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	logger = logger.WithField("pod_name", links[0].PodKey())
+	logger.Infof("eligible for ratchet with %v link(s), using the boot_network", len(links))
+
+	// Remember the links before we touch anything, so DEL can undo it all.
+	state := PodState{Ratcheted: true, Links: links}
+	if err := savePodState(containerid, netconf.CNIDir, state); err != nil {
+		return nil, err
+	}
+
+	// We want to use the ratchet "boot_network"
+	result, err := delegateAdd(podifName, argif, netconf.BootNetwork, false)
+	if err != nil {
+		logger.Errorf("delegateAdd boot_network error: %v", err)
+		return nil, err
+	}
+
+	if err := savePodResult(containerid, netconf.CNIDir, state, result); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("link info: %v", spew.Sdump(links))
 
 	// Spawn external process.
-	// ...pass tons of link info along with some basics.
-
-	logger.Printf("executing path: %v / argif: %v / containerID: %v / etcd_host: %v", netconf.ChildPath, argif, containerid, netconf.EtcdHost)
-	// exec_string := netconf.ChildPath + " " + argif + " " + containerid + " " + netconf.EtcdHost
-	// logger.Printf("executing path composite: %v",exec_string);
-	cmd := exec.Command(
-		netconf.ChildPath, // 0
-		argif,             // 1
-		containerid,
-		netconf.EtcdHost,
-		netconf.EtcdPort,
-		linki.PodName,
-		linki.TargetPod,
-		linki.TargetContainer,
-		linki.PublicIP,
-		linki.LocalIP,
-		linki.LocalIFName,
-		linki.PairName,
-		linki.PairIP,
-		linki.PairIFName,
-		linki.Primary,
-		netconf.ParentIface,
-		netconf.ParentAddr,
-	)
-	cmd.Start()
-
-	logger.Println("COMPLETE RATCHET CHILD???? ----------------------->>>>>>>>>>>>>>>")
+	// ...and hand it everything it needs to know, in a spool file.
 
-	return result
+	handoff := config.NewHandoff(netconf, links, config.CNIArgs{
+		ContainerID: containerid,
+		Netns:       args.Netns,
+		IfName:      argif,
+		Args:        args.Args,
+		Path:        args.Path,
+	})
+
+	handoffPath, err := config.WriteHandoff(handoff)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("executing path: %v / handoff: %v", netconf.ChildPath, handoffPath)
+	cmd := exec.Command(netconf.ChildPath, handoffPath)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ratchet-child %v: %v", netconf.ChildPath, err)
+	}
+
+	logger.Info("ratchet-child started")
+
+	if !netconf.WaitForLinks {
+		return result, nil
+	}
+
+	return linkResult(netconf, args.Netns, links, result)
 
 }
 
+// linkResult waits for ratchet-child (or our primaries) to create the links
+// in our netns, then merges them into the boot_network result.
+func linkResult(netconf *config.NetConf, netns string, links []config.LinkInfo, bootResult types.Result) (types.Result, error) {
+
+	if err := initStore(netconf); err != nil {
+		return nil, err
+	}
+
+	// The links come up side by side, so they share the one deadline.
+	deadline := time.Now().Add(time.Duration(netconf.LinkWaitSeconds) * time.Second)
+
+	ifnames := make([]string, 0, len(links))
+	for _, linki := range links {
+		ifname, err := waitForLink(netns, linki, deadline)
+		if err != nil {
+			return nil, fmt.Errorf("%v (waited %v seconds)", err, netconf.LinkWaitSeconds)
+		}
+		ifnames = append(ifnames, ifname)
+	}
+
+	result, err := current.NewResultFromResult(bootResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert boot_network result: %v", err)
+	}
+
+	if netconf.CNIVersion != "" {
+		result.CNIVersion = netconf.CNIVersion
+	}
+
+	for _, ifname := range ifnames {
+		err = ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+			return appendLink(result, netns, ifname)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect link %v in %v: %v", ifname, netns, err)
+		}
+	}
+
+	return result, nil
+
+}
+
+// waitForLink polls our netns until the link's interface is ready, and
+// returns its name. ratchet-child sets the interface's addresses, MTU and
+// MAC once it's made it, so it's ready when it's up with its addresses and
+// MAC, not as soon as it's there.
+func waitForLink(netns string, linki config.LinkInfo, deadline time.Time) (string, error) {
+
+	var notready error
+	for {
+
+		end := ourEnd(linki)
+
+		if end.ifname != "" {
+			notready = linkReady(netns, linki, end)
+			if notready == nil {
+				return end.ifname, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(time.Second / linkWaitPerSecond)
+
+	}
+
+	// Say so when it's our labels that kept the link from forming.
+	if err := linki.RoleConflict(peerRole(linki)); err != nil {
+		return "", err
+	}
+
+	if notready != nil {
+		return "", fmt.Errorf("Timeout: ratchet link %v for %v is not ready in %v: %v", linkName(linki), linki.PodKey(), netns, notready)
+	}
+
+	return "", fmt.Errorf("Timeout: ratchet link %v for %v did not appear in %v", linkName(linki), linki.PodKey(), netns)
+
+}
+
+// linkReady says what, if anything, our end of the link still lacks.
+func linkReady(netns string, linki config.LinkInfo, end linkEnd) error {
+
+	addrs, err := config.ParseLinkAddrs(end.ip)
+	if err != nil {
+		return err
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+
+	mac, err := end.hardwareAddr(linki)
+	if err != nil {
+		return err
+	}
+
+	return ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(end.ifname)
+		if err != nil {
+			return fmt.Errorf("ratchet link %v is missing: %v", end.ifname, err)
+		}
+
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("ratchet link %v is down", end.ifname)
+		}
+
+		if mac != nil && link.Attrs().HardwareAddr.String() != mac.String() {
+			return fmt.Errorf("ratchet link %v has MAC %v, not %v", end.ifname, link.Attrs().HardwareAddr, mac)
+		}
+
+		return checkLinkAddrs(end.ifname, ips)
+	})
+
+}
+
+// appendLink adds the interface (which must be in the current netns) and its
+// addresses to the result.
+func appendLink(result *current.Result, netns string, ifname string) error {
+
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	result.Interfaces = append(result.Interfaces, &current.Interface{
+		Name:    ifname,
+		Mac:     link.Attrs().HardwareAddr.String(),
+		Sandbox: netns,
+	})
+	ifindex := len(result.Interfaces) - 1
+
+	for _, addr := range addrs {
+		// Skip the link-local addresses the kernel assigns by itself.
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Interface: current.Int(ifindex),
+			Address:   *addr.IPNet,
+		})
+	}
+
+	return nil
+
+}
+
+// setupLogging swaps our stderr logger for the one the netconf asks for.
+func setupLogging(netconf *config.NetConf, args *skel.CmdArgs) error {
+	l, err := logging.New("ratchet", netconf.LogLevel, netconf.LogFile)
+	if err != nil {
+		return err
+	}
+
+	logger = l.WithField("container_id", args.ContainerID)
+	return nil
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 
-	var result error
 	n, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	if err := setupLogging(n, args); err != nil {
+		return err
+	}
+
 	// Pass a pointer to the NetConf type.
 	// logger.Println(reflect.TypeOf(n))
-	rerr := ratchet(n, args.IfName, args.ContainerID)
+	result, rerr := ratchet(n, args)
 	if rerr != nil {
-		logger.Printf("Ratchet error from cmdAdd handler: %v", rerr)
+		logger.Errorf("Ratchet error from cmdAdd handler: %v", rerr)
 		return rerr
 	}
 
-	return result
+	return types.PrintResult(result, n.CNIVersion)
 
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	var result error
 	in, err := loadNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	if PerformDelete {
-		result = ratchet(in, args.IfName, args.ContainerID)
+	if err := setupLogging(in, args); err != nil {
+		return err
+	}
+
+	state, err := loadPodState(args.ContainerID, in.CNIDir)
+	if err != nil {
+		return err
+	}
+
+	// Nothing saved means we never got this far in ADD, or DEL already ran.
+	// The delegate may have set the pod up all the same, so it gets its
+	// DEL, and what it never set up, or has already let go, it won't find.
+	if state == nil {
+		if err := delegateDel(getifname(), args.IfName, in.Delegate); err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	if !state.Ratcheted {
+		if err := delegateDel(getifname(), args.IfName, in.Delegate); err != nil {
+			return err
+		}
+		return removePodState(args.ContainerID, in.CNIDir)
 	}
 
-	// TODO: This doesn't perform any cleanup.
-	// r := delegateDel(podifName, args.IfName, delegate)
+	// The boot network goes whatever becomes of our links, so an etcd we
+	// can't reach doesn't leave the pod's network behind. We keep the pod's
+	// state when the links fail, so the kubelet's next DEL tries them again.
+	errlinks := initStore(in)
+	if errlinks == nil {
+		errlinks = removeRatchetLinks(args.Netns, state.Links)
+	}
+	if errlinks != nil {
+		logger.Errorf("DEL ERROR: failed to remove ratchet links: %v", errlinks)
+	}
 
-	return result
+	if err := delegateDel(getifname(), args.IfName, in.BootNetwork); err != nil {
+		return err
+	}
+
+	if errlinks != nil {
+		return errlinks
+	}
+
+	// The child removes its handoff once it's read it, unless it never ran.
+	if err := os.Remove(config.HandoffPath(in.CNIDir, args.ContainerID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return removePodState(args.ContainerID, in.CNIDir)
+}
+
+// removeRatchetLinks deletes our ends of the links, and all we told etcd
+// about them.
+func removeRatchetLinks(netns string, links []config.LinkInfo) error {
+	if len(links) == 0 {
+		return nil
+	}
+
+	for _, linki := range links {
+		if err := removeRatchetLink(netns, linki); err != nil {
+			return err
+		}
+
+		// Whoever comes back in our place stands for election afresh.
+		if linki.Role() == config.RoleElect {
+			key := config.ElectionKey(linki.PodKey(), linki.PairKey(), linki.Name)
+			if err := stateStore.Delete(context.Background(), key); err != nil {
+				return fmt.Errorf("failed to clear election of link %v: %v", linkName(linki), err)
+			}
+		}
+	}
+
+	// Our ends are gone, so our vxlan ids can go back once the far ends are too.
+	if err := vxlan.ReleaseAll(context.Background(), stateStore, links[0].PodKey()); err != nil {
+		return err
+	}
+
+	return clearEtcdAssociation(links[0].PodKey())
+}
+
+// removeRatchetLink deletes our end of the link from the pod's netns.
+// Deleting a veth end takes the peer with it; for vxlan the far side
+// cleans up its own end on its own DEL, and a vlan has no far side. Either
+// way, a missing link or netns means there's nothing left for us to do.
+func removeRatchetLink(netns string, linki config.LinkInfo) error {
+	if netns == "" {
+		return nil
+	}
+
+	// Stop copying traffic to a mirror link before it goes.
+	if err := unmirror(netns, linki); err != nil {
+		return err
+	}
+
+	ifname := linkIFName(linki)
+	if ifname == "" {
+		return nil
+	}
+
+	exists, err := linkExists(netns, ifname)
+	if err != nil || !exists {
+		return err
+	}
+
+	veth := koko.VEth{}
+	veth.NsName = netns
+	veth.LinkName = ifname
+	if err := veth.RemoveVethLink(); err != nil {
+		return fmt.Errorf("failed to remove link %v in %v: %v", ifname, netns, err)
+	}
+
+	return nil
+}
+
+func linkExists(netns string, ifname string) (bool, error) {
+	exists := false
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		_, err := netlink.LinkByName(ifname)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return err
+		}
+		exists = true
+		return nil
+	})
+
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return false, nil
+	}
+
+	return exists, err
+}
+
+// getAssociation reads one of the values stored about a pod (given as
+// namespace/name) in etcd, giving an empty string when there's no such value.
+func getAssociation(podname string, key string) string {
+	kv, err := stateStore.Get(context.Background(), config.AssociationDir(podname)+"/"+key)
+	if err != nil {
+		return ""
+	}
+
+	return kv.Value
+}
+
+// linkDir is where the primary of a link stores what the pair needs to know
+// about it. When the pair doesn't know who its primary is, it's the link of
+// the same name that the primary told it of.
+func linkDir(linki config.LinkInfo) string {
+	if linki.PairName != "" {
+		return config.LinkDir(linki.PodKey(), linki.PairKey(), linki.Name)
+	}
+
+	links, err := stateStore.Children(context.Background(), config.LinksDir(linki.PodKey()))
+	if err != nil {
+		return ""
+	}
+
+	return config.FindLinkDir(linki.PodKey(), links, linki.Name)
+}
+
+// getLinkAssociation reads the values the primary of a link stored for the
+// pair, all at once, by name. It's empty when there are none.
+func getLinkAssociation(linki config.LinkInfo) map[string]string {
+	values := make(map[string]string)
+
+	dir := linkDir(linki)
+	if dir == "" {
+		return values
+	}
+
+	kvs, _, err := stateStore.GetPrefix(context.Background(), dir+"/")
+	if err != nil {
+		return values
+	}
+
+	for _, kv := range kvs {
+		values[strings.TrimPrefix(kv.Key, dir+"/")] = kv.Value
+	}
+
+	return values
+}
+
+// linkIFName is the name of our end of the link; the pair learns it from
+// the primary via etcd.
+func linkIFName(linki config.LinkInfo) string {
+	if linki.LocalIFName != "" {
+		return linki.LocalIFName
+	}
+
+	return getLinkAssociation(linki)["pairifname"]
+}
+
+// linkEnd is what our end of a link should be: its interface, addresses and
+// MAC (when one was asked for), and the pod at the other end.
+type linkEnd struct {
+	ifname string
+	ip     string
+	mac    string
+	peer   string
+}
+
+// ourEnd is what our end of the link should be. The end that built the link
+// knows; the pair learns it from the primary via etcd.
+func ourEnd(linki config.LinkInfo) linkEnd {
+	end := linkEnd{ifname: linki.LocalIFName, ip: linki.LocalIP, mac: linki.LocalMAC, peer: linki.PairKey()}
+
+	if linki.HasPair() && !isLeader(linki) {
+		link := getLinkAssociation(linki)
+		end.ifname = link["pairifname"]
+		end.ip = link["pairip"]
+		end.peer = link["primaryname"]
+		if link["pairmac"] != "" {
+			end.mac = link["pairmac"]
+		}
+	}
+
+	return end
+}
+
+// hardwareAddr is the MAC ratchet-child gives our end, nil when it leaves
+// the interface's own MAC alone, as for a passthru macvlan that wasn't
+// given one.
+func (end linkEnd) hardwareAddr(linki config.LinkInfo) (net.HardwareAddr, error) {
+	if linki.LinkType() == config.LinkTypeMacvlan && linki.Mode() == config.MacvlanPassthru && end.mac == "" {
+		return nil, nil
+	}
+
+	return config.LinkMAC(end.mac, linki.PodKey(), end.ifname)
+}
+
+// peerRole is the role the peer we name takes for the link, as it told us
+// via etcd. It's empty when the peer isn't up, or doesn't name us.
+func peerRole(linki config.LinkInfo) string {
+	if linki.PairName == "" {
+		return ""
+	}
+
+	kv, err := stateStore.Get(context.Background(), config.PeerDir(linki.PairKey(), linki.PodKey(), linki.Name)+"/role")
+	if err != nil {
+		return ""
+	}
+
+	return kv.Value
+}
+
+// isLeader says whether our end built the link: it did when it's labelled
+// primary, or when it won the link's election.
+func isLeader(linki config.LinkInfo) bool {
+	switch linki.Role() {
+	case config.RolePrimary:
+		return true
+	case config.RoleElect:
+		kv, err := stateStore.Get(context.Background(), config.ElectionKey(linki.PodKey(), linki.PairKey(), linki.Name))
+		return err == nil && kv.Value == linki.PodKey()
+	}
+
+	return false
+}
+
+// linkName names a link in errors and logs.
+func linkName(linki config.LinkInfo) string {
+	if !linki.HasPair() {
+		return linki.LinkType() + " " + linki.LocalIFName
+	}
+
+	name := linki.PairName
+	if linki.Name != "" {
+		name += ":" + linki.Name
+	}
+
+	if name == "" {
+		return "(unnamed)"
+	}
+
+	return name
+}
+
+// podLinks reads the pod's links from its labels and annotations, ready to
+// hand to ratchet-child.
+func podLinks(netconf *config.NetConf, args *skel.CmdArgs, labels map[string]string, annotations map[string]string) ([]config.LinkInfo, error) {
+
+	// Our name and namespace only ever come from the kubelet, so no pod
+	// can name another as its own.
+	namespace, podName, _ := kube.PodArgs(args.Args)
+
+	links, err := config.LinkInfosFromMetadata(labels, annotations, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPeerNamespaces(netconf, links); err != nil {
+		return nil, err
+	}
+
+	for i := range links {
+		links[i].ParentIface = netconf.ParentIface
+		links[i].ParentAddr = netconf.ParentAddr
+		if links[i].MTU == 0 {
+			links[i].MTU = netconf.MTU
+		}
+	}
+
+	return links, nil
+}
+
+// checkPeerNamespaces makes sure the netconf lets each link's pair be in the
+// namespace it's in.
+func checkPeerNamespaces(netconf *config.NetConf, links []config.LinkInfo) error {
+	for _, linki := range links {
+		if linki.PairName == "" {
+			continue
+		}
+
+		pairNamespace, _ := config.SplitPodName(linki.PairName, linki.Namespace)
+		if !netconf.MayLink(linki.Namespace, pairNamespace) {
+			return fmt.Errorf("pods in namespace %v may not link to pods in namespace %v (see peer_namespaces)", linki.Namespace, pairNamespace)
+		}
+	}
+
+	return nil
+}
+
+func clearEtcdAssociation(podname string) error {
+	if podname == "" {
+		return nil
+	}
+
+	err := stateStore.DeletePrefix(context.Background(), config.AssociationDir(podname)+"/")
+	if err != nil {
+		return fmt.Errorf("failed to clear etcd association for %v: %v", podname, err)
+	}
+
+	return nil
+}
+
+func initStore(netconf *config.NetConf) error {
+
+	s, err := store.New(netconf)
+	if err != nil {
+		return err
+	}
+	stateStore = s
+
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := setupLogging(n, args); err != nil {
+		return err
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	state, err := loadPodState(args.ContainerID, n.CNIDir)
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		return fmt.Errorf("no ratchet state found for container %v", args.ContainerID)
+	}
+
+	if !state.Ratcheted {
+		return delegateCheck(args.IfName, n.Delegate, state.DelegateResult)
+	}
+
+	if err := delegateCheck(args.IfName, n.BootNetwork, state.DelegateResult); err != nil {
+		return err
+	}
+
+	if err := initStore(n); err != nil {
+		return err
+	}
+
+	for _, linki := range state.Links {
+		if err := checkRatchetLink(args.Netns, linki, n.PrevResult); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRatchetLink makes sure our end of the link is in the pod with the
+// address it was given, and that the pod on the other end is still around.
+func checkRatchetLink(netns string, linki config.LinkInfo, prevResult types.Result) error {
+
+	end := ourEnd(linki)
+	ifname, ip, peername := end.ifname, end.ip, end.peer
+
+	if ifname == "" || (linki.HasPair() && peername == "") {
+		return fmt.Errorf("no information in etcd for link %v of %v", linkName(linki), linki.PodKey())
+	}
+
+	addrs, err := config.ParseLinkAddrs(ip)
+	if err != nil {
+		return err
+	}
+
+	var wantIPs []net.IP
+	for _, addr := range addrs {
+		wantIPs = append(wantIPs, addr.IP)
+	}
+	if prevResult != nil {
+		prev, err := current.NewResultFromResult(prevResult)
+		if err != nil {
+			return fmt.Errorf("failed to convert prevResult: %v", err)
+		}
+		wantIPs = append(wantIPs, resultIPs(prev, netns, ifname)...)
+	}
+
+	err = ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		return checkLinkAddrs(ifname, wantIPs)
+	})
+	if err != nil {
+		return err
+	}
+
+	// A link without a pair has nobody at the other end to look for.
+	if linki.HasPair() && getAssociation(peername, "id") == "" {
+		return fmt.Errorf("peer %v of %v is gone", peername, linki.PodKey())
+	}
+
+	return nil
+}
+
+// resultIPs gives the IPs a result lists for the named interface in netns.
+func resultIPs(result *current.Result, netns string, ifname string) []net.IP {
+	var ips []net.IP
+	for _, ipc := range result.IPs {
+		if ipc.Interface == nil || *ipc.Interface >= len(result.Interfaces) {
+			continue
+		}
+		iface := result.Interfaces[*ipc.Interface]
+		if iface.Name == ifname && iface.Sandbox == netns {
+			ips = append(ips, ipc.Address.IP)
+		}
+	}
+	return ips
+}
+
+// checkLinkAddrs checks the interface (in the current netns) has every IP.
+func checkLinkAddrs(ifname string, ips []net.IP) error {
+
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("ratchet link %v is missing: %v", ifname, err)
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		found := false
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("ratchet link %v is missing address %v", ifname, ip)
+		}
+	}
+
+	return nil
 }
 
 func versionInfo(args *skel.CmdArgs) error {
@@ -448,9 +1219,10 @@ func versionInfo(args *skel.CmdArgs) error {
 
 func main() {
 
-	if DEBUG {
-		logger.Println("[LOGGING ENABLED]")
+	// Runtimes run us without arguments, admins run us with a command.
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
 	}
 
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "ratchet: connects pods with koko veth and vxlan links")
 }
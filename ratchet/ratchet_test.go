@@ -0,0 +1,81 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// fakeDelegate writes a delegate plugin to dir, which records that it ran
+// in ran, then fails with msg, unless msg is "".
+func fakeDelegate(t *testing.T, dir string, name string, msg string) {
+	script := "#!/bin/sh\necho \"$CNI_COMMAND\" >> " + filepath.Join(dir, "ran") + "\n"
+	if msg != "" {
+		script += fmt.Sprintf("echo '{\"cniVersion\": \"0.4.0\", \"code\": 11, \"msg\": \"%v\"}'\nexit 1\n", msg)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdDelWithoutState(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{name: "delegate removes the pod"},
+		{name: "delegate never set it up", msg: "container not found"},
+		{name: "delegate already let go", msg: "no such file or directory"},
+		{name: "delegate fails", msg: "permission denied", wantErr: "permission denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ratchet")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			fakeDelegate(t, dir, "fake", tt.msg)
+			defer os.Setenv("CNI_PATH", os.Getenv("CNI_PATH"))
+			os.Setenv("CNI_PATH", dir)
+
+			netconf := fmt.Sprintf(`{"name": "ratchet", "type": "ratchet", "cniDir": %q, "delegate": {"type": "fake"}}`, dir)
+			err = cmdDel(&skel.CmdArgs{ContainerID: "id", IfName: "eth0", StdinData: []byte(netconf)})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("cmdDel error = %v, want one saying %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("cmdDel: %v", err)
+			}
+
+			ran, err := ioutil.ReadFile(filepath.Join(dir, "ran"))
+			if err != nil || string(ran) != "DEL\n" {
+				t.Errorf("delegate ran %q (%v), want its DEL", ran, err)
+			}
+		})
+	}
+}